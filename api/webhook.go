@@ -2,7 +2,9 @@ package handler
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"io"
@@ -17,6 +19,9 @@ import (
 	"sync"
 	"time"
 
+	"handler/internal/botcmd"
+	"handler/internal/caption"
+	"handler/internal/cbdata"
 	"handler/internal/neomovies"
 	"handler/internal/storage"
 	"handler/internal/tg"
@@ -28,6 +33,7 @@ type update struct {
 	ChosenInline  *chosenInline   `json:"chosen_inline_result"`
 	CallbackQuery *callbackQuery  `json:"callback_query"`
 	Message       *message        `json:"message"`
+	ChannelPost   *message        `json:"channel_post"`
 	MyChatMember  json.RawMessage `json:"my_chat_member"`
 }
 
@@ -56,16 +62,12 @@ type callbackQuery struct {
 	InlineMessageID string   `json:"inline_message_id"`
 }
 
-type autoSeriesState struct {
-	KPID      int
-	StartedAt time.Time
-}
-
-var autoSeriesMu sync.Mutex
-var autoSeriesByChat = map[int64]autoSeriesState{}
+// autoSessionTTL is how long an /autoaddepisodes session stays active
+// without new episodes.
+const autoSessionTTL = 6 * time.Hour
 
-var closeMu sync.Mutex
-var closeTargetsByChat = map[int64]map[int][]int{}
+// closeTargetsTTL matches Telegram's 48h window for deleting bot messages.
+const closeTargetsTTL = 48 * time.Hour
 
 type chat struct {
 	ID int64 `json:"id"`
@@ -80,6 +82,38 @@ type message struct {
 	ReplyToMessage       *message `json:"reply_to_message"`
 	ForwardFromChat      *chat    `json:"forward_from_chat"`
 	ForwardFromMessageID int      `json:"forward_from_message_id"`
+
+	ReplyMarkup *tg.InlineKeyboardMarkup `json:"reply_markup"`
+
+	Video        *mediaFile `json:"video"`
+	Document     *mediaFile `json:"document"`
+	Animation    *mediaFile `json:"animation"`
+	MediaGroupID string     `json:"media_group_id"`
+}
+
+// mediaFile holds the fields of video, document and animation the bot uses.
+type mediaFile struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	FileSize int64  `json:"file_size"`
+	Duration int    `json:"duration"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+// media returns the attached video, document or animation, or nil.
+func (m *message) media() *mediaFile {
+	switch {
+	case m == nil:
+		return nil
+	case m.Video != nil:
+		return m.Video
+	case m.Document != nil:
+		return m.Document
+	default:
+		return m.Animation
+	}
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
@@ -92,12 +126,30 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		playerHandler(w, r)
 		return
 	}
+	if r.URL.Path == "/api/health" {
+		healthHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/api/cron/notices" {
+		noticesCronHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/api/me/favorites" {
+		favoritesHandler(w, r)
+		return
+	}
 
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
+	if !validWebhookSecret(r) {
+		log.Printf("webhook rejected: bad secret token")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
 	body, err := io.ReadAll(io.LimitReader(r.Body, 2<<20))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -125,9 +177,9 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 9*time.Second)
 	defer cancel()
 
-	bot := tg.NewClient(token)
-	movies := neomovies.NewClient(apiBase)
-	db, _ := storage.NewMongo(ctx, os.Getenv("MONGODB_URI"))
+	bot := botClient(token)
+	db := openStore(ctx)
+	movies := moviesClient(apiBase, db)
 
 	switch {
 	case upd.InlineQuery != nil:
@@ -139,19 +191,250 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	case upd.CallbackQuery != nil:
 		handleCallback(ctx, w, bot, movies, db, upd.CallbackQuery)
 		return
+	// Albums are filed by the next message or channel post (or cron run)
+	// after their window closes; the update that buffers a part doesn't wait
+	// for it. Inline and callback queries skip this, they have to be answered
+	// within seconds.
 	case upd.Message != nil:
+		flushMediaGroups(ctx, bot, db)
 		handleMessage(ctx, w, bot, movies, db, upd.Message)
 		return
+	case upd.ChannelPost != nil:
+		flushMediaGroups(ctx, bot, db)
+		handleChannelPost(ctx, bot, db, upd.ChannelPost)
+		w.WriteHeader(http.StatusOK)
+		return
 	default:
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 }
 
+var noSecretWarning sync.Once
+
+// validWebhookSecret checks the X-Telegram-Bot-Api-Secret-Token header
+// against WEBHOOK_SECRET. Without a configured secret every request passes,
+// which is logged once per instance.
+func validWebhookSecret(r *http.Request) bool {
+	secret := strings.TrimSpace(os.Getenv("WEBHOOK_SECRET"))
+	if secret == "" {
+		noSecretWarning.Do(func() {
+			log.Printf("WEBHOOK_SECRET is empty, webhook updates are not verified")
+		})
+		return true
+	}
+	got := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(secret)) == 1
+}
+
+func webhookURL() string {
+	base := strings.TrimRight(strings.TrimSpace(os.Getenv("PUBLIC_BASE_URL")), "/")
+	if base == "" {
+		return ""
+	}
+	return base + "/api/webhook"
+}
+
+var memoryStore = storage.NewMemory()
+
+// openStore picks the storage backend. STORAGE_BACKEND=memory keeps
+// everything in process memory, which is enough for cmd/local without MongoDB.
+func openStore(ctx context.Context) storage.Store {
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("STORAGE_BACKEND")), "memory") {
+		return memoryStore
+	}
+	db, err := storage.SharedMongo(ctx, os.Getenv("MONGODB_URI"))
+	if err != nil {
+		log.Printf("mongo connect error: %v", err)
+		return nil
+	}
+	return db
+}
+
+var (
+	clientsMu    sync.Mutex
+	sharedBot    *tg.Client
+	sharedBotKey string
+	sharedMovies *neomovies.Cached
+	sharedAPI    string
+	sharedCache  neomovies.CacheStore
+)
+
+// botClient and moviesClient keep one HTTP client per process so warm
+// instances reuse keep-alive connections and the lookup cache.
+func botClient(token string) *tg.Client {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if sharedBot == nil || sharedBotKey != token {
+		sharedBot = tg.NewClientWithLimiter(token, tg.NewLimiter(telegramRateLimits()))
+		sharedBotKey = token
+	}
+	return sharedBot
+}
+
+// telegramRateLimits reads the TG_RATE_* overrides of the Bot API limits.
+func telegramRateLimits() tg.RateLimits {
+	limits, err := tg.RateLimitsFromEnv(os.Getenv)
+	if err != nil {
+		log.Printf("telegram rate limits: %v, using defaults for those", err)
+	}
+	return limits
+}
+
+func moviesClient(apiBase string, db storage.Store) neomovies.API {
+	var store neomovies.CacheStore
+	if db != nil {
+		store = db
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if sharedMovies == nil || sharedAPI != apiBase || sharedCache != store {
+		sharedMovies = neomovies.NewCached(neomovies.NewClient(apiBase), store, neomovies.DefaultCacheTTLs)
+		sharedAPI = apiBase
+		sharedCache = store
+	}
+	return sharedMovies
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	status := map[string]string{"status": "ok", "storage": "ok"}
+	db := openStore(ctx)
+	if db == nil {
+		status["status"] = "degraded"
+		status["storage"] = "not configured"
+	} else if err := db.Ping(ctx); err != nil {
+		status["status"] = "degraded"
+		status["storage"] = err.Error()
+	}
+	if status["status"] != "ok" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(status)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// noticesCronHandler files due albums, sends due new-episode notices and
+// backfills missing title metadata with what is left of the budget. Nothing
+// else sends notices, so it has to be called every few minutes by a
+// scheduler such as Vercel Cron, which sends CRON_SECRET as a bearer token.
+func noticesCronHandler(w http.ResponseWriter, r *http.Request) {
+	secret := strings.TrimSpace(os.Getenv("CRON_SECRET"))
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if secret == "" || subtle.ConstantTimeCompare([]byte(got), []byte(secret)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	token := os.Getenv("BOT_TOKEN")
+	if token == "" {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("BOT_TOKEN is required"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 9*time.Second)
+	defer cancel()
+	db := openStore(ctx)
+	if db == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	apiBase := strings.TrimRight(os.Getenv("API_BASE"), "/")
+	if apiBase == "" {
+		apiBase = "https://api.neomovies.ru"
+	}
+	bot := botClient(token)
+	albums := flushMediaGroups(ctx, bot, db)
+	sent := flushEpisodeNotices(ctx, bot, db)
+	synced := backfillTitleMeta(ctx, moviesClient(apiBase, db), db)
+	writeJSON(w, map[string]int{"sent": sent, "albums": albums, "meta": synced})
+}
+
+type favoriteItem struct {
+	KPID      int       `json:"kp_id"`
+	Title     string    `json:"title"`
+	AddedAt   time.Time `json:"added_at"`
+	InLibrary bool      `json:"in_library"`
+}
+
+// webAppInitDataMaxAge bounds how old Mini App init data may be.
+const webAppInitDataMaxAge = 24 * time.Hour
+
+// webAppUser authenticates a web client request by its Telegram Mini App
+// init data, sent as "Authorization: tma <initData>" or X-Telegram-Init-Data.
+func webAppUser(r *http.Request, botToken string) (*tg.WebAppUser, error) {
+	initData := r.Header.Get("X-Telegram-Init-Data")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "tma ") {
+		initData = strings.TrimPrefix(auth, "tma ")
+	}
+	if initData == "" {
+		return nil, tg.ErrInitData
+	}
+	return tg.ValidateInitData(initData, botToken, webAppInitDataMaxAge)
+}
+
+func favoritesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	token := os.Getenv("BOT_TOKEN")
+	if token == "" {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	u, err := webAppUser(r, token)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 9*time.Second)
+	defer cancel()
+	db := openStore(ctx)
+	if db == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	favs, total, err := db.ListFavorites(ctx, u.ID, (page-1)*limit, limit)
+	if err != nil {
+		log.Printf("favorites list error: %v (user_id=%d)", err, u.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ids := make([]int, 0, len(favs))
+	for _, f := range favs {
+		ids = append(ids, f.KPID)
+	}
+	watchable, _ := db.HasWatchItems(ctx, ids)
+	items := make([]favoriteItem, 0, len(favs))
+	for _, f := range favs {
+		items = append(items, favoriteItem{KPID: f.KPID, Title: f.Title, AddedAt: f.CreatedAt, InLibrary: watchable[f.KPID]})
+	}
+	writeJSON(w, map[string]any{
+		"items": items,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
 type libraryItem struct {
 	KPID          int             `json:"kp_id"`
 	Type          string          `json:"type"`
 	Title         string          `json:"title"`
+	Year          int             `json:"year,omitempty"`
 	PosterURL     string          `json:"poster_url"`
 	Rating        float64         `json:"rating"`
 	Overview      string          `json:"overview"`
@@ -162,6 +445,18 @@ type libraryItem struct {
 	SeasonsCount  int             `json:"seasons_count,omitempty"`
 	EpisodesCount int             `json:"episodes_count,omitempty"`
 	Voices        []string        `json:"voices,omitempty"`
+	MetaPending   bool            `json:"meta_pending,omitempty"`
+}
+
+// libraryPage is the /api/library response. NextCursor fetches the next
+// page with the same filters; it is empty on the last one. Partial is set
+// when some items have no metadata yet; they carry meta_pending and their
+// kp_ids are in Pending.
+type libraryPage struct {
+	Items      []libraryItem `json:"items"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+	Partial    bool          `json:"partial"`
+	Pending    []int         `json:"pending,omitempty"`
 }
 
 type librarySeason struct {
@@ -177,8 +472,10 @@ type libraryEpisode struct {
 }
 
 type libraryEpisodeVariant struct {
-	Voice   string `json:"voice,omitempty"`
-	Quality string `json:"quality,omitempty"`
+	Voice    string `json:"voice,omitempty"`
+	Quality  string `json:"quality,omitempty"`
+	FileSize int64  `json:"file_size,omitempty"`
+	Duration int    `json:"duration,omitempty"`
 }
 
 func libraryHandler(w http.ResponseWriter, r *http.Request) {
@@ -201,8 +498,7 @@ func libraryHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 9*time.Second)
 	defer cancel()
 
-	movies := neomovies.NewClient(apiBase)
-	db, _ := storage.NewMongo(ctx, os.Getenv("MONGODB_URI"))
+	db := openStore(ctx)
 	if db == nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -219,52 +515,193 @@ func libraryHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		out, err := buildLibraryItem(ctx, movies, item)
-		if err != nil {
-			w.WriteHeader(http.StatusBadGateway)
-			return
-		}
-		writeJSON(w, out)
+		writeJSON(w, buildLibraryItem(item, apiBase))
 		return
 	}
 
-	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
-	items, err := db.ListRecent(ctx, limit)
+	q, ok := parseLibraryQuery(r.URL.Query())
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	res, err := db.QueryLibrary(ctx, q)
+	if errors.Is(err, storage.ErrBadCursor) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	if err != nil {
+		log.Printf("library query error: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	out := make([]libraryItem, 0, len(items))
+	items := res.Items
+	out := libraryPage{
+		Items:      make([]libraryItem, 0, len(items)),
+		NextCursor: res.NextCursor,
+	}
 	for i := range items {
-		li, err := buildLibraryItem(ctx, movies, &items[i])
-		if err != nil {
-			out = append(out, buildLibraryFallback(&items[i], apiBase))
-			continue
+		out.Items = append(out.Items, buildLibraryItem(&items[i], apiBase))
+		if items[i].Meta == nil {
+			out.Pending = append(out.Pending, items[i].KPID)
 		}
-		out = append(out, li)
 	}
+	out.Partial = len(out.Pending) > 0
 	writeJSON(w, out)
 }
 
-func buildLibraryItem(ctx context.Context, movies *neomovies.Client, wItem *storage.WatchItem) (libraryItem, error) {
-	info, err := movies.GetMovieByKPID(ctx, wItem.KPID)
+// parseLibraryQuery reads the /api/library filters. Malformed numbers and
+// unknown sorts are rejected rather than ignored.
+func parseLibraryQuery(v url.Values) (storage.LibraryQuery, bool) {
+	q := storage.LibraryQuery{
+		Type:    strings.TrimSpace(v.Get("type")),
+		Genre:   strings.TrimSpace(v.Get("genre")),
+		Voice:   strings.TrimSpace(v.Get("voice")),
+		Quality: strings.TrimSpace(v.Get("quality")),
+		Search:  strings.TrimSpace(v.Get("q")),
+		Cursor:  strings.TrimSpace(v.Get("cursor")),
+	}
+	sortBy, ok := storage.ParseLibrarySort(strings.TrimSpace(v.Get("sort")))
+	if !ok {
+		return q, false
+	}
+	q.Sort = sortBy
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"limit", &q.Limit}, {"year_from", &q.YearFrom}, {"year_to", &q.YearTo}} {
+		if raw := strings.TrimSpace(v.Get(p.name)); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				return q, false
+			}
+			*p.dst = n
+		}
+	}
+	if raw := strings.TrimSpace(v.Get("min_rating")); raw != "" {
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil || f < 0 {
+			return q, false
+		}
+		q.MinRating = f
+	}
+	return q, true
+}
+
+const (
+	defaultEnrichConcurrency = 6
+	maxEnrichConcurrency     = 32
+	// enrichItemTimeout bounds one title's lookups (card, search, torrents).
+	enrichItemTimeout = 3 * time.Second
+	// enrichReserve is kept back from the request budget to write the response.
+	enrichReserve = time.Second
+	// metaBackfillPerRun is how many items without metadata one cron run
+	// picks up.
+	metaBackfillPerRun = 30
+)
+
+// enrichConcurrency is LIBRARY_ENRICH_CONCURRENCY, the number of titles
+// looked up in parallel.
+func enrichConcurrency() int {
+	n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("LIBRARY_ENRICH_CONCURRENCY")))
+	if err != nil || n <= 0 {
+		return defaultEnrichConcurrency
+	}
+	return min(n, maxEnrichConcurrency)
+}
+
+// enrichLibrary syncs metadata for the items that have none, in place, with
+// a bounded pool of workers. It returns the kp_ids still without metadata
+// because their lookup failed or the request budget ran out.
+func enrichLibrary(ctx context.Context, movies neomovies.API, db storage.Store, items []storage.WatchItem) []int {
+	todo := []int{}
+	for i := range items {
+		if items[i].Meta == nil {
+			todo = append(todo, i)
+		}
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+	budget := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		budget, cancel = context.WithDeadline(ctx, deadline.Add(-enrichReserve))
+		defer cancel()
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for n := min(enrichConcurrency(), len(todo)); n > 0; n-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				itemCtx, cancel := context.WithTimeout(budget, enrichItemTimeout)
+				meta, err := syncTitleMeta(itemCtx, movies, db, items[i].KPID, items[i].Type)
+				cancel()
+				if err != nil {
+					log.Printf("meta backfill error: %v (kp_id=%d)", err, items[i].KPID)
+					continue
+				}
+				// each index is handed to one worker only
+				items[i].Meta = meta
+			}
+		}()
+	}
+feed:
+	for _, i := range todo {
+		select {
+		case jobs <- i:
+		case <-budget.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	var pending []int
+	for _, i := range todo {
+		if items[i].Meta == nil {
+			pending = append(pending, items[i].KPID)
+		}
+	}
+	return pending
+}
+
+// backfillTitleMeta enriches a sample of the items that still have no
+// metadata and returns how many were synced. The library handler serves
+// stored data only, so this and /refreshmeta are what fill the gaps.
+func backfillTitleMeta(ctx context.Context, movies neomovies.API, db storage.Store) int {
+	items, err := db.SampleMissingMeta(ctx, metaBackfillPerRun)
+	if err != nil {
+		log.Printf("meta backfill list error: %v", err)
+		return 0
+	}
+	pending := enrichLibrary(ctx, movies, db, items)
+	return len(items) - len(pending)
+}
+
+// fetchTitleMeta builds the metadata snapshot for kpID from the API,
+// backfilling empty card fields from a search by kp_id.
+func fetchTitleMeta(ctx context.Context, movies neomovies.API, kpID int, itemType string) (*storage.TitleMeta, error) {
+	info, err := movies.GetMovieByKPID(ctx, kpID)
 	if err != nil {
-		return libraryItem{}, err
+		return nil, err
 	}
 	if info == nil {
-		return libraryItem{}, fmt.Errorf("not found")
+		return nil, fmt.Errorf("not found")
 	}
 
 	// Fallback to search by kp_id if API returned empty fields
 	if info.Title == "" && info.NameRu == "" && info.Name == "" && info.NameOriginal == "" ||
 		(info.Overview == "" && info.Description == "" && info.ShortDescription == "") {
-		if sr, _ := movies.SearchMovies(ctx, strconv.Itoa(wItem.KPID), 1); sr != nil {
+		if sr, _ := movies.SearchMovies(ctx, strconv.Itoa(kpID), 1); sr != nil {
 			for _, m := range sr.Results {
 				matchID := m.ExternalIDs.KP
 				if matchID == 0 {
 					matchID = m.KinopoiskID
 				}
-				if matchID != wItem.KPID {
+				if matchID != kpID {
 					continue
 				}
 				if info.Title == "" && info.NameRu == "" && info.Name == "" && info.NameOriginal == "" {
@@ -316,19 +753,13 @@ func buildLibraryItem(ctx context.Context, movies *neomovies.Client, wItem *stor
 		}
 	}
 
-	title := strings.TrimSpace(firstNonEmpty(info.Title, info.NameRu, info.Name, info.NameOriginal, wItem.Title))
-	if title == "" {
-		title = fmt.Sprintf("kp_%d", wItem.KPID)
+	title := strings.TrimSpace(firstNonEmpty(info.Title, info.NameRu, info.Name, info.NameOriginal))
+	original := strings.TrimSpace(info.NameOriginal)
+	if original == title {
+		original = ""
 	}
 	poster := firstNonEmpty(info.PosterPath, info.PosterURLPreview, info.PosterURL)
-	posterURL := movies.ImageURL(poster, "kp", wItem.KPID)
-	if posterURL == "" {
-		apiBase := strings.TrimRight(os.Getenv("API_BASE"), "/")
-		if apiBase == "" {
-			apiBase = "https://api.neomovies.ru"
-		}
-		posterURL = fmt.Sprintf("%s/api/v1/images/kp/%d", apiBase, wItem.KPID)
-	}
+	year, _ := strconv.Atoi(releaseYear(info))
 	rating := info.Rating
 	if rating == 0 {
 		rating = info.RatingKinopoisk
@@ -336,7 +767,6 @@ func buildLibraryItem(ctx context.Context, movies *neomovies.Client, wItem *stor
 	if rating == 0 {
 		rating = info.VoteAverage
 	}
-	overview := strings.TrimSpace(firstNonEmpty(info.Overview, info.Description, info.ShortDescription))
 
 	genres := make([]string, 0, len(info.Genres))
 	for _, g := range info.Genres {
@@ -346,78 +776,77 @@ func buildLibraryItem(ctx context.Context, movies *neomovies.Client, wItem *stor
 		}
 	}
 
-	seasonsCount := 0
-	episodesCount := 0
-	if wItem.Type == "series" {
-		seasonsCount = len(wItem.Seasons)
-		for _, s := range wItem.Seasons {
-			episodesCount += len(s.Episodes)
-		}
-	}
-
-	seasons := []librarySeason{}
-	if wItem.Type == "series" && len(wItem.Seasons) > 0 {
-		seasons = make([]librarySeason, 0, len(wItem.Seasons))
-		for _, s := range wItem.Seasons {
-			ls := librarySeason{Number: s.Number}
-			if len(s.Episodes) > 0 {
-				ls.Episodes = make([]libraryEpisode, 0, len(s.Episodes))
-				for _, ep := range s.Episodes {
-					var variants []libraryEpisodeVariant
-					if len(ep.Variants) > 0 {
-						variants = make([]libraryEpisodeVariant, 0, len(ep.Variants))
-						for _, v := range ep.Variants {
-							variants = append(variants, libraryEpisodeVariant{
-								Voice:   strings.TrimSpace(v.Voice),
-								Quality: strings.TrimSpace(v.Quality),
-							})
-						}
-					}
-					ls.Episodes = append(ls.Episodes, libraryEpisode{
-						Number:   ep.Number,
-						Voice:    strings.TrimSpace(ep.Voice),
-						Quality:  strings.TrimSpace(ep.Quality),
-						Variants: variants,
-					})
-				}
-			}
-			seasons = append(seasons, ls)
-		}
-	}
-
-	voices := []string{}
+	var voices []string
 	imdb := strings.TrimSpace(info.ExternalIDs.IMDB)
 	if imdb != "" {
 		typeParam := "movie"
-		if wItem.Type == "series" {
+		if itemType == "series" {
 			typeParam = "tv"
 		}
 		trs, _ := movies.GetTorrentsByIMDB(ctx, imdb, typeParam)
 		voices = neomovies.UniqueVoices(trs)
 	}
 
-	return libraryItem{
-		KPID:          wItem.KPID,
-		Type:          wItem.Type,
+	return &storage.TitleMeta{
 		Title:         title,
-		PosterURL:     posterURL,
-		Rating:        rating,
-		Overview:      overview,
+		OriginalTitle: original,
+		Year:          year,
+		PosterURL:     movies.ImageURL(poster, "kp", kpID),
 		Genres:        genres,
-		Voice:         strings.TrimSpace(wItem.Voice),
-		Quality:       strings.TrimSpace(wItem.Quality),
-		Seasons:       seasons,
-		SeasonsCount:  seasonsCount,
-		EpisodesCount: episodesCount,
+		Rating:        rating,
+		Overview:      strings.TrimSpace(firstNonEmpty(info.Overview, info.Description, info.ShortDescription)),
+		IMDBID:        imdb,
 		Voices:        voices,
+		SyncedAt:      time.Now(),
 	}, nil
 }
 
-func buildLibraryFallback(wItem *storage.WatchItem, apiBase string) libraryItem {
-	title := strings.TrimSpace(wItem.Title)
+func releaseYear(info *neomovies.Movie) string {
+	if info.Year != "" {
+		return info.Year
+	}
+	if len(info.ReleaseDate) >= 4 {
+		return info.ReleaseDate[0:4]
+	}
+	return ""
+}
+
+// syncTitleMeta fetches the snapshot for an item and stores it.
+func syncTitleMeta(ctx context.Context, movies neomovies.API, db storage.Store, kpID int, itemType string) (*storage.TitleMeta, error) {
+	meta, err := fetchTitleMeta(ctx, movies, kpID, itemType)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.SetTitleMeta(ctx, kpID, *meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// snapshotTitleMeta is syncTitleMeta for the add commands, where a failed
+// lookup must not fail the add; /refreshmeta can retry it later.
+func snapshotTitleMeta(ctx context.Context, env *cmdEnv, kpID int, itemType string) {
+	if _, err := syncTitleMeta(ctx, env.movies, env.db, kpID, itemType); err != nil {
+		log.Printf("meta snapshot error: %v (kp_id=%d)", err, kpID)
+	}
+}
+
+// buildLibraryItem renders a stored item without calling the API. Items
+// that were never synced get the stored title and the default poster.
+func buildLibraryItem(wItem *storage.WatchItem, apiBase string) libraryItem {
+	meta := wItem.Meta
+	if meta == nil {
+		meta = &storage.TitleMeta{}
+	}
+	title := strings.TrimSpace(firstNonEmpty(meta.Title, wItem.Title))
 	if title == "" {
 		title = fmt.Sprintf("kp_%d", wItem.KPID)
 	}
+	posterURL := meta.PosterURL
+	if posterURL == "" && wItem.KPID > 0 {
+		posterURL = fmt.Sprintf("%s/api/v1/images/kp/%d", strings.TrimRight(apiBase, "/"), wItem.KPID)
+	}
+
 	seasonsCount := 0
 	episodesCount := 0
 	if wItem.Type == "series" {
@@ -426,10 +855,7 @@ func buildLibraryFallback(wItem *storage.WatchItem, apiBase string) libraryItem
 			episodesCount += len(s.Episodes)
 		}
 	}
-	posterURL := ""
-	if wItem.KPID > 0 {
-		posterURL = fmt.Sprintf("%s/api/v1/images/kp/%d", strings.TrimRight(apiBase, "/"), wItem.KPID)
-	}
+
 	seasons := []librarySeason{}
 	if wItem.Type == "series" && len(wItem.Seasons) > 0 {
 		seasons = make([]librarySeason, 0, len(wItem.Seasons))
@@ -443,8 +869,10 @@ func buildLibraryFallback(wItem *storage.WatchItem, apiBase string) libraryItem
 						variants = make([]libraryEpisodeVariant, 0, len(ep.Variants))
 						for _, v := range ep.Variants {
 							variants = append(variants, libraryEpisodeVariant{
-								Voice:   strings.TrimSpace(v.Voice),
-								Quality: strings.TrimSpace(v.Quality),
+								Voice:    strings.TrimSpace(v.Voice),
+								Quality:  strings.TrimSpace(v.Quality),
+								FileSize: v.FileSize,
+								Duration: v.Duration,
 							})
 						}
 					}
@@ -459,20 +887,23 @@ func buildLibraryFallback(wItem *storage.WatchItem, apiBase string) libraryItem
 			seasons = append(seasons, ls)
 		}
 	}
+
 	return libraryItem{
 		KPID:          wItem.KPID,
 		Type:          wItem.Type,
 		Title:         title,
+		Year:          meta.Year,
 		PosterURL:     posterURL,
-		Rating:        0,
-		Overview:      "",
-		Genres:        nil,
+		Rating:        meta.Rating,
+		Overview:      meta.Overview,
+		Genres:        meta.Genres,
 		Voice:         strings.TrimSpace(wItem.Voice),
 		Quality:       strings.TrimSpace(wItem.Quality),
 		Seasons:       seasons,
 		SeasonsCount:  seasonsCount,
 		EpisodesCount: episodesCount,
-		Voices:        nil,
+		Voices:        meta.Voices,
+		MetaPending:   wItem.Meta == nil,
 	}
 }
 
@@ -482,7 +913,7 @@ func writeJSON(w http.ResponseWriter, v any) {
 	_ = enc.Encode(v)
 }
 
-func handleInlineQuery(ctx context.Context, w http.ResponseWriter, bot *tg.Client, movies *neomovies.Client, db *storage.Mongo, q *inlineQuery) {
+func handleInlineQuery(ctx context.Context, w http.ResponseWriter, bot *tg.Client, movies neomovies.API, db storage.Store, q *inlineQuery) {
 	query := strings.TrimSpace(q.Query)
 	switch strings.ToLower(query) {
 	case "#movies", "movies":
@@ -523,14 +954,14 @@ func handleInlineQuery(ctx context.Context, w http.ResponseWriter, bot *tg.Clien
 	w.WriteHeader(http.StatusOK)
 }
 
-func handleChosenInline(ctx context.Context, w http.ResponseWriter, bot *tg.Client, movies *neomovies.Client, db *storage.Mongo, chosen *chosenInline) {
+func handleChosenInline(ctx context.Context, w http.ResponseWriter, bot *tg.Client, movies neomovies.API, db storage.Store, chosen *chosenInline) {
 	kpID, err := strconv.Atoi(strings.TrimSpace(chosen.ResultID))
 	if err != nil || kpID <= 0 {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	payload, err := buildMoviePayload(ctx, movies, db, kpID)
+	payload, err := buildMoviePayload(ctx, movies, db, chosen.From.ID, kpID)
 	if err != nil {
 		log.Printf("chosen inline payload error: %v (kp_id=%d)", err, kpID)
 		w.WriteHeader(http.StatusOK)
@@ -565,7 +996,7 @@ func handleChosenInline(ctx context.Context, w http.ResponseWriter, bot *tg.Clie
 	w.WriteHeader(http.StatusOK)
 }
 
-func buildInlineResults(ctx context.Context, movies *neomovies.Client, db *storage.Mongo, res *neomovies.SearchResponse) []tg.InlineQueryResult {
+func buildInlineResults(ctx context.Context, movies neomovies.API, db storage.Store, res *neomovies.SearchResponse) []tg.InlineQueryResult {
 	results := make([]tg.InlineQueryResult, 0, 10)
 	for i, m := range res.Results {
 		if i >= 10 {
@@ -686,16 +1117,29 @@ func truncateRunes(s string, max int) string {
 	return string([]rune(s)[:max-1]) + "…"
 }
 
-func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client, movies *neomovies.Client, db *storage.Mongo, cq *callbackQuery) {
-	data := strings.TrimSpace(cq.Data)
-	if data == "close" {
+func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client, movies neomovies.API, db storage.Store, cq *callbackQuery) {
+	act, err := cbdata.Decode(cq.Data)
+	if err != nil {
+		text := ""
+		if errors.Is(err, cbdata.ErrStale) {
+			text = "Кнопка устарела, открой меню заново"
+		}
+		_ = bot.AnswerCallbackQuery(ctx, cq.ID, text)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if _, ok := act.(cbdata.Close); ok {
 		if cq.Message != nil {
 			chatID := cq.Message.Chat.ID
 			msgID := cq.Message.MessageID
-			closeMu.Lock()
-			targets := closeTargetsByChat[chatID][msgID]
-			delete(closeTargetsByChat[chatID], msgID)
-			closeMu.Unlock()
+			var targets []int
+			if db != nil {
+				var err error
+				targets, err = db.TakeCloseTargets(ctx, chatID, msgID)
+				if err != nil {
+					log.Printf("close targets lookup error: %v (chat_id=%d msg_id=%d)", err, chatID, msgID)
+				}
+			}
 			if len(targets) > 0 {
 				for _, id := range targets {
 					_ = bot.DeleteMessage(ctx, chatID, id)
@@ -710,14 +1154,14 @@ func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client,
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	if data == "menu:new" || data == "menu:movies" || data == "menu:series" {
+	if menu, ok := act.(cbdata.Menu); ok {
 		if cq.Message != nil {
 			query := ""
 			text := "Открой поиск и набери название — я покажу карточки.\n\nПодсказка: можно нажать кнопку “Поиск” в меню."
-			if data == "menu:movies" {
+			if menu.Section == "movies" {
 				query = "#movies"
 				text = "Топ фильмов. Нажми кнопку ниже."
-			} else if data == "menu:series" {
+			} else if menu.Section == "series" {
 				query = "#tv"
 				text = "Топ сериалов. Нажми кнопку ниже."
 			}
@@ -734,14 +1178,13 @@ func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client,
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	if strings.HasPrefix(data, "watch:") {
-		kpStr := strings.TrimPrefix(data, "watch:")
-		kpID, _ := strconv.Atoi(kpStr)
-		if kpID <= 0 {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	if db == nil {
+		_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if a, ok := act.(cbdata.Watch); ok {
+		kpID := a.KPID
 
 		item, _ := db.GetWatchItemByKPID(ctx, kpID)
 		if item == nil {
@@ -755,6 +1198,24 @@ func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client,
 		if cq.Message != nil {
 			if item.Type == "movie" {
 				messageIDs := movieMessageIDs(item)
+				if len(messageIDs) > 1 {
+					// one copyMessages call keeps an album together
+					copiedIDs, err := bot.CopyMessages(ctx, cq.Message.Chat.ID, item.StorageChatID, messageIDs)
+					if err == nil && len(copiedIDs) > 0 {
+						log.Printf("copy movie album ok kp_id=%d parts=%d", item.KPID, len(copiedIDs))
+						recordProgress(ctx, db, storage.WatchProgress{UserID: cq.From.ID, KPID: item.KPID, VoiceID: cbdata.NoVoice})
+						sendAlbumCloseButton(ctx, bot, db, cq.Message.Chat.ID, copiedIDs)
+						if len(copiedIDs) < len(messageIDs) {
+							_ = bot.SendMessage(ctx, tg.SendMessageRequest{
+								ChatID: cq.Message.Chat.ID,
+								Text:   fmt.Sprintf("Скопировано частей: %d из %d", len(copiedIDs), len(messageIDs)),
+							})
+						}
+						w.WriteHeader(http.StatusOK)
+						return
+					}
+					log.Printf("copy movie album error kp_id=%d err=%v, copying one by one", item.KPID, err)
+				}
 				var lastCopied int
 				copiedIDs := []int{}
 				failed := []int{}
@@ -768,26 +1229,21 @@ func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client,
 						log.Printf("copy movie part error kp_id=%d mid=%d err=%v", item.KPID, mid, err)
 						failed = append(failed, mid)
 					}
-					time.Sleep(250 * time.Millisecond)
 				}
 				if lastCopied > 0 {
+					recordProgress(ctx, db, storage.WatchProgress{UserID: cq.From.ID, KPID: item.KPID, VoiceID: cbdata.NoVoice})
 					closeKB := tg.NewInlineKeyboardMarkup([][]tg.InlineKeyboardButton{
-						{{Text: "Закрыть", CallbackData: "close"}},
+						{{Text: "Закрыть", CallbackData: cbdata.Data(cbdata.Close{})}},
 					})
 					_ = bot.EditMessageReplyMarkup(ctx, tg.EditMessageReplyMarkupRequest{
 						ChatID:      cq.Message.Chat.ID,
 						MessageID:   lastCopied,
 						ReplyMarkup: &closeKB,
 					})
-					if len(copiedIDs) > 0 {
-						closeMu.Lock()
-						m, ok := closeTargetsByChat[cq.Message.Chat.ID]
-						if !ok {
-							m = map[int][]int{}
-							closeTargetsByChat[cq.Message.Chat.ID] = m
+					if len(copiedIDs) > 1 {
+						if err := db.SaveCloseTargets(ctx, cq.Message.Chat.ID, lastCopied, copiedIDs, closeTargetsTTL); err != nil {
+							log.Printf("close targets save error: %v (kp_id=%d)", err, item.KPID)
 						}
-						m[lastCopied] = copiedIDs
-						closeMu.Unlock()
 					}
 				}
 				if len(failed) > 0 {
@@ -803,7 +1259,7 @@ func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client,
 					if err := bot.SendMessage(ctx, tg.SendMessageRequest{
 						ChatID:      cq.Message.Chat.ID,
 						Text:        "Выбери озвучку",
-						ReplyMarkup: &kb,
+						ReplyMarkup: withSubscribeRow(ctx, db, &kb, item.KPID, cq.From.ID),
 					}); err != nil {
 						log.Printf("series menu send error: %v (kp_id=%d)", err, kpID)
 					}
@@ -812,7 +1268,7 @@ func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client,
 					if title == "" {
 						title = fmt.Sprintf("kp_%d", item.KPID)
 					}
-					if err := bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: cq.Message.Chat.ID, Text: title, ReplyMarkup: item.SeriesKeyboard()}); err != nil {
+					if err := bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: cq.Message.Chat.ID, Text: title, ReplyMarkup: withSubscribeRow(ctx, db, item.SeriesKeyboard(), item.KPID, cq.From.ID)}); err != nil {
 						log.Printf("series menu send error: %v (kp_id=%d)", err, kpID)
 					}
 				}
@@ -821,111 +1277,60 @@ func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client,
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	if strings.HasPrefix(data, "season:") {
-		parts := strings.Split(data, ":")
-		if len(parts) != 3 && len(parts) != 4 {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		kpID, _ := strconv.Atoi(parts[1])
-		seasonNum, _ := strconv.Atoi(parts[2])
-		voice := ""
-		voiceIdx := -1
-		if len(parts) == 4 && parts[3] != "" {
-			voiceIdx, _ = strconv.Atoi(parts[3])
-		}
-		if kpID <= 0 || seasonNum <= 0 {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	if a, ok := act.(cbdata.Season); ok {
+		kpID := a.KPID
+		seasonNum := a.Season
+		voiceID := a.VoiceID
 		item, _ := db.GetWatchItemByKPID(ctx, kpID)
 		if item == nil {
 			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		if voiceIdx >= 0 {
-			voice = voiceByIndex(item, voiceIdx)
-		}
 		if cq.Message != nil {
-			text := buildSeasonHeader(item, seasonNum, voice)
+			text := buildSeasonHeader(item, seasonNum, item.VoiceName(voiceID))
 			_ = bot.EditMessageText(ctx, tg.EditMessageTextRequest{
 				ChatID:      cq.Message.Chat.ID,
 				MessageID:   cq.Message.MessageID,
 				Text:        text,
-				ReplyMarkup: item.SeasonKeyboard(seasonNum, 1, voice, voiceIdx),
+				ReplyMarkup: item.SeasonKeyboard(seasonNum, 1, voiceID),
 			})
 		}
 		_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	if strings.HasPrefix(data, "seasonpage:") {
-		parts := strings.Split(data, ":")
-		if len(parts) != 4 && len(parts) != 5 {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		kpID, _ := strconv.Atoi(parts[1])
-		seasonNum, _ := strconv.Atoi(parts[2])
-		pageNum, _ := strconv.Atoi(parts[3])
-		voice := ""
-		voiceIdx := -1
-		if len(parts) == 5 && parts[4] != "" {
-			voiceIdx, _ = strconv.Atoi(parts[4])
-		}
-		if kpID <= 0 || seasonNum <= 0 || pageNum <= 0 {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	if a, ok := act.(cbdata.SeasonPage); ok {
+		kpID := a.KPID
+		seasonNum := a.Season
+		pageNum := a.Page
+		voiceID := a.VoiceID
 		item, _ := db.GetWatchItemByKPID(ctx, kpID)
 		if item == nil {
 			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		if voiceIdx >= 0 {
-			voice = voiceByIndex(item, voiceIdx)
-		}
 		if cq.Message != nil {
 			_ = bot.EditMessageReplyMarkup(ctx, tg.EditMessageReplyMarkupRequest{
 				ChatID:      cq.Message.Chat.ID,
 				MessageID:   cq.Message.MessageID,
-				ReplyMarkup: item.SeasonKeyboard(seasonNum, pageNum, voice, voiceIdx),
+				ReplyMarkup: item.SeasonKeyboard(seasonNum, pageNum, voiceID),
 			})
 		}
 		_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	if strings.HasPrefix(data, "seriesvoice:") {
-		parts := strings.Split(data, ":")
-		if len(parts) != 3 {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		kpID, _ := strconv.Atoi(parts[1])
-		voiceIdx, _ := strconv.Atoi(parts[2])
-		if kpID <= 0 {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	if a, ok := act.(cbdata.SeriesVoice); ok {
+		kpID := a.KPID
+		voiceID := a.VoiceID
 		item, _ := db.GetWatchItemByKPID(ctx, kpID)
 		if item == nil {
 			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		voice := ""
-		if voiceIdx >= 0 {
-			voice = voiceByIndex(item, voiceIdx)
-		}
 		if cq.Message != nil {
 			title := strings.TrimSpace(item.Title)
 			if title == "" {
@@ -935,26 +1340,15 @@ func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client,
 				ChatID:      cq.Message.Chat.ID,
 				MessageID:   cq.Message.MessageID,
 				Text:        title,
-				ReplyMarkup: item.SeriesKeyboardWithVoice(voice, voiceIdx),
+				ReplyMarkup: withSubscribeRow(ctx, db, item.SeriesKeyboardWithVoice(voiceID), item.KPID, cq.From.ID),
 			})
 		}
 		_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	if strings.HasPrefix(data, "seriesvoices:") {
-		parts := strings.Split(data, ":")
-		if len(parts) != 2 {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		kpID, _ := strconv.Atoi(parts[1])
-		if kpID <= 0 {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	if a, ok := act.(cbdata.SeriesVoices); ok {
+		kpID := a.KPID
 		item, _ := db.GetWatchItemByKPID(ctx, kpID)
 		if item == nil {
 			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
@@ -968,36 +1362,18 @@ func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client,
 				ChatID:      cq.Message.Chat.ID,
 				MessageID:   cq.Message.MessageID,
 				Text:        "Выбери озвучку",
-				ReplyMarkup: &kb,
+				ReplyMarkup: withSubscribeRow(ctx, db, &kb, item.KPID, cq.From.ID),
 			})
 		}
 		_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	if strings.HasPrefix(data, "ep:") {
-		parts := strings.Split(data, ":")
-		if len(parts) != 4 && len(parts) != 5 {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		kpID, _ := strconv.Atoi(parts[1])
-		seasonNum, _ := strconv.Atoi(parts[2])
-		epNum, _ := strconv.Atoi(parts[3])
-		voiceIdx := -1
-		if len(parts) == 5 && parts[4] != "" {
-			if parts[4] == "select" {
-				voiceIdx = -1
-			} else {
-				voiceIdx, _ = strconv.Atoi(parts[4])
-			}
-		}
-		if kpID <= 0 || seasonNum <= 0 || epNum <= 0 {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	if a, ok := act.(cbdata.Episode); ok {
+		kpID := a.KPID
+		seasonNum := a.Season
+		epNum := a.Episode
+		voiceID := a.VoiceID
 		item, _ := db.GetWatchItemByKPID(ctx, kpID)
 		if item == nil {
 			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
@@ -1013,33 +1389,19 @@ func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client,
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		if err := sendEpisodeWithNav(ctx, bot, item, chatID, seasonNum, epNum, voiceIdx, -1); err != nil {
+		if err := sendEpisodeWithNav(ctx, bot, db, item, cq.From.ID, chatID, seasonNum, epNum, voiceID, -1); err != nil {
 			log.Printf("episode send error: %v (kp_id=%d s=%d e=%d)", err, kpID, seasonNum, epNum)
 		}
 		_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	if strings.HasPrefix(data, "epnav:") {
-		parts := strings.Split(data, ":")
-		if len(parts) != 5 && len(parts) != 6 {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		kpID, _ := strconv.Atoi(parts[1])
-		seasonNum, _ := strconv.Atoi(parts[2])
-		epNum, _ := strconv.Atoi(parts[3])
-		dir, _ := strconv.Atoi(parts[4])
-		voiceIdx := -1
-		if len(parts) == 6 && parts[5] != "" {
-			voiceIdx, _ = strconv.Atoi(parts[5])
-		}
-		if kpID <= 0 || seasonNum <= 0 || epNum <= 0 || (dir != -1 && dir != 1) {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	if a, ok := act.(cbdata.EpisodeNav); ok {
+		kpID := a.KPID
+		seasonNum := a.Season
+		epNum := a.Episode
+		dir := a.Dir
+		voiceID := a.VoiceID
 		item, _ := db.GetWatchItemByKPID(ctx, kpID)
 		if item == nil {
 			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
@@ -1057,9 +1419,18 @@ func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client,
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		nextEp := epNum + dir
-		if err := sendEpisodeWithNav(ctx, bot, item, chatID, seasonNum, nextEp, voiceIdx, -1); err != nil {
-			log.Printf("episode nav error: %v (kp_id=%d s=%d e=%d)", err, kpID, seasonNum, nextEp)
+		nextSeason, nextEp, ok := item.AdjacentEpisode(seasonNum, epNum, dir, item.VoiceName(voiceID))
+		if !ok {
+			text := "Это последняя серия"
+			if dir < 0 {
+				text = "Это первая серия"
+			}
+			_ = bot.AnswerCallbackQuery(ctx, cq.ID, text)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if err := sendEpisodeWithNav(ctx, bot, db, item, cq.From.ID, chatID, nextSeason, nextEp, voiceID, -1); err != nil {
+			log.Printf("episode nav error: %v (kp_id=%d s=%d e=%d)", err, kpID, nextSeason, nextEp)
 		} else if msgID != 0 {
 			_ = bot.DeleteMessage(ctx, chatID, msgID)
 		}
@@ -1067,22 +1438,11 @@ func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client,
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	if strings.HasPrefix(data, "epv:") {
-		parts := strings.Split(data, ":")
-		if len(parts) != 5 {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		kpID, _ := strconv.Atoi(parts[1])
-		seasonNum, _ := strconv.Atoi(parts[2])
-		epNum, _ := strconv.Atoi(parts[3])
-		variantIdx, _ := strconv.Atoi(parts[4])
-		if kpID <= 0 || seasonNum <= 0 || epNum <= 0 {
-			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	if a, ok := act.(cbdata.EpisodeVariant); ok {
+		kpID := a.KPID
+		seasonNum := a.Season
+		epNum := a.Episode
+		variantIdx := a.Variant
 		item, _ := db.GetWatchItemByKPID(ctx, kpID)
 		if item == nil {
 			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
@@ -1098,7 +1458,7 @@ func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client,
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		if err := sendEpisodeWithNav(ctx, bot, item, chatID, seasonNum, epNum, -1, variantIdx); err != nil {
+		if err := sendEpisodeWithNav(ctx, bot, db, item, cq.From.ID, chatID, seasonNum, epNum, cbdata.NoVoice, variantIdx); err != nil {
 			log.Printf("episode voice send error: %v (kp_id=%d s=%d e=%d)", err, kpID, seasonNum, epNum)
 		}
 		_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
@@ -1106,457 +1466,1494 @@ func handleCallback(ctx context.Context, w http.ResponseWriter, bot *tg.Client,
 		return
 	}
 
-	_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
-	w.WriteHeader(http.StatusOK)
-}
-
-func handleMessage(ctx context.Context, w http.ResponseWriter, bot *tg.Client, movies *neomovies.Client, db *storage.Mongo, msg *message) {
-	text := strings.TrimSpace(msg.Text)
-	log.Printf("message received chat_id=%d text=%q", msg.Chat.ID, text)
-	if strings.HasPrefix(text, "/start") {
-		log.Printf("/start from chat_id=%d", msg.Chat.ID)
-		parts := strings.Fields(text)
-		if len(parts) > 1 {
-			payload := strings.TrimSpace(parts[1])
-			if strings.HasPrefix(payload, "get_") {
-				idStr := strings.TrimPrefix(payload, "get_")
-				if kpID, _ := strconv.Atoi(idStr); kpID > 0 {
-					if err := sendMovieCard(ctx, bot, movies, db, msg.Chat.ID, kpID); err != nil {
-						log.Printf("start get error: %v (kp_id=%d)", err, kpID)
-					}
-					w.WriteHeader(http.StatusOK)
-					return
-				}
-			}
-		}
-		kb := tg.NewInlineKeyboardMarkup([][]tg.InlineKeyboardButton{
-			{{Text: "Фильмы", CallbackData: "menu:movies"}, {Text: "Сериалы", CallbackData: "menu:series"}},
-			{{Text: "Поиск", SwitchInlineQueryCurrentChat: tg.StrPtr("")}},
-			{{Text: "Кинотека в боте(Сайт)", URL: "https://tg.neomovies.ru/"}}, {{Text: "Кинотека в боте(Канал)", URL: "https://t.me/neomovies_tg"}},
-			{{Text: "Закрыть", CallbackData: "close"}},
-		})
-		if err := bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Это библиотека кино и сериалов с быстрым поиском.\n\nНажми “Поиск” и введи название — я покажу карточки.\n\nЕсли просто написать @neomovies_tg_bot без текста — покажу популярное.", ReplyMarkup: &kb}); err != nil {
-			log.Printf("/start sendMessage error: %v", err)
+	if a, ok := act.(cbdata.Favorite); ok {
+		title := titleForKPID(ctx, movies, db, a.KPID)
+		if err := db.AddFavorite(ctx, storage.Favorite{UserID: cq.From.ID, KPID: a.KPID, Title: title}); err != nil {
+			log.Printf("add favorite error: %v (user_id=%d kp_id=%d)", err, cq.From.ID, a.KPID)
+			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "Не удалось добавить в избранное")
+		} else {
+			swapCallbackButton(ctx, bot, cq, favoriteButton(ctx, db, a.KPID, cq.From.ID))
+			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "Добавлено в избранное")
 		}
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	if strings.HasPrefix(text, "/get ") {
-		parts := strings.Fields(text)
-		if len(parts) < 2 {
-			w.WriteHeader(http.StatusOK)
-			return
+	if a, ok := act.(cbdata.Unfavorite); ok {
+		if err := db.RemoveFavorite(ctx, cq.From.ID, a.KPID); err != nil {
+			log.Printf("remove favorite error: %v (user_id=%d kp_id=%d)", err, cq.From.ID, a.KPID)
+			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "Не удалось убрать из избранного")
+		} else {
+			swapCallbackButton(ctx, bot, cq, favoriteButton(ctx, db, a.KPID, cq.From.ID))
+			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "Убрано из избранного")
 		}
-		kpID, _ := strconv.Atoi(parts[1])
-		if kpID <= 0 {
-			w.WriteHeader(http.StatusOK)
-			return
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if a, ok := act.(cbdata.Card); ok {
+		_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
+		if cq.Message != nil {
+			if err := sendMovieCard(ctx, bot, movies, db, cq.Message.Chat.ID, cq.From.ID, a.KPID); err != nil {
+				log.Printf("card send error: %v (kp_id=%d)", err, a.KPID)
+			}
 		}
-		if err := sendMovieCard(ctx, bot, movies, db, msg.Chat.ID, kpID); err != nil {
-			log.Printf("public /get error: %v (kp_id=%d)", err, kpID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if a, ok := act.(cbdata.FavoritesPage); ok {
+		if cq.Message != nil {
+			text, kb, err := favoritesPage(ctx, db, cq.From.ID, a.Page)
+			if err != nil {
+				log.Printf("favorites page error: %v (user_id=%d)", err, cq.From.ID)
+			} else {
+				_ = bot.EditMessageText(ctx, tg.EditMessageTextRequest{
+					ChatID:      cq.Message.Chat.ID,
+					MessageID:   cq.Message.MessageID,
+					Text:        text,
+					ReplyMarkup: kb,
+				})
+			}
 		}
+		_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-
-	if handled := handleAutoEpisode(ctx, bot, db, msg); handled {
+	if a, ok := act.(cbdata.Request); ok {
+		title := titleForKPID(ctx, movies, db, a.KPID)
+		votes, added, err := db.AddContentRequest(ctx, a.KPID, title, cq.From.ID)
+		switch {
+		case err != nil:
+			log.Printf("content request error: %v (user_id=%d kp_id=%d)", err, cq.From.ID, a.KPID)
+			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "Не удалось отправить запрос")
+		case added:
+			_ = bot.AnswerCallbackQuery(ctx, cq.ID, fmt.Sprintf("Запрос принят, напишу когда появится. Запросов: %d", votes))
+		default:
+			_ = bot.AnswerCallbackQuery(ctx, cq.ID, fmt.Sprintf("Ты уже запрашивал. Запросов: %d", votes))
+		}
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-
-	if text == "/help" || text == "help" {
-		adminChatIDStr := strings.TrimSpace(os.Getenv("ADMIN_CHAT_ID"))
-		if adminChatIDStr == "" {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: fmt.Sprintf("ADMIN_CHAT_ID не задан. Твой chat_id=%d", msg.Chat.ID)})
+	if a, ok := act.(cbdata.RequestDone); ok {
+		if cq.Message == nil || !isAdminChat(cq.Message.Chat.ID) {
+			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		adminChatID, err := strconv.ParseInt(adminChatIDStr, 10, 64)
-		if err != nil || adminChatID == 0 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: fmt.Sprintf("ADMIN_CHAT_ID неверный. Твой chat_id=%d", msg.Chat.ID)})
+		notified, err := completeContentRequest(ctx, bot, db, a.KPID)
+		if err != nil {
+			log.Printf("complete request error: %v (kp_id=%d)", err, a.KPID)
+			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "Ошибка")
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		if msg.Chat.ID != adminChatID {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: fmt.Sprintf("Нет доступа. Твой chat_id=%d", msg.Chat.ID)})
-			w.WriteHeader(http.StatusOK)
-			return
+		if text, kb, err := contentRequestsList(ctx, db); err == nil {
+			_ = bot.EditMessageText(ctx, tg.EditMessageTextRequest{
+				ChatID:      cq.Message.Chat.ID,
+				MessageID:   cq.Message.MessageID,
+				Text:        text,
+				ReplyMarkup: kb,
+			})
 		}
-		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "/help\n\n/addmovie <kp_id> <voice> <quality> <storage_chat_id> <storage_message_id[,storage_message_id...]>\n/addmovie <kp_id> <voice> <quality>   (reply to forwarded channel post)\n/addmoviepart <kp_id>   (reply to forwarded channel post, append part)\n\n/addseries <kp_id> <title>\n\n/addepisode <kp_id> <season> <episode> <voice> <quality> <storage_chat_id> <storage_message_id>\n/addepisode <kp_id> <season> <episode> <voice> <quality>   (reply to forwarded channel post)\n\n/autoaddepisodes <kp_id>\n/autostop\n\n/delepisode <kp_id> <season> <episode>\n/delseason <kp_id> <season>\n\n/getinfo <kp_id>\n/del <kp_id>\n/list [limit]"})
+		_ = bot.AnswerCallbackQuery(ctx, cq.ID, fmt.Sprintf("Готово, уведомлено: %d", notified))
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-
-	adminChatIDStr := strings.TrimSpace(os.Getenv("ADMIN_CHAT_ID"))
-	if adminChatIDStr == "" {
+	if a, ok := act.(cbdata.Subscribe); ok {
+		if err := db.Subscribe(ctx, cq.From.ID, a.KPID); err != nil {
+			log.Printf("subscribe error: %v (user_id=%d kp_id=%d)", err, cq.From.ID, a.KPID)
+			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "Не удалось подписаться")
+		} else {
+			swapCallbackButton(ctx, bot, cq, subscribeButton(ctx, db, a.KPID, cq.From.ID))
+			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "Пришлю сообщение, когда выйдут новые серии")
+		}
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	adminChatID, err := strconv.ParseInt(adminChatIDStr, 10, 64)
-	if err != nil || adminChatID == 0 {
-		if text == "/help" || text == "help" {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: fmt.Sprintf("ADMIN_CHAT_ID неверный. Твой chat_id=%d", msg.Chat.ID)})
+	if a, ok := act.(cbdata.Unsubscribe); ok {
+		if err := db.Unsubscribe(ctx, cq.From.ID, a.KPID); err != nil {
+			log.Printf("unsubscribe error: %v (user_id=%d kp_id=%d)", err, cq.From.ID, a.KPID)
+			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "Не удалось отписаться")
+		} else {
+			swapCallbackButton(ctx, bot, cq, subscribeButton(ctx, db, a.KPID, cq.From.ID))
+			_ = bot.AnswerCallbackQuery(ctx, cq.ID, "Подписка отменена")
 		}
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	if msg.Chat.ID != adminChatID {
-		if text == "/help" || text == "help" {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: fmt.Sprintf("Нет доступа. Твой chat_id=%d", msg.Chat.ID)})
+
+	_ = bot.AnswerCallbackQuery(ctx, cq.ID, "")
+	w.WriteHeader(http.StatusOK)
+}
+
+// swapCallbackButton replaces the pressed button of cq's message with btn.
+func swapCallbackButton(ctx context.Context, bot *tg.Client, cq *callbackQuery, btn tg.InlineKeyboardButton) {
+	if cq.Message == nil || cq.Message.ReplyMarkup == nil {
+		return
+	}
+	kb := *cq.Message.ReplyMarkup
+	changed := false
+	for i, row := range kb.InlineKeyboard {
+		for j, b := range row {
+			if b.CallbackData == cq.Data {
+				kb.InlineKeyboard[i][j] = btn
+				changed = true
+			}
 		}
-		w.WriteHeader(http.StatusOK)
+	}
+	if !changed {
 		return
 	}
+	_ = bot.EditMessageReplyMarkup(ctx, tg.EditMessageReplyMarkupRequest{
+		ChatID:      cq.Message.Chat.ID,
+		MessageID:   cq.Message.MessageID,
+		ReplyMarkup: &kb,
+	})
+}
 
-	if strings.HasPrefix(text, "/addmovie ") {
-		parts := strings.Fields(text)
-		if len(parts) != 4 && len(parts) != 6 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Usage: /addmovie <kp_id> <voice> <quality> <storage_chat_id> <storage_message_id[,storage_message_id...]> OR reply to forwarded post: /addmovie <kp_id> <voice> <quality>"})
-			w.WriteHeader(http.StatusOK)
-			return
+// cmdEnv is what command handlers get besides their arguments.
+type cmdEnv struct {
+	bot    *tg.Client
+	movies neomovies.API
+	db     storage.Store
+	msg    *message
+}
+
+func (e *cmdEnv) reply(ctx context.Context, text string) {
+	_ = e.bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: e.msg.Chat.ID, Text: text})
+}
+
+func (e *cmdEnv) userID() int64 {
+	if e.msg.From == nil {
+		return 0
+	}
+	return e.msg.From.ID
+}
+
+type command = botcmd.Command[*cmdEnv]
+
+var commands *botcmd.Registry[*cmdEnv]
+
+func init() {
+	commands = newCommandRegistry()
+}
+
+func newCommandRegistry() *botcmd.Registry[*cmdEnv] {
+	r := botcmd.NewRegistry[*cmdEnv]()
+	r.Register(&command{Name: "start", Args: []botcmd.Arg{{Name: "payload", Optional: true}}, Description: "Главное меню", Handler: cmdStart})
+	r.Register(&command{Name: "get", Args: []botcmd.Arg{{Name: "kp_id"}}, Description: "Карточка фильма по kp_id", Handler: cmdGet})
+	r.Register(&command{Name: "help", Description: "Список команд", Handler: cmdHelp})
+	r.Register(&command{Name: "favorites", Description: "Избранное", Handler: requireDB(cmdFavorites)})
+
+	r.Register(&command{
+		Name:        "addmovie",
+		Args:        []botcmd.Arg{{Name: "kp_id"}, {Name: "voice"}, {Name: "quality"}, {Name: "storage_chat_id", Optional: true}, {Name: "storage_message_id[,storage_message_id...]", Optional: true}},
+		Description: "Добавить фильм",
+		AltForms:    []string{"/addmovie <kp_id> <voice> <quality>   (reply to forwarded channel post)"},
+		AdminOnly:   true,
+		Handler:     requireDB(cmdAddMovie),
+	})
+	r.Register(&command{
+		Name:        "addmoviepart",
+		Args:        []botcmd.Arg{{Name: "kp_id"}},
+		Description: "Добавить часть фильма",
+		Note:        "(reply to forwarded channel post, append part)",
+		AdminOnly:   true,
+		Handler:     requireDB(cmdAddMoviePart),
+	})
+	r.Register(&command{
+		Name:        "addseries",
+		Args:        []botcmd.Arg{{Name: "kp_id"}, {Name: "title", Rest: true}},
+		Description: "Добавить сериал",
+		AdminOnly:   true,
+		Handler:     requireDB(cmdAddSeries),
+	})
+	r.Register(&command{
+		Name:        "addepisode",
+		Args:        []botcmd.Arg{{Name: "kp_id"}, {Name: "season"}, {Name: "episode"}, {Name: "voice"}, {Name: "quality"}, {Name: "storage_chat_id", Optional: true}, {Name: "storage_message_id", Optional: true}},
+		Description: "Добавить серию",
+		AltForms:    []string{"/addepisode <kp_id> <season> <episode> <voice> <quality>   (reply to forwarded channel post)"},
+		AdminOnly:   true,
+		Handler:     requireDB(cmdAddEpisode),
+	})
+	r.Register(&command{Name: "autoaddepisodes", Args: []botcmd.Arg{{Name: "kp_id|stop"}}, Description: "Автодобавление серий", AdminOnly: true, Handler: requireDB(cmdAutoAdd)})
+	r.Register(&command{Name: "autostatus", Description: "Статус автодобавления", AdminOnly: true, Handler: requireDB(cmdAutoStatus)})
+	r.Register(&command{
+		Name:        "testcaption",
+		Args:        []botcmd.Arg{{Name: "caption", Optional: true, Rest: true}},
+		Description: "Проверить разбор подписи",
+		Note:        "(или ответом на пост; chat_id канала перед подписью включает его шаблоны)",
+		AdminOnly:   true,
+		Handler:     cmdTestCaption,
+	})
+	r.Register(&command{
+		Name:        "captiontemplate",
+		Args:        []botcmd.Arg{{Name: "chat_id"}, {Name: "add|del", Optional: true}, {Name: "regex|n", Optional: true, Rest: true}},
+		Description: "Шаблоны подписей канала",
+		Note:        "(группы season, episode, episode_end, voice, quality)",
+		AdminOnly:   true,
+		Handler:     requireDB(cmdCaptionTemplate),
+	})
+	r.Register(&command{Name: "autostop", Description: "Выключить автодобавление", AdminOnly: true, Handler: requireDB(cmdAutoStop)})
+	r.Register(&command{Name: "delepisode", Args: []botcmd.Arg{{Name: "kp_id"}, {Name: "season"}, {Name: "episode"}}, Description: "Удалить серию", AdminOnly: true, Handler: requireDB(cmdDelEpisode)})
+	r.Register(&command{Name: "delseason", Args: []botcmd.Arg{{Name: "kp_id"}, {Name: "season"}}, Description: "Удалить сезон", AdminOnly: true, Handler: requireDB(cmdDelSeason)})
+	r.Register(&command{Name: "getinfo", Args: []botcmd.Arg{{Name: "kp_id"}}, Description: "Данные записи", AdminOnly: true, Handler: requireDB(cmdGetInfo)})
+	r.Register(&command{Name: "refreshmeta", Args: []botcmd.Arg{{Name: "kp_id|all"}}, Description: "Обновить метаданные", AdminOnly: true, Handler: requireDB(cmdRefreshMeta)})
+	r.Register(&command{Name: "del", Args: []botcmd.Arg{{Name: "kp_id"}}, Description: "Удалить запись", AdminOnly: true, Handler: requireDB(cmdDel)})
+	r.Register(&command{
+		Name:        "requests",
+		Args:        []botcmd.Arg{{Name: "done", Optional: true}, {Name: "kp_id", Optional: true}},
+		Description: "Запросы пользователей",
+		AdminOnly:   true,
+		Handler:     requireDB(cmdRequests),
+	})
+	r.Register(&command{Name: "list", Args: []botcmd.Arg{{Name: "limit", Optional: true}}, Description: "Последние записи", AdminOnly: true, Handler: requireDB(cmdList)})
+	r.Register(&command{Name: "setwebhook", Args: []botcmd.Arg{{Name: "url", Optional: true}}, Description: "Зарегистрировать webhook", AdminOnly: true, Handler: cmdSetWebhook})
+	r.Register(&command{Name: "webhookinfo", Description: "Состояние webhook", AdminOnly: true, Handler: cmdWebhookInfo})
+	r.Register(&command{Name: "setcommands", Description: "Обновить меню команд", AdminOnly: true, Handler: cmdSetCommands})
+	return r
+}
+
+func requireDB(h botcmd.Handler[*cmdEnv]) botcmd.Handler[*cmdEnv] {
+	return func(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+		if env.db == nil {
+			env.reply(ctx, "DB not configured")
+			return nil
 		}
-		kpID, _ := strconv.Atoi(parts[1])
-		voice := strings.TrimSpace(parts[2])
-		quality := strings.TrimSpace(parts[3])
-		var storageChatID int64
-		var storageMsgIDs []int
-		if len(parts) == 6 {
-			storageChatID, _ = strconv.ParseInt(parts[4], 10, 64)
-			storageMsgIDs = parseMessageIDList(parts[5])
+		return h(ctx, env, args)
+	}
+}
+
+// adminChatID returns ADMIN_CHAT_ID, or a reason why it is unusable.
+func adminChatID() (int64, string) {
+	raw := strings.TrimSpace(os.Getenv("ADMIN_CHAT_ID"))
+	if raw == "" {
+		return 0, "ADMIN_CHAT_ID не задан"
+	}
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || id == 0 {
+		return 0, "ADMIN_CHAT_ID неверный"
+	}
+	return id, ""
+}
+
+func isAdminChat(chatID int64) bool {
+	id, _ := adminChatID()
+	return id != 0 && id == chatID
+}
+
+// getMeRetry is how long a failed getMe is remembered, so an outage doesn't
+// add a Bot API call to every command.
+const getMeRetry = time.Minute
+
+var (
+	botUsernameMu      sync.Mutex
+	botUsername        string
+	botUsernameRetryAt time.Time
+)
+
+// cachedBotUsername resolves the bot's @username once per process so
+// "/cmd@otherbot" in groups can be ignored. Empty means unknown.
+func cachedBotUsername(ctx context.Context, bot *tg.Client) string {
+	if name := strings.TrimSpace(os.Getenv("BOT_USERNAME")); name != "" {
+		return name
+	}
+	botUsernameMu.Lock()
+	defer botUsernameMu.Unlock()
+	if botUsername == "" && time.Now().After(botUsernameRetryAt) {
+		if me, err := bot.GetMe(ctx); err == nil {
+			botUsername = me.Username
 		} else {
-			if msg.ReplyToMessage == nil || msg.ReplyToMessage.ForwardFromChat == nil || msg.ReplyToMessage.ForwardFromMessageID == 0 {
-				_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Reply to a forwarded post from the storage channel."})
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-			storageChatID = msg.ReplyToMessage.ForwardFromChat.ID
-			storageMsgIDs = []int{msg.ReplyToMessage.ForwardFromMessageID}
+			log.Printf("getMe error: %v", err)
+			botUsernameRetryAt = time.Now().Add(getMeRetry)
 		}
-		if kpID <= 0 || voice == "" || quality == "" || storageChatID == 0 || len(storageMsgIDs) == 0 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Invalid args"})
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		_ = db.UpsertWatchMovie(ctx, kpID, voice, quality, storageChatID, storageMsgIDs)
-		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "OK"})
-		w.WriteHeader(http.StatusOK)
-		return
 	}
-	if strings.HasPrefix(text, "/autoaddepisodes ") {
-		parts := strings.Fields(text)
-		if len(parts) != 2 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Usage: /autoaddepisodes <kp_id>"})
+	return botUsername
+}
+
+func handleMessage(ctx context.Context, w http.ResponseWriter, bot *tg.Client, movies neomovies.API, db storage.Store, msg *message) {
+	text := strings.TrimSpace(msg.Text)
+	log.Printf("message received chat_id=%d text=%q", msg.Chat.ID, text)
+	if text == "help" {
+		text = "/help"
+	}
+	env := &cmdEnv{bot: bot, movies: movies, db: db, msg: msg}
+
+	if _, _, isCmd := botcmd.Split(text); isCmd {
+		cmd, args, err := commands.Lookup(text, cachedBotUsername(ctx, bot))
+		if errors.Is(err, botcmd.ErrUnknown) {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		kpID, _ := strconv.Atoi(parts[1])
-		if kpID <= 0 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Invalid kp_id"})
+		if cmd.AdminOnly && !isAdminChat(msg.Chat.ID) {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		autoSeriesMu.Lock()
-		autoSeriesByChat[msg.Chat.ID] = autoSeriesState{KPID: kpID, StartedAt: time.Now()}
-		autoSeriesMu.Unlock()
-		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: fmt.Sprintf("OK. Автодобавление включено для kp_id=%d. Пересылай посты с видео.", kpID)})
+		if err == nil {
+			err = cmd.Handler(ctx, env, args)
+		}
+		if errors.Is(err, botcmd.ErrUsage) {
+			env.reply(ctx, cmd.UsageText())
+		} else if err != nil {
+			log.Printf("/%s error: %v (chat_id=%d)", cmd.Name, err, msg.Chat.ID)
+			env.reply(ctx, fmt.Sprintf("Error: %v", err))
+		}
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	if text == "/autostop" || text == "/autoaddepisodes stop" {
-		autoSeriesMu.Lock()
-		delete(autoSeriesByChat, msg.Chat.ID)
-		autoSeriesMu.Unlock()
-		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "OK. Автодобавление выключено."})
-		w.WriteHeader(http.StatusOK)
-		return
+
+	if !handleAutoEpisode(ctx, bot, db, msg) && isAdminChat(msg.Chat.ID) && db != nil &&
+		msg.MediaGroupID != "" && msg.ForwardFromChat != nil && msg.ForwardFromMessageID != 0 {
+		bufferAlbumPart(ctx, db, msg.ForwardFromChat.ID, msg.ForwardFromMessageID, msg.Chat.ID, msg)
 	}
-	if strings.HasPrefix(text, "/addmoviepart ") {
-		parts := strings.Fields(text)
-		if len(parts) != 2 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Usage: /addmoviepart <kp_id> (reply to forwarded post)"})
-			w.WriteHeader(http.StatusOK)
-			return
+	w.WriteHeader(http.StatusOK)
+}
+
+// forwardedRef returns the storage channel post the admin replied to.
+func forwardedRef(msg *message) (int64, int, bool) {
+	if msg.ReplyToMessage == nil || msg.ReplyToMessage.ForwardFromChat == nil || msg.ReplyToMessage.ForwardFromMessageID == 0 {
+		return 0, 0, false
+	}
+	return msg.ReplyToMessage.ForwardFromChat.ID, msg.ReplyToMessage.ForwardFromMessageID, true
+}
+
+func cmdStart(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	msg := env.msg
+	log.Printf("/start from chat_id=%d", msg.Chat.ID)
+	if payload := args.String(0); strings.HasPrefix(payload, "get_") {
+		if kpID, _ := strconv.Atoi(strings.TrimPrefix(payload, "get_")); kpID > 0 {
+			if err := sendMovieCard(ctx, env.bot, env.movies, env.db, msg.Chat.ID, env.userID(), kpID); err != nil {
+				log.Printf("start get error: %v (kp_id=%d)", err, kpID)
+			}
+			return nil
 		}
-		kpID, _ := strconv.Atoi(parts[1])
-		if kpID <= 0 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Invalid kp_id"})
-			w.WriteHeader(http.StatusOK)
-			return
+	}
+	kb := tg.NewInlineKeyboardMarkup([][]tg.InlineKeyboardButton{
+		{{Text: "Фильмы", CallbackData: cbdata.Data(cbdata.Menu{Section: "movies"})}, {Text: "Сериалы", CallbackData: cbdata.Data(cbdata.Menu{Section: "series"})}},
+		{{Text: "Поиск", SwitchInlineQueryCurrentChat: tg.StrPtr("")}},
+		{{Text: "Кинотека в боте(Сайт)", URL: "https://tg.neomovies.ru/"}}, {{Text: "Кинотека в боте(Канал)", URL: "https://t.me/neomovies_tg"}},
+		{{Text: "Закрыть", CallbackData: cbdata.Data(cbdata.Close{})}},
+	})
+	if row := continueRow(ctx, env.db, env.userID()); row != nil {
+		kb.InlineKeyboard = append([][]tg.InlineKeyboardButton{row}, kb.InlineKeyboard...)
+	}
+	if err := env.bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Это библиотека кино и сериалов с быстрым поиском.\n\nНажми “Поиск” и введи название — я покажу карточки.\n\nЕсли просто написать @neomovies_tg_bot без текста — покажу популярное.", ReplyMarkup: &kb}); err != nil {
+		log.Printf("/start sendMessage error: %v", err)
+	}
+	return nil
+}
+
+// continueRow offers the next episode of the series the user watched most
+// recently, if there is one.
+func continueRow(ctx context.Context, db storage.Store, userID int64) []tg.InlineKeyboardButton {
+	if db == nil || userID == 0 {
+		return nil
+	}
+	recent, err := db.RecentProgress(ctx, userID, 5)
+	if err != nil {
+		log.Printf("recent progress error: %v (user_id=%d)", err, userID)
+		return nil
+	}
+	for i := range recent {
+		p := &recent[i]
+		if p.Season <= 0 {
+			continue
 		}
-		if msg.ReplyToMessage == nil || msg.ReplyToMessage.ForwardFromChat == nil || msg.ReplyToMessage.ForwardFromMessageID == 0 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Reply to a forwarded post from the storage channel."})
-			w.WriteHeader(http.StatusOK)
-			return
+		item, _ := db.GetWatchItemByKPID(ctx, p.KPID)
+		if item == nil || item.Type != "series" {
+			continue
 		}
-		storageChatID := msg.ReplyToMessage.ForwardFromChat.ID
-		storageMsgID := msg.ReplyToMessage.ForwardFromMessageID
-		if err := db.AppendMovieParts(ctx, kpID, storageChatID, []int{storageMsgID}); err != nil {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: fmt.Sprintf("Error: %v", err)})
-			w.WriteHeader(http.StatusOK)
-			return
+		next, ok := nextEpisodeAfter(item, p)
+		if !ok {
+			continue
 		}
-		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "OK"})
-		w.WriteHeader(http.StatusOK)
-		return
+		text := fmt.Sprintf("Продолжить: S%dE%d", next.Season, next.Episode)
+		if title := strings.TrimSpace(item.Title); title != "" {
+			text = fmt.Sprintf("Продолжить: %s S%dE%d", truncateRunes(title, 32), next.Season, next.Episode)
+		}
+		return []tg.InlineKeyboardButton{{Text: text, CallbackData: cbdata.Data(next)}}
+	}
+	return nil
+}
+
+func cmdFavorites(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	text, kb, err := favoritesPage(ctx, env.db, env.userID(), 1)
+	if err != nil {
+		return err
+	}
+	return env.bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: env.msg.Chat.ID, Text: text, ReplyMarkup: kb})
+}
+
+const favoritesPerPage = 8
+
+// favoritesPage renders one page of a user's favorites: a button per title
+// that opens its card, plus "Смотреть в Telegram" for titles in the library.
+func favoritesPage(ctx context.Context, db storage.Store, userID int64, page int) (string, *tg.InlineKeyboardMarkup, error) {
+	if page < 1 {
+		page = 1
+	}
+	favs, total, err := db.ListFavorites(ctx, userID, (page-1)*favoritesPerPage, favoritesPerPage)
+	if err != nil {
+		return "", nil, err
+	}
+	if total == 0 {
+		kb := tg.NewInlineKeyboardMarkup([][]tg.InlineKeyboardButton{{{Text: "Закрыть", CallbackData: cbdata.Data(cbdata.Close{})}}})
+		return "Избранное пусто. Добавляй фильмы и сериалы кнопкой “В избранное” на карточке.", &kb, nil
+	}
+	totalPages := (total + favoritesPerPage - 1) / favoritesPerPage
+	if page > totalPages && len(favs) == 0 {
+		return favoritesPage(ctx, db, userID, totalPages)
+	}
+	ids := make([]int, 0, len(favs))
+	for _, f := range favs {
+		ids = append(ids, f.KPID)
+	}
+	watchable, err := db.HasWatchItems(ctx, ids)
+	if err != nil {
+		log.Printf("favorites library lookup error: %v", err)
+	}
+
+	rows := make([][]tg.InlineKeyboardButton, 0, len(favs)+2)
+	for _, f := range favs {
+		title := strings.TrimSpace(f.Title)
+		if title == "" {
+			title = fmt.Sprintf("kp_%d", f.KPID)
+		}
+		row := []tg.InlineKeyboardButton{{Text: truncateRunes(title, 40), CallbackData: cbdata.Data(cbdata.Card{KPID: f.KPID})}}
+		if watchable[f.KPID] {
+			row = append(row, tg.InlineKeyboardButton{Text: "Смотреть в Telegram", CallbackData: cbdata.Data(cbdata.Watch{KPID: f.KPID})})
+		}
+		rows = append(rows, row)
+	}
+	if totalPages > 1 {
+		nav := []tg.InlineKeyboardButton{}
+		if page > 1 {
+			nav = append(nav, tg.InlineKeyboardButton{Text: "<<<", CallbackData: cbdata.Data(cbdata.FavoritesPage{Page: page - 1})})
+		}
+		if page < totalPages {
+			nav = append(nav, tg.InlineKeyboardButton{Text: ">>>", CallbackData: cbdata.Data(cbdata.FavoritesPage{Page: page + 1})})
+		}
+		rows = append(rows, nav)
+	}
+	rows = append(rows, []tg.InlineKeyboardButton{{Text: "Закрыть", CallbackData: cbdata.Data(cbdata.Close{})}})
+	kb := tg.NewInlineKeyboardMarkup(rows)
+	text := fmt.Sprintf("Избранное (%d)", total)
+	if totalPages > 1 {
+		text = fmt.Sprintf("Избранное (%d), страница %d из %d", total, page, totalPages)
+	}
+	return text, &kb, nil
+}
+
+func favoriteButton(ctx context.Context, db storage.Store, kpID int, userID int64) tg.InlineKeyboardButton {
+	if on, _ := db.IsFavorite(ctx, userID, kpID); on {
+		return tg.InlineKeyboardButton{Text: "Убрать из избранного", CallbackData: cbdata.Data(cbdata.Unfavorite{KPID: kpID})}
+	}
+	return tg.InlineKeyboardButton{Text: "В избранное", CallbackData: cbdata.Data(cbdata.Favorite{KPID: kpID})}
+}
+
+// watchItemTitle prefers the synced title over the one typed into
+// /addseries; movies only have the former.
+func watchItemTitle(item *storage.WatchItem) string {
+	if item.Meta != nil && strings.TrimSpace(item.Meta.Title) != "" {
+		return strings.TrimSpace(item.Meta.Title)
+	}
+	return strings.TrimSpace(item.Title)
+}
+
+// titleForKPID resolves a display title for a new favorite or request,
+// preferring data that is already at hand over an API call.
+func titleForKPID(ctx context.Context, movies neomovies.API, db storage.Store, kpID int) string {
+	if cached, ok := inlineCache.Get(kpID); ok && strings.TrimSpace(cached.Title) != "" {
+		return strings.TrimSpace(cached.Title)
+	}
+	if item, _ := db.GetWatchItemByKPID(ctx, kpID); item != nil {
+		if title := watchItemTitle(item); title != "" {
+			return title
+		}
+	}
+	if info, err := movies.GetMovieByKPID(ctx, kpID); err == nil && info != nil {
+		if title := strings.TrimSpace(firstNonEmpty(info.Title, info.NameRu, info.Name, info.NameOriginal)); title != "" {
+			return title
+		}
+	}
+	return fmt.Sprintf("kp_%d", kpID)
+}
+
+func cmdRequests(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	if args.Len() > 0 {
+		if !strings.EqualFold(args.String(0), "done") || args.Int(1) <= 0 {
+			return botcmd.ErrUsage
+		}
+		kpID := args.Int(1)
+		notified, err := completeContentRequest(ctx, env.bot, env.db, kpID)
+		if err != nil {
+			return err
+		}
+		env.reply(ctx, fmt.Sprintf("OK. kp_id=%d, уведомлено: %d", kpID, notified))
+		return nil
+	}
+	text, kb, err := contentRequestsList(ctx, env.db)
+	if err != nil {
+		return err
+	}
+	return env.bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: env.msg.Chat.ID, Text: text, ReplyMarkup: kb})
+}
+
+// contentRequestsList renders the most wanted titles for admins; each button
+// marks a request as done.
+func contentRequestsList(ctx context.Context, db storage.Store) (string, *tg.InlineKeyboardMarkup, error) {
+	reqs, err := db.ListContentRequests(ctx, 20)
+	if err != nil {
+		return "", nil, err
+	}
+	rows := make([][]tg.InlineKeyboardButton, 0, len(reqs)+1)
+	lines := []string{"Запросы пользователей:"}
+	if len(reqs) == 0 {
+		lines = []string{"Открытых запросов нет."}
+	}
+	for i, req := range reqs {
+		title := strings.TrimSpace(req.Title)
+		if title == "" {
+			title = fmt.Sprintf("kp_%d", req.KPID)
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s (kp_id=%d) — %d", i+1, title, req.KPID, req.Votes))
+		rows = append(rows, []tg.InlineKeyboardButton{{
+			Text:         fmt.Sprintf("Готово: %s", truncateRunes(title, 40)),
+			CallbackData: cbdata.Data(cbdata.RequestDone{KPID: req.KPID}),
+		}})
+	}
+	rows = append(rows, []tg.InlineKeyboardButton{{Text: "Закрыть", CallbackData: cbdata.Data(cbdata.Close{})}})
+	kb := tg.NewInlineKeyboardMarkup(rows)
+	return strings.Join(lines, "\n"), &kb, nil
+}
+
+// completeContentRequest closes the open request for kpID. If the title is in
+// the library, every requester gets a message with a watch button. It
+// returns the number of users notified.
+func completeContentRequest(ctx context.Context, bot *tg.Client, db storage.Store, kpID int) (int, error) {
+	req, err := db.CompleteContentRequest(ctx, kpID)
+	if err != nil || req == nil {
+		return 0, err
+	}
+	item, _ := db.GetWatchItemByKPID(ctx, kpID)
+	if item == nil {
+		return 0, nil
+	}
+	title := strings.TrimSpace(item.Title)
+	if title == "" {
+		title = strings.TrimSpace(req.Title)
+	}
+	if title == "" {
+		title = fmt.Sprintf("kp_%d", kpID)
+	}
+	kb := tg.NewInlineKeyboardMarkup([][]tg.InlineKeyboardButton{
+		{{Text: "Смотреть в Telegram", CallbackData: cbdata.Data(cbdata.Watch{KPID: kpID})}},
+		{{Text: "Закрыть", CallbackData: cbdata.Data(cbdata.Close{})}},
+	})
+	notified := 0
+	for _, userID := range req.Voters {
+		err := bot.SendMessage(ctx, tg.SendMessageRequest{
+			ChatID:      userID,
+			Text:        fmt.Sprintf("Появилось в Telegram: %s", title),
+			ReplyMarkup: &kb,
+		})
+		if err != nil {
+			log.Printf("request notify error: %v (user_id=%d kp_id=%d)", err, userID, kpID)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		notified++
+	}
+	return notified, nil
+}
+
+func cmdGet(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	kpID := args.Int(0)
+	if kpID <= 0 {
+		return nil
+	}
+	if err := sendMovieCard(ctx, env.bot, env.movies, env.db, env.msg.Chat.ID, env.userID(), kpID); err != nil {
+		log.Printf("public /get error: %v (kp_id=%d)", err, kpID)
+	}
+	return nil
+}
+
+func cmdHelp(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	chatID := env.msg.Chat.ID
+	adminID, problem := adminChatID()
+	if adminID != 0 && adminID == chatID {
+		env.reply(ctx, "/help\n\n"+commands.HelpText(true))
+		return nil
+	}
+	if problem == "" {
+		problem = "Нет доступа"
+	}
+	env.reply(ctx, fmt.Sprintf("%s\n\n%s. Твой chat_id=%d", commands.HelpText(false), problem, chatID))
+	return nil
+}
+
+func cmdAddMovie(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	if args.Len() != 3 && args.Len() != 5 {
+		return botcmd.ErrUsage
+	}
+	kpID := args.Int(0)
+	voice := args.String(1)
+	quality := args.String(2)
+	var storageChatID int64
+	var storageMsgIDs []int
+	if args.Len() == 5 {
+		storageChatID = args.Int64(3)
+		storageMsgIDs = parseMessageIDList(args.String(4))
+	} else {
+		chatID, msgID, ok := forwardedRef(env.msg)
+		if !ok {
+			env.reply(ctx, "Reply to a forwarded post from the storage channel.")
+			return nil
+		}
+		storageChatID = chatID
+		storageMsgIDs = []int{msgID}
+	}
+	if kpID <= 0 || voice == "" || quality == "" || storageChatID == 0 || len(storageMsgIDs) == 0 {
+		env.reply(ctx, "Invalid args")
+		return nil
+	}
+	if err := env.db.UpsertWatchMovie(ctx, kpID, voice, quality, storageChatID, storageMsgIDs); err != nil {
+		return err
+	}
+	snapshotTitleMeta(ctx, env, kpID, "movie")
+	env.reply(ctx, "OK"+fulfilledNote(ctx, env, kpID))
+	return nil
+}
+
+func cmdAddMoviePart(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	kpID := args.Int(0)
+	if kpID <= 0 {
+		env.reply(ctx, "Invalid kp_id")
+		return nil
+	}
+	storageChatID, storageMsgID, ok := forwardedRef(env.msg)
+	if !ok {
+		env.reply(ctx, "Reply to a forwarded post from the storage channel.")
+		return nil
+	}
+	if err := env.db.AppendMovieParts(ctx, kpID, storageChatID, []int{storageMsgID}); err != nil {
+		return err
+	}
+	env.reply(ctx, "OK")
+	return nil
+}
+
+// sendAlbumCloseButton adds a "Закрыть" message under copied album parts;
+// album messages can't carry inline keyboards themselves.
+func sendAlbumCloseButton(ctx context.Context, bot *tg.Client, db storage.Store, chatID int64, copiedIDs []int) {
+	closeKB := tg.NewInlineKeyboardMarkup([][]tg.InlineKeyboardButton{
+		{{Text: "Закрыть", CallbackData: cbdata.Data(cbdata.Close{})}},
+	})
+	msgID, err := bot.SendMessageWithResult(ctx, tg.SendMessageRequest{
+		ChatID:      chatID,
+		Text:        fmt.Sprintf("Частей: %d", len(copiedIDs)),
+		ReplyMarkup: &closeKB,
+	})
+	if err != nil || msgID == 0 {
+		return
+	}
+	targets := append(append([]int(nil), copiedIDs...), msgID)
+	if err := db.SaveCloseTargets(ctx, chatID, msgID, targets, closeTargetsTTL); err != nil {
+		log.Printf("close targets save error: %v (chat_id=%d)", err, chatID)
+	}
+}
+
+// fulfilledNote completes the content request for a newly added title and
+// returns a note for the admin reply.
+func fulfilledNote(ctx context.Context, env *cmdEnv, kpID int) string {
+	notified, err := completeContentRequest(ctx, env.bot, env.db, kpID)
+	if err != nil {
+		log.Printf("complete request error: %v (kp_id=%d)", err, kpID)
+		return ""
+	}
+	if notified == 0 {
+		return ""
+	}
+	return fmt.Sprintf(". Запрос выполнен, уведомлено: %d", notified)
+}
+
+func cmdAddSeries(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	kpID := args.Int(0)
+	title := args.RestFrom(1)
+	if kpID <= 0 || title == "" {
+		env.reply(ctx, "Invalid args")
+		return nil
+	}
+	if err := env.db.UpsertWatchSeries(ctx, kpID, title); err != nil {
+		return err
+	}
+	snapshotTitleMeta(ctx, env, kpID, "series")
+	env.reply(ctx, "OK"+fulfilledNote(ctx, env, kpID))
+	return nil
+}
+
+func cmdAddEpisode(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	if args.Len() != 5 && args.Len() != 7 {
+		return botcmd.ErrUsage
+	}
+	kpID := args.Int(0)
+	seasonNum := args.Int(1)
+	epNum := args.Int(2)
+	voice := args.String(3)
+	quality := args.String(4)
+	var storageChatID int64
+	var storageMsgID int
+	var file *mediaFile
+	if args.Len() == 7 {
+		storageChatID = args.Int64(5)
+		storageMsgID = args.Int(6)
+	} else {
+		file = env.msg.ReplyToMessage.media()
+		chatID, msgID, ok := forwardedRef(env.msg)
+		if !ok {
+			env.reply(ctx, "Reply to a forwarded post from the storage channel.")
+			return nil
+		}
+		storageChatID = chatID
+		storageMsgID = msgID
+	}
+	if kpID <= 0 || seasonNum <= 0 || epNum <= 0 || voice == "" || quality == "" || storageChatID == 0 || storageMsgID <= 0 {
+		env.reply(ctx, "Invalid args")
+		return nil
+	}
+	added, err := env.db.UpsertSeriesEpisode(ctx, kpID, seasonNum, epNum, episodeVariant(voice, quality, storageChatID, storageMsgID, file))
+	if err != nil {
+		return err
+	}
+	if added {
+		queueEpisodeNotice(ctx, env.db, kpID, seasonNum, epNum, voice)
+	}
+	env.reply(ctx, "OK")
+	return nil
+}
+
+func cmdTestCaption(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	var chatID int64
+	text := args.RestFrom(0)
+	if id := args.Int64(0); id < 0 && args.Len() > 1 {
+		chatID = id
+		text = args.RestFrom(1)
+	}
+	post := &message{Text: text}
+	if text == "" && env.msg.ReplyToMessage != nil {
+		post = env.msg.ReplyToMessage
+		text = strings.TrimSpace(firstNonEmpty(post.Caption, post.Text))
+		if post.ForwardFromChat != nil && chatID == 0 {
+			chatID = post.ForwardFromChat.ID
+		}
+	}
+	if text == "" && post.media() == nil {
+		return botcmd.ErrUsage
+	}
+	res := parseUpload(ctx, env.db, chatID, post)
+	lines := []string{}
+	if res.OK() {
+		lines = append(lines, "Шаблон: "+res.Parser, "Серии: "+formatEpisodeRange(res))
+	} else {
+		lines = append(lines, "Сезон/серия не найдены")
+	}
+	lines = append(lines,
+		"Озвучка: "+firstNonEmpty(res.Voice, "-"),
+		"Качество: "+firstNonEmpty(res.Quality, "-"),
+	)
+	if f := post.media(); f != nil {
+		lines = append(lines, fmt.Sprintf("Файл: %s, %d МБ, %d мин", firstNonEmpty(f.FileName, "-"), f.FileSize>>20, f.Duration/60))
+	}
+	if kpID := parseKPTag(text); kpID > 0 {
+		lines = append(lines, fmt.Sprintf("kp_id: %d", kpID))
+	}
+	env.reply(ctx, strings.Join(lines, "\n"))
+	return nil
+}
+
+func cmdCaptionTemplate(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	chatID := args.Int64(0)
+	if chatID == 0 {
+		return botcmd.ErrUsage
+	}
+	templates, err := env.db.ListCaptionTemplates(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(args.String(1)) {
+	case "":
+		if len(templates) == 0 {
+			env.reply(ctx, fmt.Sprintf("Шаблонов для %d нет, работают только встроенные.", chatID))
+			return nil
+		}
+		lines := make([]string, 0, len(templates))
+		for i, t := range templates {
+			lines = append(lines, fmt.Sprintf("%d. %s", i+1, t.Pattern))
+		}
+		env.reply(ctx, strings.Join(lines, "\n"))
+		return nil
+	case "add":
+		pattern := args.RestFrom(2)
+		if pattern == "" {
+			return botcmd.ErrUsage
+		}
+		if _, err := caption.NewTemplate(pattern); err != nil {
+			env.reply(ctx, err.Error())
+			return nil
+		}
+		if err := env.db.AddCaptionTemplate(ctx, chatID, pattern); err != nil {
+			return err
+		}
+		env.reply(ctx, "OK")
+		return nil
+	case "del":
+		pattern := args.RestFrom(2)
+		if n := args.Int(2); n > 0 && args.Len() == 3 {
+			if n > len(templates) {
+				env.reply(ctx, "Нет такого шаблона")
+				return nil
+			}
+			pattern = templates[n-1].Pattern
+		}
+		if pattern == "" {
+			return botcmd.ErrUsage
+		}
+		if err := env.db.DeleteCaptionTemplate(ctx, chatID, pattern); err != nil {
+			return err
+		}
+		env.reply(ctx, "OK")
+		return nil
+	default:
+		return botcmd.ErrUsage
+	}
+}
+
+func cmdAutoAdd(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	if strings.EqualFold(args.String(0), "stop") {
+		return cmdAutoStop(ctx, env, args)
+	}
+	kpID := args.Int(0)
+	if kpID <= 0 {
+		env.reply(ctx, "Invalid kp_id")
+		return nil
+	}
+	if err := env.db.StartAutoSession(ctx, env.msg.Chat.ID, kpID, autoSessionTTL); err != nil {
+		return err
+	}
+	env.reply(ctx, fmt.Sprintf("OK. Автодобавление включено для kp_id=%d. Пересылай посты с видео.", kpID))
+	return nil
+}
+
+func cmdAutoStop(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	if err := env.db.StopAutoSession(ctx, env.msg.Chat.ID); err != nil {
+		return err
+	}
+	env.reply(ctx, "OK. Автодобавление выключено.")
+	return nil
+}
+
+func cmdAutoStatus(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	session, err := env.db.GetAutoSession(ctx, env.msg.Chat.ID)
+	if err != nil {
+		return err
+	}
+	if session == nil {
+		env.reply(ctx, "Автодобавление выключено.")
+		return nil
+	}
+	env.reply(ctx, formatAutoSession(session))
+	return nil
+}
+
+func cmdSetWebhook(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	u := webhookURL()
+	if args.Len() >= 1 {
+		u = args.String(0)
+	}
+	if !strings.HasPrefix(u, "https://") {
+		env.reply(ctx, "Usage: /setwebhook <https url> (or set PUBLIC_BASE_URL)")
+		return nil
+	}
+	err := env.bot.SetWebhook(ctx, tg.SetWebhookRequest{
+		URL:            u,
+		SecretToken:    strings.TrimSpace(os.Getenv("WEBHOOK_SECRET")),
+		AllowedUpdates: tg.AllowedUpdates,
+	})
+	if err != nil {
+		return err
+	}
+	env.reply(ctx, fmt.Sprintf("OK. Webhook: %s", u))
+	return nil
+}
+
+func cmdWebhookInfo(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	info, err := env.bot.GetWebhookInfo(ctx)
+	if err != nil {
+		return err
+	}
+	env.reply(ctx, formatWebhookInfo(info))
+	return nil
+}
+
+// cmdSetCommands publishes the registry to Telegram's command menu: public
+// commands for everyone, the full list for the admin chat.
+func cmdSetCommands(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	toBotCommands := func(entries []botcmd.MenuEntry) []tg.BotCommand {
+		out := make([]tg.BotCommand, 0, len(entries))
+		for _, e := range entries {
+			out = append(out, tg.BotCommand{Command: e.Command, Description: e.Description})
+		}
+		return out
+	}
+	if err := env.bot.SetMyCommands(ctx, tg.SetMyCommandsRequest{Commands: toBotCommands(commands.Menu(false))}); err != nil {
+		return err
+	}
+	adminID, _ := adminChatID()
+	if err := env.bot.SetMyCommands(ctx, tg.SetMyCommandsRequest{
+		Commands: toBotCommands(commands.Menu(true)),
+		Scope:    &tg.BotCommandScope{Type: "chat", ChatID: adminID},
+	}); err != nil {
+		return err
+	}
+	env.reply(ctx, "OK")
+	return nil
+}
+
+func cmdGetInfo(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	kpID := args.Int(0)
+	if kpID <= 0 {
+		env.reply(ctx, "Invalid kp_id")
+		return nil
+	}
+	item, _ := env.db.GetWatchItemByKPID(ctx, kpID)
+	if item == nil {
+		env.reply(ctx, "Not found")
+		return nil
+	}
+	ref := fmt.Sprintf("%d:%d", item.StorageChatID, item.StorageMessageID)
+	if len(item.StorageMessageIDs) > 0 {
+		ref = fmt.Sprintf("%d:%s", item.StorageChatID, joinMessageIDs(item.StorageMessageIDs))
+	}
+	meta := "none"
+	if item.Meta != nil {
+		meta = fmt.Sprintf("%s (%s)", item.Meta.SyncedAt.Format(time.RFC3339), firstNonEmpty(item.Meta.Title, "-"))
+	}
+	env.reply(ctx, fmt.Sprintf("kp_id=%d\ntype=%s\ntitle=%s\nmovie_ref=%s\nseasons=%d\nmeta=%s", item.KPID, item.Type, item.Title, ref, len(item.Seasons), meta))
+	return nil
+}
+
+// refreshMetaReserve is the part of the request budget /refreshmeta all
+// leaves for the reply.
+const refreshMetaReserve = 2 * time.Second
+
+func cmdRefreshMeta(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	if strings.EqualFold(args.String(0), "all") {
+		return refreshAllMeta(ctx, env)
+	}
+	kpID := args.Int(0)
+	if kpID <= 0 {
+		return botcmd.ErrUsage
+	}
+	item, _ := env.db.GetWatchItemByKPID(ctx, kpID)
+	if item == nil {
+		env.reply(ctx, "Not found")
+		return nil
+	}
+	meta, err := syncTitleMeta(ctx, env.movies, env.db, kpID, item.Type)
+	if err != nil {
+		env.reply(ctx, fmt.Sprintf("Не удалось обновить kp_id=%d: %v", kpID, err))
+		return nil
+	}
+	env.reply(ctx, fmt.Sprintf("OK. %s (%d), рейтинг %.1f, озвучек: %d", firstNonEmpty(meta.Title, "-"), meta.Year, meta.Rating, len(meta.Voices)))
+	return nil
+}
+
+// refreshAllMeta re-syncs the library, least recently synced first, until
+// the request budget runs out; repeating the command continues from there.
+func refreshAllMeta(ctx context.Context, env *cmdEnv) error {
+	items, err := env.db.ListRecent(ctx, 500)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return metaSyncedAt(&items[i]).Before(metaSyncedAt(&items[j]))
+	})
+	deadline, hasDeadline := ctx.Deadline()
+	updated, failed := 0, 0
+	for i := range items {
+		if hasDeadline && time.Until(deadline) < refreshMetaReserve {
+			break
+		}
+		if _, err := syncTitleMeta(ctx, env.movies, env.db, items[i].KPID, items[i].Type); err != nil {
+			log.Printf("meta refresh error: %v (kp_id=%d)", err, items[i].KPID)
+			failed++
+			continue
+		}
+		updated++
+	}
+	text := fmt.Sprintf("Обновлено: %d, ошибок: %d, всего: %d", updated, failed, len(items))
+	if left := len(items) - updated - failed; left > 0 {
+		text += fmt.Sprintf("\nНе успели: %d, повторите /refreshmeta all", left)
+	}
+	env.reply(ctx, text)
+	return nil
+}
+
+func metaSyncedAt(item *storage.WatchItem) time.Time {
+	if item.Meta == nil {
+		return time.Time{}
+	}
+	return item.Meta.SyncedAt
+}
+
+func cmdDelEpisode(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	kpID, seasonNum, epNum := args.Int(0), args.Int(1), args.Int(2)
+	if kpID <= 0 || seasonNum <= 0 || epNum <= 0 {
+		env.reply(ctx, "Invalid args")
+		return nil
+	}
+	if err := env.db.DeleteSeriesEpisode(ctx, kpID, seasonNum, epNum); err != nil {
+		return err
+	}
+	env.reply(ctx, "OK")
+	return nil
+}
+
+func cmdDelSeason(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	kpID, seasonNum := args.Int(0), args.Int(1)
+	if kpID <= 0 || seasonNum <= 0 {
+		env.reply(ctx, "Invalid args")
+		return nil
+	}
+	if err := env.db.DeleteSeason(ctx, kpID, seasonNum); err != nil {
+		return err
+	}
+	env.reply(ctx, "OK")
+	return nil
+}
+
+func cmdDel(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	kpID := args.Int(0)
+	if kpID <= 0 {
+		env.reply(ctx, "Invalid kp_id")
+		return nil
+	}
+	if err := env.db.DeleteByKPID(ctx, kpID); err != nil {
+		return err
+	}
+	env.reply(ctx, "OK")
+	return nil
+}
+
+func cmdList(ctx context.Context, env *cmdEnv, args botcmd.Args) error {
+	limit := 20
+	if args.Len() >= 1 {
+		if n, err := strconv.Atoi(args.String(0)); err == nil {
+			limit = n
+		}
+	}
+	items, err := env.db.ListRecent(ctx, limit)
+	if err != nil {
+		env.reply(ctx, "DB not configured")
+		return nil
+	}
+	if len(items) == 0 {
+		env.reply(ctx, "Empty")
+		return nil
+	}
+	b := strings.Builder{}
+	for i := range items {
+		it := &items[i]
+		name := watchItemTitle(it)
+		if name == "" {
+			name = fmt.Sprintf("kp_%d", it.KPID)
+		}
+		if it.Meta != nil && it.Meta.Year > 0 {
+			name = fmt.Sprintf("%s (%d)", name, it.Meta.Year)
+		}
+		b.WriteString(fmt.Sprintf("%d %s %s\n", it.KPID, it.Type, name))
+	}
+	env.reply(ctx, strings.TrimSpace(b.String()))
+	return nil
+}
+
+func handleAutoEpisode(ctx context.Context, bot *tg.Client, db storage.Store, msg *message) bool {
+	if db == nil {
+		return false
+	}
+	// only forwarded posts can be ingested and replies are never intercepted;
+	// checked before the session lookup so plain messages cost no DB read
+	if msg.ForwardFromChat == nil || msg.ForwardFromMessageID == 0 || msg.ReplyToMessage != nil {
+		return false
+	}
+	state, err := db.GetAutoSession(ctx, msg.Chat.ID)
+	if err != nil || state == nil {
+		return false
+	}
+
+	if strings.TrimSpace(firstNonEmpty(msg.Caption, msg.Text)) == "" && msg.media() == nil {
+		return false
+	}
+	res := parseUpload(ctx, db, msg.ForwardFromChat.ID, msg)
+	if !res.OK() {
+		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Не удалось распознать сезон/серию из подписи. Проверить: /testcaption"})
+		return true
+	}
+	if res.Voice == "" {
+		res.Voice = "Unknown"
+	}
+	if res.Quality == "" {
+		res.Quality = "Unknown"
+	}
+
+	if err := fileEpisodes(ctx, db, state.KPID, res, msg.ForwardFromChat.ID, msg.ForwardFromMessageID, msg.media()); err != nil {
+		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: fmt.Sprintf("Ошибка добавления: %v", err)})
+		return true
 	}
-	if strings.HasPrefix(text, "/addseries ") {
-		rest := strings.TrimSpace(strings.TrimPrefix(text, "/addseries"))
-		fields := strings.Fields(rest)
-		if len(fields) < 2 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Usage: /addseries <kp_id> <title>"})
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		kpID, _ := strconv.Atoi(fields[0])
-		title := strings.TrimSpace(rest[len(fields[0]):])
-		if kpID <= 0 || title == "" {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Invalid args"})
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		_ = db.UpsertWatchSeries(ctx, kpID, title)
-		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "OK"})
-		w.WriteHeader(http.StatusOK)
-		return
+	last := res.Episodes()[len(res.Episodes())-1]
+	if err := db.RecordAutoEpisode(ctx, msg.Chat.ID, res.Season, last, autoSessionTTL); err != nil {
+		log.Printf("auto session record error: %v (chat_id=%d)", err, msg.Chat.ID)
 	}
-	if strings.HasPrefix(text, "/addepisode ") {
-		parts := strings.Fields(text)
-		if len(parts) != 6 && len(parts) != 8 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Usage: /addepisode <kp_id> <season> <episode> <voice> <quality> <storage_chat_id> <storage_message_id> OR reply to forwarded post: /addepisode <kp_id> <season> <episode> <voice> <quality>"})
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		kpID, _ := strconv.Atoi(parts[1])
-		seasonNum, _ := strconv.Atoi(parts[2])
-		epNum, _ := strconv.Atoi(parts[3])
-		voice := strings.TrimSpace(parts[4])
-		quality := strings.TrimSpace(parts[5])
-		var storageChatID int64
-		var storageMsgID int
-		if len(parts) == 8 {
-			storageChatID, _ = strconv.ParseInt(parts[6], 10, 64)
-			storageMsgID, _ = strconv.Atoi(parts[7])
-		} else {
-			if msg.ReplyToMessage == nil || msg.ReplyToMessage.ForwardFromChat == nil || msg.ReplyToMessage.ForwardFromMessageID == 0 {
-				_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Reply to a forwarded post from the storage channel."})
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-			storageChatID = msg.ReplyToMessage.ForwardFromChat.ID
-			storageMsgID = msg.ReplyToMessage.ForwardFromMessageID
+	_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: fmt.Sprintf("OK: %s, %s, %s", formatEpisodeRange(res), res.Voice, res.Quality)})
+	return true
+}
+
+func storageChannelIDs() []int64 {
+	var out []int64
+	for _, raw := range strings.Split(os.Getenv("STORAGE_CHANNEL_IDS"), ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err == nil && id != 0 {
+			out = append(out, id)
 		}
-		if kpID <= 0 || seasonNum <= 0 || epNum <= 0 || voice == "" || quality == "" || storageChatID == 0 || storageMsgID <= 0 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Invalid args"})
-			w.WriteHeader(http.StatusOK)
-			return
+	}
+	return out
+}
+
+func isStorageChannel(chatID int64) bool {
+	for _, id := range storageChannelIDs() {
+		if id == chatID {
+			return true
 		}
-		_ = db.UpsertSeriesEpisode(ctx, kpID, seasonNum, epNum, voice, quality, storageChatID, storageMsgID)
-		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "OK"})
-		w.WriteHeader(http.StatusOK)
+	}
+	return false
+}
+
+var kpTagRe = regexp.MustCompile(`(?i)(?:#kp_?|\bkp(?:_id)?\s*[:=]\s*)(\d{1,9})\b`)
+
+// parseKPTag finds the kp_id of a storage post: "#kp123", "#kp_123",
+// "kp:123" or "kp_id=123".
+func parseKPTag(caption string) int {
+	m := kpTagRe.FindStringSubmatch(caption)
+	if len(m) != 2 {
+		return 0
+	}
+	id, _ := strconv.Atoi(m[1])
+	return id
+}
+
+// handleChannelPost files a post from a storage channel: captions with a
+// season and episode become episode variants, others become movie parts.
+// Posts that can't be filed are reported to the admin chat.
+func handleChannelPost(ctx context.Context, bot *tg.Client, db storage.Store, msg *message) {
+	if db == nil || !isStorageChannel(msg.Chat.ID) {
 		return
 	}
-	if strings.HasPrefix(text, "/getinfo ") {
-		parts := strings.Fields(text)
-		if len(parts) < 2 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Usage: /get <kp_id>"})
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		kpID, _ := strconv.Atoi(parts[1])
-		if kpID <= 0 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Invalid kp_id"})
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		item, _ := db.GetWatchItemByKPID(ctx, kpID)
-		if item == nil {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Not found"})
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		ref := fmt.Sprintf("%d:%d", item.StorageChatID, item.StorageMessageID)
-		if len(item.StorageMessageIDs) > 0 {
-			ref = fmt.Sprintf("%d:%s", item.StorageChatID, joinMessageIDs(item.StorageMessageIDs))
-		}
-		textOut := fmt.Sprintf("kp_id=%d\ntype=%s\ntitle=%s\nmovie_ref=%s\nseasons=%d", item.KPID, item.Type, item.Title, ref, len(item.Seasons))
-		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: textOut})
-		w.WriteHeader(http.StatusOK)
+	res := parseUpload(ctx, db, msg.Chat.ID, msg)
+	if msg.MediaGroupID != "" && !res.OK() {
+		// the kp_id tag is usually on one part only
+		bufferAlbumPart(ctx, db, msg.Chat.ID, msg.MessageID, 0, msg)
 		return
 	}
-	if strings.HasPrefix(text, "/delepisode ") {
-		parts := strings.Fields(text)
-		if len(parts) < 4 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Usage: /delepisode <kp_id> <season> <episode>"})
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		kpID, _ := strconv.Atoi(parts[1])
-		seasonNum, _ := strconv.Atoi(parts[2])
-		epNum, _ := strconv.Atoi(parts[3])
-		if kpID <= 0 || seasonNum <= 0 || epNum <= 0 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Invalid args"})
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		_ = db.DeleteSeriesEpisode(ctx, kpID, seasonNum, epNum)
-		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "OK"})
-		w.WriteHeader(http.StatusOK)
+	text := strings.TrimSpace(firstNonEmpty(msg.Caption, msg.Text))
+	kpID := parseKPTag(text)
+	if f := msg.media(); kpID <= 0 && f != nil {
+		kpID = parseKPTag(f.FileName)
+	}
+	if kpID <= 0 {
+		reportChannelPost(ctx, bot, msg, "нет тега kp_id (#kp123 или kp_id=123)")
 		return
 	}
-	if strings.HasPrefix(text, "/delseason ") {
-		parts := strings.Fields(text)
-		if len(parts) < 3 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Usage: /delseason <kp_id> <season>"})
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		kpID, _ := strconv.Atoi(parts[1])
-		seasonNum, _ := strconv.Atoi(parts[2])
-		if kpID <= 0 || seasonNum <= 0 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Invalid args"})
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		_ = db.DeleteSeason(ctx, kpID, seasonNum)
-		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "OK"})
-		w.WriteHeader(http.StatusOK)
+	if res.Voice == "" {
+		res.Voice = "Unknown"
+	}
+	if res.Quality == "" {
+		res.Quality = "Unknown"
+	}
+	item, err := db.GetWatchItemByKPID(ctx, kpID)
+	if err != nil {
+		reportChannelPost(ctx, bot, msg, fmt.Sprintf("ошибка чтения kp_id=%d: %v", kpID, err))
 		return
 	}
-	if strings.HasPrefix(text, "/del ") {
-		parts := strings.Fields(text)
-		if len(parts) < 2 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Usage: /del <kp_id>"})
-			w.WriteHeader(http.StatusOK)
+
+	switch {
+	case res.OK():
+		if item != nil && item.Type != "series" {
+			reportChannelPost(ctx, bot, msg, fmt.Sprintf("kp_id=%d это фильм, а в подписи есть сезон и серия", kpID))
 			return
 		}
-		kpID, _ := strconv.Atoi(parts[1])
-		if kpID <= 0 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Invalid kp_id"})
-			w.WriteHeader(http.StatusOK)
+		if err := fileEpisodes(ctx, db, kpID, res, msg.Chat.ID, msg.MessageID, msg.media()); err != nil {
+			reportChannelPost(ctx, bot, msg, fmt.Sprintf("ошибка добавления: %v", err))
 			return
 		}
-		_ = db.DeleteByKPID(ctx, kpID)
-		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "OK"})
-		w.WriteHeader(http.StatusOK)
+		log.Printf("channel post filed: kp_id=%d %s chat_id=%d message_id=%d", kpID, formatEpisodeRange(res), msg.Chat.ID, msg.MessageID)
+	case item != nil && item.Type == "series":
+		reportChannelPost(ctx, bot, msg, fmt.Sprintf("kp_id=%d это сериал, но в подписи нет сезона и серии", kpID))
 		return
-	}
-	if strings.HasPrefix(text, "/list") {
-		parts := strings.Fields(text)
-		limit := 20
-		if len(parts) >= 2 {
-			if n, err := strconv.Atoi(parts[1]); err == nil {
-				limit = n
-			}
-		}
-		items, err := db.ListRecent(ctx, limit)
-		if err != nil {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "DB not configured"})
-			w.WriteHeader(http.StatusOK)
+	case item != nil:
+		if err := db.AppendMovieParts(ctx, kpID, msg.Chat.ID, []int{msg.MessageID}); err != nil {
+			reportChannelPost(ctx, bot, msg, fmt.Sprintf("ошибка добавления части: %v", err))
 			return
 		}
-		if len(items) == 0 {
-			_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Empty"})
-			w.WriteHeader(http.StatusOK)
+		log.Printf("channel post filed: kp_id=%d movie part chat_id=%d message_id=%d", kpID, msg.Chat.ID, msg.MessageID)
+	default:
+		if err := db.UpsertWatchMovie(ctx, kpID, res.Voice, res.Quality, msg.Chat.ID, []int{msg.MessageID}); err != nil {
+			reportChannelPost(ctx, bot, msg, fmt.Sprintf("ошибка добавления: %v", err))
 			return
 		}
-		b := strings.Builder{}
-		for _, it := range items {
-			name := strings.TrimSpace(it.Title)
-			if name == "" {
-				name = fmt.Sprintf("kp_%d", it.KPID)
-			}
-			b.WriteString(fmt.Sprintf("%d %s %s\n", it.KPID, it.Type, name))
-		}
-		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: strings.TrimSpace(b.String())})
-		w.WriteHeader(http.StatusOK)
-		return
+		log.Printf("channel post filed: kp_id=%d movie chat_id=%d message_id=%d", kpID, msg.Chat.ID, msg.MessageID)
 	}
+	if _, err := completeContentRequest(ctx, bot, db, kpID); err != nil {
+		log.Printf("complete request error: %v (kp_id=%d)", err, kpID)
+	}
+}
 
-	w.WriteHeader(http.StatusOK)
+// albumWindow is how long an album is buffered after its latest part.
+// Telegram sends the parts of an album within a second or so.
+const albumWindow = 2 * time.Second
+
+// bufferAlbumPart stores one part of an album posted in (or forwarded from)
+// storageChatID. flushMediaGroups files the album once the window closes.
+func bufferAlbumPart(ctx context.Context, db storage.Store, storageChatID int64, storageMsgID int, reportChatID int64, msg *message) {
+	part := storage.MediaGroupPart{MessageID: storageMsgID, Caption: strings.TrimSpace(msg.Caption)}
+	if f := msg.media(); f != nil {
+		part.FileName = f.FileName
+		part.Width = f.Width
+		part.Height = f.Height
+	}
+	if err := db.AddMediaGroupPart(ctx, storageChatID, msg.MediaGroupID, reportChatID, part, albumWindow); err != nil {
+		log.Printf("album buffer error: %v (chat_id=%d group=%s)", err, storageChatID, msg.MediaGroupID)
+	}
 }
 
-func handleAutoEpisode(ctx context.Context, bot *tg.Client, db *storage.Mongo, msg *message) bool {
+// flushMediaGroups files every album whose buffering window has closed and
+// returns how many were taken. Caption templates are loaded once per
+// storage chat.
+func flushMediaGroups(ctx context.Context, bot *tg.Client, db storage.Store) int {
 	if db == nil {
-		return false
+		return 0
 	}
-	autoSeriesMu.Lock()
-	state, ok := autoSeriesByChat[msg.Chat.ID]
-	autoSeriesMu.Unlock()
-	if !ok {
-		return false
+	groups, err := db.TakeDueMediaGroups(ctx, time.Now())
+	if err != nil {
+		log.Printf("take media groups error: %v", err)
 	}
-
-	if msg.ReplyToMessage != nil {
-		// don't intercept replies
-		return false
+	parsers := map[int64]caption.Chain{}
+	for i := range groups {
+		chain, ok := parsers[groups[i].StorageChatID]
+		if !ok {
+			chain = captionParser(ctx, db, groups[i].StorageChatID)
+			parsers[groups[i].StorageChatID] = chain
+		}
+		fileAlbum(ctx, bot, db, chain, &groups[i])
 	}
-	if msg.ForwardFromChat == nil || msg.ForwardFromMessageID == 0 {
-		return false
+	return len(groups)
+}
+
+// fileAlbum stores an album as one movie, its parts in posting order. The
+// kp_id tag and voice/quality may be on any part. Without a tag the admin
+// gets a ready /addmovie command to finish by hand.
+func fileAlbum(ctx context.Context, bot *tg.Client, db storage.Store, chain caption.Chain, g *storage.MediaGroup) {
+	ids := g.MessageIDs()
+	sort.Slice(g.Parts, func(i, j int) bool { return g.Parts[i].MessageID < g.Parts[j].MessageID })
+	kpID := 0
+	res := caption.Result{}
+	for _, p := range g.Parts {
+		if kpID <= 0 {
+			kpID = parseKPTag(firstNonEmpty(p.Caption, p.FileName))
+		}
+		pr := parseUploadWith(chain, &message{Caption: p.Caption, Document: &mediaFile{FileName: p.FileName, Width: p.Width, Height: p.Height}})
+		res.Voice = firstNonEmpty(res.Voice, pr.Voice)
+		res.Quality = firstNonEmpty(res.Quality, pr.Quality)
 	}
+	voice := firstNonEmpty(res.Voice, "Unknown")
+	quality := firstNonEmpty(res.Quality, "Unknown")
 
-	caption := strings.TrimSpace(firstNonEmpty(msg.Caption, msg.Text))
-	if caption == "" {
-		return false
+	if kpID <= 0 {
+		reportAlbum(ctx, bot, g, fmt.Sprintf("Альбом из %d частей без тега kp_id. Добавить как фильм:\n/addmovie <kp_id> %s %s %d %s",
+			len(ids), strings.ReplaceAll(voice, " ", "_"), quality, g.StorageChatID, joinMessageIDs(ids)), true)
+		return
 	}
-	season, episode, voice, quality := parseEpisodeCaption(caption)
-	if season <= 0 || episode <= 0 {
-		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: "Не удалось распознать сезон/серию из подписи."})
-		return true
+	item, err := db.GetWatchItemByKPID(ctx, kpID)
+	switch {
+	case err != nil:
+		reportAlbum(ctx, bot, g, fmt.Sprintf("Альбом kp_id=%d не добавлен: %v", kpID, err), true)
+		return
+	case item != nil && item.Type == "series":
+		reportAlbum(ctx, bot, g, fmt.Sprintf("Альбом kp_id=%d не добавлен: это сериал", kpID), true)
+		return
+	case item != nil:
+		err = db.AppendMovieParts(ctx, kpID, g.StorageChatID, ids)
+	default:
+		err = db.UpsertWatchMovie(ctx, kpID, voice, quality, g.StorageChatID, ids)
+	}
+	if err != nil {
+		reportAlbum(ctx, bot, g, fmt.Sprintf("Альбом kp_id=%d не добавлен: %v", kpID, err), true)
+		return
+	}
+	log.Printf("album filed: kp_id=%d parts=%d chat_id=%d", kpID, len(ids), g.StorageChatID)
+	notified, err := completeContentRequest(ctx, bot, db, kpID)
+	if err != nil {
+		log.Printf("complete request error: %v (kp_id=%d)", err, kpID)
+	}
+	text := fmt.Sprintf("OK: kp_id=%d, частей: %d, %s, %s", kpID, len(ids), voice, quality)
+	if notified > 0 {
+		text += fmt.Sprintf(". Запрос выполнен, уведомлено: %d", notified)
 	}
-	if voice == "" {
-		voice = "Unknown"
+	reportAlbum(ctx, bot, g, text, false)
+}
+
+// reportAlbum sends text to the chat the album came from. Failures of
+// albums posted in storage channels go to the admin chat.
+func reportAlbum(ctx context.Context, bot *tg.Client, g *storage.MediaGroup, text string, failed bool) {
+	chatID := g.ReportChatID
+	if chatID == 0 && failed {
+		chatID, _ = adminChatID()
 	}
-	if quality == "" {
-		quality = "Unknown"
+	if chatID == 0 {
+		return
 	}
+	_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: chatID, Text: text})
+}
 
-	err := db.UpsertSeriesEpisode(ctx, state.KPID, season, episode, voice, quality, msg.ForwardFromChat.ID, msg.ForwardFromMessageID)
-	if err != nil {
-		_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: fmt.Sprintf("Ошибка добавления: %v", err)})
-		return true
+// reportChannelPost tells the admin chat that a storage post was not filed.
+func reportChannelPost(ctx context.Context, bot *tg.Client, msg *message, reason string) {
+	log.Printf("channel post skipped: %s (chat_id=%d message_id=%d)", reason, msg.Chat.ID, msg.MessageID)
+	adminID, _ := adminChatID()
+	if adminID == 0 {
+		return
 	}
-	_ = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: msg.Chat.ID, Text: fmt.Sprintf("OK: S%dE%d, %s, %s", season, episode, voice, quality)})
-	return true
+	_ = bot.SendMessage(ctx, tg.SendMessageRequest{
+		ChatID: adminID,
+		Text:   fmt.Sprintf("Пост %d в канале %d не добавлен: %s", msg.MessageID, msg.Chat.ID, reason),
+	})
+}
+
+func formatWebhookInfo(info *tg.WebhookInfo) string {
+	u := info.URL
+	if u == "" {
+		u = "(not set)"
+	}
+	lines := []string{
+		fmt.Sprintf("url=%s", u),
+		fmt.Sprintf("pending=%d", info.PendingUpdateCount),
+		fmt.Sprintf("allowed_updates=%s", strings.Join(info.AllowedUpdates, ",")),
+	}
+	if info.LastErrorMessage != "" {
+		lines = append(lines, fmt.Sprintf("last_error=%s (%s)", info.LastErrorMessage, time.Unix(info.LastErrorDate, 0).Format(time.RFC3339)))
+	}
+	return strings.Join(lines, "\n")
 }
 
-func parseEpisodeCaption(caption string) (season int, episode int, voice string, quality string) {
-	c := strings.TrimSpace(caption)
-	reSeason := regexp.MustCompile(`(?i)сезон\s*(\d{1,2})`)
-	reEpisode := regexp.MustCompile(`(?i)серия\s*(\d{1,3})`)
-	if m := reSeason.FindStringSubmatch(c); len(m) == 2 {
-		season, _ = strconv.Atoi(m[1])
+func formatAutoSession(s *storage.AutoSession) string {
+	lines := []string{
+		fmt.Sprintf("Автодобавление включено для kp_id=%d", s.KPID),
+		fmt.Sprintf("Начато: %s", s.StartedAt.Local().Format("02.01.2006 15:04")),
+		fmt.Sprintf("Истекает: %s", s.ExpiresAt.Local().Format("02.01.2006 15:04")),
+		fmt.Sprintf("Добавлено серий: %d", s.EpisodesAdded),
 	}
-	if m := reEpisode.FindStringSubmatch(c); len(m) == 2 {
-		episode, _ = strconv.Atoi(m[1])
+	if s.LastSeason > 0 && s.LastEpisode > 0 {
+		lines = append(lines, fmt.Sprintf("Последняя: S%dE%d", s.LastSeason, s.LastEpisode))
 	}
+	return strings.Join(lines, "\n")
+}
 
-	reParens := regexp.MustCompile(`\(([^)]+)\)`)
-	if m := reParens.FindStringSubmatch(c); len(m) == 2 {
-		parts := strings.Split(m[1], ",")
-		for _, p := range parts {
-			p = strings.TrimSpace(p)
-			if p == "" {
-				continue
-			}
-			if strings.Contains(strings.ToLower(p), "p") && strings.ContainsAny(p, "0123456789") {
-				quality = p
+// captionParser returns the parser chain for posts from storageChatID: the
+// channel's templates first, then the built-in patterns.
+func captionParser(ctx context.Context, db storage.Store, storageChatID int64) caption.Chain {
+	var chain caption.Chain
+	if db != nil && storageChatID != 0 {
+		templates, err := db.ListCaptionTemplates(ctx, storageChatID)
+		if err != nil {
+			log.Printf("caption templates error: %v (chat_id=%d)", err, storageChatID)
+		}
+		for _, t := range templates {
+			tpl, err := caption.NewTemplate(t.Pattern)
+			if err != nil {
+				log.Printf("caption template skipped: %v (chat_id=%d)", err, storageChatID)
 				continue
 			}
-			if voice == "" {
-				voice = p
-			}
+			chain = append(chain, tpl)
+		}
+	}
+	return append(chain, caption.Builtin()...)
+}
+
+// fileEpisodes stores one storage post under every episode the caption
+// covers and queues notices for the new ones.
+func fileEpisodes(ctx context.Context, db storage.Store, kpID int, res caption.Result, storageChatID int64, storageMsgID int, f *mediaFile) error {
+	v := episodeVariant(res.Voice, res.Quality, storageChatID, storageMsgID, f)
+	for _, ep := range res.Episodes() {
+		added, err := db.UpsertSeriesEpisode(ctx, kpID, res.Season, ep, v)
+		if err != nil {
+			return err
 		}
+		if added {
+			queueEpisodeNotice(ctx, db, kpID, res.Season, ep, res.Voice)
+		}
+	}
+	return nil
+}
+
+// episodeVariant builds the stored variant for a storage post, with the file
+// size and duration when the post carries a file.
+func episodeVariant(voice string, quality string, storageChatID int64, storageMsgID int, f *mediaFile) storage.EpisodeVariant {
+	v := storage.EpisodeVariant{
+		StorageChatID:    storageChatID,
+		StorageMessageID: storageMsgID,
+		Voice:            voice,
+		Quality:          quality,
+	}
+	if f != nil {
+		v.FileSize = f.FileSize
+		v.Duration = f.Duration
 	}
+	return v
+}
+
+// parseUpload reads season and episode from the caption of a storage post,
+// falling back to the file name. Without a quality in either, it is guessed
+// from the frame size.
+func parseUpload(ctx context.Context, db storage.Store, storageChatID int64, msg *message) caption.Result {
+	return parseUploadWith(captionParser(ctx, db, storageChatID), msg)
+}
 
-	// Also try to detect quality outside parentheses
-	if quality == "" {
-		reQuality := regexp.MustCompile(`(?i)\b(\d{3,4}p)\b`)
-		if m := reQuality.FindStringSubmatch(c); len(m) == 2 {
-			quality = m[1]
+// parseUploadWith is parseUpload with an already loaded parser chain.
+func parseUploadWith(chain caption.Chain, msg *message) caption.Result {
+	res := chain.Parse(firstNonEmpty(msg.Caption, msg.Text))
+	f := msg.media()
+	if f == nil {
+		return res
+	}
+	if name := strings.TrimSpace(f.FileName); name != "" {
+		byName := chain.Parse(name)
+		if !res.OK() && byName.OK() {
+			res.Season, res.Episode, res.EpisodeEnd = byName.Season, byName.Episode, byName.EpisodeEnd
+			res.Parser = byName.Parser + " (имя файла)"
 		}
+		res.Voice = firstNonEmpty(res.Voice, byName.Voice)
+		res.Quality = firstNonEmpty(res.Quality, byName.Quality)
 	}
+	if res.Quality == "" {
+		res.Quality = caption.QualityFromFrame(f.Width, f.Height)
+	}
+	return res
+}
 
-	return
+// formatEpisodeRange renders "S1E5" or "S1E5-6".
+func formatEpisodeRange(res caption.Result) string {
+	if res.EpisodeEnd > res.Episode {
+		return fmt.Sprintf("S%dE%d-%d", res.Season, res.Episode, res.EpisodeEnd)
+	}
+	return fmt.Sprintf("S%dE%d", res.Season, res.Episode)
 }
 
 var iframeSrcRe = regexp.MustCompile(`(?i)src=\"([^\"]+)\"`)
@@ -1689,7 +3086,7 @@ func (c *inlineMovieCache) Set(kpID int, data inlineMovieData, ttl time.Duration
 
 var inlineCache = newInlineMovieCache()
 
-func buildMoviePayload(ctx context.Context, movies *neomovies.Client, db *storage.Mongo, kpID int) (*moviePayload, error) {
+func buildMoviePayload(ctx context.Context, movies neomovies.API, db storage.Store, userID int64, kpID int) (*moviePayload, error) {
 	if kpID <= 0 {
 		return nil, fmt.Errorf("invalid kp_id")
 	}
@@ -1798,12 +3195,7 @@ func buildMoviePayload(ctx context.Context, movies *neomovies.Client, db *storag
 	if title == "" {
 		title = fmt.Sprintf("kp_%d", kpID)
 	}
-	year := ""
-	if info.Year != "" {
-		year = info.Year
-	} else if info.ReleaseDate != "" && len(info.ReleaseDate) >= 4 {
-		year = info.ReleaseDate[0:4]
-	}
+	year := releaseYear(info)
 	displayTitle := title
 	if year != "" {
 		displayTitle = fmt.Sprintf("%s (%s)", title, year)
@@ -1833,10 +3225,18 @@ func buildMoviePayload(ctx context.Context, movies *neomovies.Client, db *storag
 	})
 	if db != nil {
 		if watch, _ := db.GetWatchItemByKPID(ctx, kpID); watch != nil {
-			keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []tg.InlineKeyboardButton{{Text: "Смотреть в Telegram", CallbackData: fmt.Sprintf("watch:%d", kpID)}})
+			keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []tg.InlineKeyboardButton{{Text: "Смотреть в Telegram", CallbackData: cbdata.Data(cbdata.Watch{KPID: kpID})}})
+			if next, ok := continueEpisode(ctx, db, watch, userID); ok {
+				keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []tg.InlineKeyboardButton{{Text: fmt.Sprintf("Продолжить: S%dE%d", next.Season, next.Episode), CallbackData: cbdata.Data(next)}})
+			}
+		} else {
+			keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []tg.InlineKeyboardButton{{Text: "Запросить в Telegram", CallbackData: cbdata.Data(cbdata.Request{KPID: kpID})}})
+		}
+		if userID != 0 {
+			keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []tg.InlineKeyboardButton{favoriteButton(ctx, db, kpID, userID)})
 		}
 	}
-	keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []tg.InlineKeyboardButton{{Text: "Закрыть", CallbackData: "close"}})
+	keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []tg.InlineKeyboardButton{{Text: "Закрыть", CallbackData: cbdata.Data(cbdata.Close{})}})
 
 	captionLines := []string{fmt.Sprintf("<b>%s</b>", html.EscapeString(displayTitle))}
 	if rating > 0 {
@@ -1873,12 +3273,12 @@ func buildMoviePayload(ctx context.Context, movies *neomovies.Client, db *storag
 	}, nil
 }
 
-func sendMovieCard(ctx context.Context, bot *tg.Client, movies *neomovies.Client, db *storage.Mongo, chatID int64, kpID int) error {
+func sendMovieCard(ctx context.Context, bot *tg.Client, movies neomovies.API, db storage.Store, chatID int64, userID int64, kpID int) error {
 	if kpID <= 0 {
 		return fmt.Errorf("invalid kp_id")
 	}
 
-	payload, err := buildMoviePayload(ctx, movies, db, kpID)
+	payload, err := buildMoviePayload(ctx, movies, db, userID, kpID)
 	if err != nil {
 		return err
 	}
@@ -1945,20 +3345,17 @@ func findEpisode(season *storage.Season, epNum int) (*storage.Episode, int) {
 	return nil, -1
 }
 
-func sendEpisodeWithNav(ctx context.Context, bot *tg.Client, item *storage.WatchItem, chatID int64, seasonNum int, epNum int, voiceIdx int, variantIdx int) error {
+func sendEpisodeWithNav(ctx context.Context, bot *tg.Client, db storage.Store, item *storage.WatchItem, userID int64, chatID int64, seasonNum int, epNum int, voiceID int, variantIdx int) error {
 	season := findSeason(item, seasonNum)
 	if season == nil {
 		return fmt.Errorf("season not found")
 	}
-	ep, idx := findEpisode(season, epNum)
-	if ep == nil || idx == -1 {
+	ep, _ := findEpisode(season, epNum)
+	if ep == nil {
 		return fmt.Errorf("episode not found")
 	}
 
-	voice := ""
-	if voiceIdx >= 0 {
-		voice = voiceByIndex(item, voiceIdx)
-	}
+	voice := item.VoiceName(voiceID)
 
 	if len(ep.Variants) > 1 && voice == "" && variantIdx < 0 {
 		rows := [][]tg.InlineKeyboardButton{}
@@ -1970,7 +3367,7 @@ func sendEpisodeWithNav(ctx context.Context, bot *tg.Client, item *storage.Watch
 			}
 			btn := tg.InlineKeyboardButton{
 				Text:         vName,
-				CallbackData: fmt.Sprintf("epv:%d:%d:%d:%d", item.KPID, seasonNum, epNum, i),
+				CallbackData: cbdata.Data(cbdata.EpisodeVariant{KPID: item.KPID, Season: seasonNum, Episode: epNum, Variant: i}),
 			}
 			if len(row) == 2 {
 				rows = append(rows, row)
@@ -1981,7 +3378,7 @@ func sendEpisodeWithNav(ctx context.Context, bot *tg.Client, item *storage.Watch
 		if len(row) > 0 {
 			rows = append(rows, row)
 		}
-		rows = append(rows, []tg.InlineKeyboardButton{{Text: "Закрыть", CallbackData: "close"}})
+		rows = append(rows, []tg.InlineKeyboardButton{{Text: "Закрыть", CallbackData: cbdata.Data(cbdata.Close{})}})
 		kb := tg.NewInlineKeyboardMarkup(rows)
 		return bot.SendMessage(ctx, tg.SendMessageRequest{
 			ChatID:      chatID,
@@ -1992,14 +3389,18 @@ func sendEpisodeWithNav(ctx context.Context, bot *tg.Client, item *storage.Watch
 
 	storageChatID := ep.StorageChatID
 	storageMsgID := ep.StorageMessageID
+	watchedVoice := voiceID
 	if len(ep.Variants) > 0 {
 		if variantIdx >= 0 && variantIdx < len(ep.Variants) {
 			v := ep.Variants[variantIdx]
 			storageChatID = v.StorageChatID
 			storageMsgID = v.StorageMessageID
+			if v.VoiceID > 0 {
+				watchedVoice = v.VoiceID
+			}
 		} else if voice != "" {
 			for _, v := range ep.Variants {
-				if strings.EqualFold(strings.TrimSpace(v.Voice), voice) {
+				if v.VoiceID == voiceID || strings.EqualFold(strings.TrimSpace(v.Voice), voice) {
 					storageChatID = v.StorageChatID
 					storageMsgID = v.StorageMessageID
 					break
@@ -2012,29 +3413,30 @@ func sendEpisodeWithNav(ctx context.Context, bot *tg.Client, item *storage.Watch
 	if err != nil || copiedID <= 0 {
 		return err
 	}
+	recordProgress(ctx, db, storage.WatchProgress{UserID: userID, KPID: item.KPID, Season: seasonNum, Episode: epNum, VoiceID: watchedVoice})
 
-	hasPrev := idx > 0
-	hasNext := idx < len(season.Episodes)-1
+	prevSeason, _, hasPrev := item.AdjacentEpisode(seasonNum, epNum, -1, voice)
+	nextSeason, _, hasNext := item.AdjacentEpisode(seasonNum, epNum, 1, voice)
 	rows := make([][]tg.InlineKeyboardButton, 0, 2)
 	if hasPrev || hasNext {
 		nav := []tg.InlineKeyboardButton{}
 		if hasPrev {
-			if voiceIdx >= 0 {
-				nav = append(nav, tg.InlineKeyboardButton{Text: "<<<", CallbackData: fmt.Sprintf("epnav:%d:%d:%d:-1:%d", item.KPID, seasonNum, epNum, voiceIdx)})
-			} else {
-				nav = append(nav, tg.InlineKeyboardButton{Text: "<<<", CallbackData: fmt.Sprintf("epnav:%d:%d:%d:-1", item.KPID, seasonNum, epNum)})
+			text := "<<<"
+			if prevSeason != seasonNum {
+				text = fmt.Sprintf("<<< %d сезон", prevSeason)
 			}
+			nav = append(nav, tg.InlineKeyboardButton{Text: text, CallbackData: cbdata.Data(cbdata.EpisodeNav{KPID: item.KPID, Season: seasonNum, Episode: epNum, Dir: -1, VoiceID: voiceID})})
 		}
 		if hasNext {
-			if voiceIdx >= 0 {
-				nav = append(nav, tg.InlineKeyboardButton{Text: ">>>", CallbackData: fmt.Sprintf("epnav:%d:%d:%d:1:%d", item.KPID, seasonNum, epNum, voiceIdx)})
-			} else {
-				nav = append(nav, tg.InlineKeyboardButton{Text: ">>>", CallbackData: fmt.Sprintf("epnav:%d:%d:%d:1", item.KPID, seasonNum, epNum)})
+			text := ">>>"
+			if nextSeason != seasonNum {
+				text = fmt.Sprintf("%d сезон >>>", nextSeason)
 			}
+			nav = append(nav, tg.InlineKeyboardButton{Text: text, CallbackData: cbdata.Data(cbdata.EpisodeNav{KPID: item.KPID, Season: seasonNum, Episode: epNum, Dir: 1, VoiceID: voiceID})})
 		}
 		rows = append(rows, nav)
 	}
-	rows = append(rows, []tg.InlineKeyboardButton{{Text: "Закрыть", CallbackData: "close"}})
+	rows = append(rows, []tg.InlineKeyboardButton{{Text: "Закрыть", CallbackData: cbdata.Data(cbdata.Close{})}})
 	kb := tg.NewInlineKeyboardMarkup(rows)
 
 	return bot.EditMessageReplyMarkup(ctx, tg.EditMessageReplyMarkupRequest{
@@ -2044,6 +3446,240 @@ func sendEpisodeWithNav(ctx context.Context, bot *tg.Client, item *storage.Watch
 	})
 }
 
+// New episodes are announced once uploads settle: noticeDelay after the
+// last added episode, but no later than noticeMaxDelay after the first.
+const (
+	noticeDelay    = 2 * time.Minute
+	noticeMaxDelay = 15 * time.Minute
+)
+
+func queueEpisodeNotice(ctx context.Context, db storage.Store, kpID int, seasonNum int, epNum int, voice string) {
+	ep := storage.NewEpisode{Season: seasonNum, Episode: epNum, Voice: strings.TrimSpace(voice)}
+	if err := db.QueueEpisodeNotice(ctx, kpID, ep, noticeDelay, noticeMaxDelay); err != nil {
+		log.Printf("queue episode notice error: %v (kp_id=%d s=%d e=%d)", err, kpID, seasonNum, epNum)
+	}
+}
+
+// Notice deliveries stop noticeSendMargin before the request deadline so
+// the one in flight can still be re-queued. A failed send is retried after
+// noticeRetryDelay, up to maxNoticeAttempts times.
+const (
+	noticeSendMargin  = 1500 * time.Millisecond
+	noticeRetryDelay  = time.Minute
+	maxNoticeAttempts = 3
+)
+
+// flushEpisodeNotices expands due notices into one delivery per subscriber
+// and sends queued deliveries until the request deadline is near. It returns
+// the number of messages sent. Users who blocked the bot are unsubscribed.
+func flushEpisodeNotices(ctx context.Context, bot *tg.Client, db storage.Store) int {
+	if db == nil {
+		return 0
+	}
+	queueDueNotices(ctx, db)
+	items := map[int]*storage.WatchItem{}
+	sent := 0
+	for {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < noticeSendMargin {
+			return sent
+		}
+		d, err := db.TakeNoticeDelivery(ctx, time.Now())
+		if err != nil {
+			log.Printf("take notice delivery error: %v", err)
+			return sent
+		}
+		if d == nil {
+			return sent
+		}
+		item, ok := items[d.KPID]
+		if !ok {
+			item, _ = db.GetWatchItemByKPID(ctx, d.KPID)
+			items[d.KPID] = item
+		}
+		if item == nil || len(d.Episodes) == 0 {
+			continue
+		}
+		text, kb := formatEpisodeNotice(item, storage.EpisodeNotice{KPID: d.KPID, Episodes: d.Episodes})
+		err = bot.SendMessage(ctx, tg.SendMessageRequest{ChatID: d.UserID, Text: text, ReplyMarkup: &kb})
+		if tg.IsForbidden(err) {
+			_ = db.Unsubscribe(ctx, d.UserID, d.KPID)
+			continue
+		}
+		if err != nil {
+			log.Printf("episode notice send error: %v (user_id=%d kp_id=%d)", err, d.UserID, d.KPID)
+			requeueNoticeDelivery(ctx, db, *d)
+			if ctx.Err() != nil {
+				return sent
+			}
+			continue
+		}
+		sent++
+	}
+}
+
+// queueDueNotices turns each due notice into deliveries for the current
+// subscribers of its series.
+func queueDueNotices(ctx context.Context, db storage.Store) {
+	notices, err := db.TakeDueNotices(ctx, time.Now())
+	if err != nil {
+		log.Printf("take episode notices error: %v", err)
+	}
+	now := time.Now()
+	for _, n := range notices {
+		if len(n.Episodes) == 0 {
+			continue
+		}
+		subscribers, err := db.Subscribers(ctx, n.KPID)
+		if err != nil {
+			log.Printf("subscribers error: %v (kp_id=%d), notice dropped", err, n.KPID)
+			continue
+		}
+		ds := make([]storage.NoticeDelivery, 0, len(subscribers))
+		for _, userID := range subscribers {
+			ds = append(ds, storage.NoticeDelivery{UserID: userID, KPID: n.KPID, Episodes: n.Episodes, DueAt: now})
+		}
+		if err := db.QueueNoticeDeliveries(ctx, ds); err != nil {
+			log.Printf("queue notice deliveries error: %v (kp_id=%d subscribers=%d), notice dropped", err, n.KPID, len(ds))
+		}
+	}
+}
+
+// requeueNoticeDelivery puts d back after a failed send. Sends cut short by
+// the request deadline don't count as attempts.
+func requeueNoticeDelivery(ctx context.Context, db storage.Store, d storage.NoticeDelivery) {
+	if ctx.Err() == nil {
+		d.Attempts++
+	}
+	if d.Attempts >= maxNoticeAttempts {
+		log.Printf("episode notice given up after %d attempts (user_id=%d kp_id=%d)", d.Attempts, d.UserID, d.KPID)
+		return
+	}
+	d.DueAt = time.Now().Add(noticeRetryDelay)
+	// ctx may be the one that just expired
+	qctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 2*time.Second)
+	defer cancel()
+	if err := db.QueueNoticeDeliveries(qctx, []storage.NoticeDelivery{d}); err != nil {
+		log.Printf("requeue notice delivery error: %v (user_id=%d kp_id=%d)", err, d.UserID, d.KPID)
+	}
+}
+
+func formatEpisodeNotice(item *storage.WatchItem, n storage.EpisodeNotice) (string, tg.InlineKeyboardMarkup) {
+	eps := append([]storage.NewEpisode(nil), n.Episodes...)
+	sort.Slice(eps, func(i, j int) bool {
+		if eps[i].Season != eps[j].Season {
+			return eps[i].Season < eps[j].Season
+		}
+		return eps[i].Episode < eps[j].Episode
+	})
+	title := strings.TrimSpace(item.Title)
+	if title == "" {
+		title = fmt.Sprintf("kp_%d", item.KPID)
+	}
+
+	bySeason := map[int][]int{}
+	seasons := []int{}
+	voices := []string{}
+	seenVoice := map[string]struct{}{}
+	for _, ep := range eps {
+		if _, ok := bySeason[ep.Season]; !ok {
+			seasons = append(seasons, ep.Season)
+		}
+		if nums := bySeason[ep.Season]; len(nums) == 0 || nums[len(nums)-1] != ep.Episode {
+			bySeason[ep.Season] = append(nums, ep.Episode)
+		}
+		key := strings.ToLower(ep.Voice)
+		if _, ok := seenVoice[key]; !ok && ep.Voice != "" {
+			seenVoice[key] = struct{}{}
+			voices = append(voices, ep.Voice)
+		}
+	}
+	lines := []string{fmt.Sprintf("Новые серии: %s", title)}
+	for _, sn := range seasons {
+		nums := bySeason[sn]
+		lines = append(lines, fmt.Sprintf("%d сезон: %s %s", sn, formatEpisodeList(nums), seriesWord(len(nums))))
+	}
+	if len(voices) > 0 {
+		lines = append(lines, "Озвучка: "+strings.Join(voices, ", "))
+	}
+
+	first := eps[0]
+	voiceID := cbdata.NoVoice
+	if len(voices) == 1 {
+		if v, ok := item.FindVoice(voices[0]); ok {
+			voiceID = v.ID
+		}
+	}
+	rows := [][]tg.InlineKeyboardButton{
+		{{Text: fmt.Sprintf("Смотреть S%dE%d", first.Season, first.Episode), CallbackData: cbdata.Data(cbdata.Episode{KPID: item.KPID, Season: first.Season, Episode: first.Episode, VoiceID: voiceID})}},
+	}
+	if len(bySeason[first.Season]) > 1 {
+		rows = append(rows, []tg.InlineKeyboardButton{{Text: fmt.Sprintf("%d сезон", first.Season), CallbackData: cbdata.Data(cbdata.Season{KPID: item.KPID, Season: first.Season, VoiceID: voiceID})}})
+	}
+	rows = append(rows, []tg.InlineKeyboardButton{{Text: "Отписаться", CallbackData: cbdata.Data(cbdata.Unsubscribe{KPID: item.KPID})}})
+	return strings.Join(lines, "\n"), tg.NewInlineKeyboardMarkup(rows)
+}
+
+// subscribeButton toggles the new-episode subscription of userID.
+func subscribeButton(ctx context.Context, db storage.Store, kpID int, userID int64) tg.InlineKeyboardButton {
+	if on, _ := db.IsSubscribed(ctx, userID, kpID); on {
+		return tg.InlineKeyboardButton{Text: "Отписаться", CallbackData: cbdata.Data(cbdata.Unsubscribe{KPID: kpID})}
+	}
+	return tg.InlineKeyboardButton{Text: "Подписаться", CallbackData: cbdata.Data(cbdata.Subscribe{KPID: kpID})}
+}
+
+// withSubscribeRow adds the subscribe button to a series menu, above its
+// last (Назад/Закрыть) row.
+func withSubscribeRow(ctx context.Context, db storage.Store, kb *tg.InlineKeyboardMarkup, kpID int, userID int64) *tg.InlineKeyboardMarkup {
+	if kb == nil || userID == 0 {
+		return kb
+	}
+	row := []tg.InlineKeyboardButton{subscribeButton(ctx, db, kpID, userID)}
+	rows := kb.InlineKeyboard
+	if len(rows) == 0 {
+		kb.InlineKeyboard = [][]tg.InlineKeyboardButton{row}
+		return kb
+	}
+	out := make([][]tg.InlineKeyboardButton, 0, len(rows)+1)
+	out = append(out, rows[:len(rows)-1]...)
+	out = append(out, row, rows[len(rows)-1])
+	kb.InlineKeyboard = out
+	return kb
+}
+
+func recordProgress(ctx context.Context, db storage.Store, p storage.WatchProgress) {
+	if db == nil || p.UserID == 0 {
+		return
+	}
+	if err := db.SaveProgress(ctx, p); err != nil {
+		log.Printf("save progress error: %v (user_id=%d kp_id=%d)", err, p.UserID, p.KPID)
+	}
+}
+
+// continueEpisode picks the episode after the one userID opened last, in the
+// same voice. It returns false for movies, unknown users and finished series.
+func continueEpisode(ctx context.Context, db storage.Store, item *storage.WatchItem, userID int64) (cbdata.Episode, bool) {
+	if db == nil || item == nil || item.Type != "series" || userID == 0 {
+		return cbdata.Episode{}, false
+	}
+	p, _ := db.GetProgress(ctx, userID, item.KPID)
+	if p == nil || p.Season <= 0 || p.Episode <= 0 {
+		return cbdata.Episode{}, false
+	}
+	return nextEpisodeAfter(item, p)
+}
+
+func nextEpisodeAfter(item *storage.WatchItem, p *storage.WatchProgress) (cbdata.Episode, bool) {
+	voiceID := p.VoiceID
+	if _, ok := item.VoiceByID(voiceID); !ok {
+		voiceID = cbdata.NoVoice
+	}
+	seasonNum, epNum, ok := item.AdjacentEpisode(p.Season, p.Episode, 1, item.VoiceName(voiceID))
+	if !ok {
+		return cbdata.Episode{}, false
+	}
+	return cbdata.Episode{KPID: item.KPID, Season: seasonNum, Episode: epNum, VoiceID: voiceID}, true
+}
+
 func buildSeasonHeader(item *storage.WatchItem, seasonNum int, voice string) string {
 	title := strings.TrimSpace(item.Title)
 	if title == "" {
@@ -2179,43 +3815,44 @@ func collectEpisodeDiffs(season *storage.Season, base string, kind string) []str
 	return lines
 }
 
-func collectSeriesVoices(item *storage.WatchItem) []string {
+// collectSeriesVoices returns the voices worth choosing between: those of
+// episodes that exist in more than one dub, sorted by name.
+func collectSeriesVoices(item *storage.WatchItem) []storage.Voice {
 	if item == nil {
 		return nil
 	}
-	seen := map[string]struct{}{}
-	out := []string{}
+	seen := map[int]struct{}{}
+	out := []storage.Voice{}
 	for _, s := range item.Seasons {
 		for _, ep := range s.Episodes {
 			if len(ep.Variants) > 1 {
 				for _, v := range ep.Variants {
-					name := strings.TrimSpace(v.Voice)
-					if name == "" {
+					voice, ok := item.FindVoice(v.Voice)
+					if !ok {
 						continue
 					}
-					key := strings.ToLower(name)
-					if _, ok := seen[key]; ok {
+					if _, ok := seen[voice.ID]; ok {
 						continue
 					}
-					seen[key] = struct{}{}
-					out = append(out, name)
+					seen[voice.ID] = struct{}{}
+					out = append(out, voice)
 				}
 			}
 		}
 	}
-	sort.Strings(out)
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
 	return out
 }
 
-func buildSeriesVoiceKeyboard(kpID int, voices []string) tg.InlineKeyboardMarkup {
+func buildSeriesVoiceKeyboard(kpID int, voices []storage.Voice) tg.InlineKeyboardMarkup {
 	rows := [][]tg.InlineKeyboardButton{}
 	row := []tg.InlineKeyboardButton{
-		{Text: "Все", CallbackData: fmt.Sprintf("seriesvoice:%d:-1", kpID)},
+		{Text: "Все", CallbackData: cbdata.Data(cbdata.SeriesVoice{KPID: kpID, VoiceID: cbdata.NoVoice})},
 	}
-	for i, v := range voices {
+	for _, v := range voices {
 		btn := tg.InlineKeyboardButton{
-			Text:         v,
-			CallbackData: fmt.Sprintf("seriesvoice:%d:%d", kpID, i),
+			Text:         v.Name,
+			CallbackData: cbdata.Data(cbdata.SeriesVoice{KPID: kpID, VoiceID: v.ID}),
 		}
 		if len(row) == 3 {
 			rows = append(rows, row)
@@ -2226,21 +3863,10 @@ func buildSeriesVoiceKeyboard(kpID int, voices []string) tg.InlineKeyboardMarkup
 	if len(row) > 0 {
 		rows = append(rows, row)
 	}
-	rows = append(rows, []tg.InlineKeyboardButton{{Text: "Закрыть", CallbackData: "close"}})
+	rows = append(rows, []tg.InlineKeyboardButton{{Text: "Закрыть", CallbackData: cbdata.Data(cbdata.Close{})}})
 	return tg.NewInlineKeyboardMarkup(rows)
 }
 
-func voiceByIndex(item *storage.WatchItem, idx int) string {
-	if item == nil || idx < 0 {
-		return ""
-	}
-	voices := collectSeriesVoices(item)
-	if idx >= len(voices) {
-		return ""
-	}
-	return voices[idx]
-}
-
 func formatEpisodeList(nums []int) string {
 	parts := make([]string, 0, len(nums))
 	for _, n := range nums {
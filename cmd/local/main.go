@@ -3,12 +3,14 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -16,11 +18,31 @@ import (
 	"time"
 
 	handler "handler/api"
+	"handler/internal/tg"
 )
 
 func main() {
 	_ = loadDotEnv(".env")
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "setwebhook":
+			if err := setWebhook(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "deletewebhook":
+			if err := deleteWebhookCmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	if strings.TrimSpace(os.Getenv("WEBHOOK_SECRET")) == "" {
+		log.Printf("WEBHOOK_SECRET is empty, /api/webhook accepts updates from anyone")
+	}
+
 	port := strings.TrimSpace(os.Getenv("PORT"))
 	if port == "" {
 		port = "7955"
@@ -28,6 +50,7 @@ func main() {
 
 	if strings.TrimSpace(os.Getenv("LOCAL_POLLING")) == "1" {
 		go startPolling()
+		go startCron()
 	}
 
 	mux := http.NewServeMux()
@@ -66,7 +89,11 @@ func startPolling() {
 	}
 
 	base := fmt.Sprintf("https://api.telegram.org/bot%s", token)
-	deleteWebhook(base)
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	if err := newBot(token).DeleteWebhook(ctx, true); err != nil {
+		log.Printf("deleteWebhook error: %v", err)
+	}
+	cancel()
 
 	offset := 0
 	client := &http.Client{Timeout: 45 * time.Second}
@@ -111,6 +138,9 @@ func startPolling() {
 
 			r := httptest.NewRequest(http.MethodPost, "http://localhost/api/webhook", bytes.NewReader(raw))
 			r.Header.Set("Content-Type", "application/json")
+			if secret := strings.TrimSpace(os.Getenv("WEBHOOK_SECRET")); secret != "" {
+				r.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+			}
 			w := httptest.NewRecorder()
 			handler.Handler(w, r)
 			if w.Code != 200 {
@@ -120,24 +150,64 @@ func startPolling() {
 	}
 }
 
-func deleteWebhook(base string) {
-	client := &http.Client{Timeout: 15 * time.Second}
-	u := base + "/deleteWebhook?drop_pending_updates=true"
-	req, _ := http.NewRequest(http.MethodGet, u, nil)
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("deleteWebhook error: %v", err)
+// startCron stands in for Vercel Cron while polling: due notices are only
+// sent from /api/cron/notices.
+func startCron() {
+	secret := strings.TrimSpace(os.Getenv("CRON_SECRET"))
+	if secret == "" {
+		log.Printf("CRON_SECRET is empty, new-episode notices will not be sent")
 		return
 	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-	log.Printf("deleteWebhook status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(body)))
+	for range time.Tick(30 * time.Second) {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost/api/cron/notices", nil)
+		r.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler.Handler(w, r)
+		if w.Code != 200 {
+			log.Printf("cron returned status=%d", w.Code)
+		}
+	}
 }
 
 func urlQueryAllowedUpdates() string {
-	// telegram expects json array as string; encode minimal set we use
-	// message, callback_query, inline_query, chosen_inline_result
-	return "%5B%22message%22%2C%22callback_query%22%2C%22inline_query%22%2C%22chosen_inline_result%22%5D"
+	// telegram expects json array as string
+	b, _ := json.Marshal(tg.AllowedUpdates)
+	return url.QueryEscape(string(b))
+}
+
+// setWebhook registers <url> (or PUBLIC_BASE_URL/api/webhook) with the
+// WEBHOOK_SECRET token: go run ./cmd/local setwebhook [url]
+func setWebhook(args []string) error {
+	token := strings.TrimSpace(os.Getenv("BOT_TOKEN"))
+	if token == "" {
+		return fmt.Errorf("BOT_TOKEN is empty")
+	}
+	u := ""
+	if len(args) > 0 {
+		u = strings.TrimSpace(args[0])
+	} else if base := strings.TrimRight(strings.TrimSpace(os.Getenv("PUBLIC_BASE_URL")), "/"); base != "" {
+		u = base + "/api/webhook"
+	}
+	if !strings.HasPrefix(u, "https://") {
+		return fmt.Errorf("webhook url must be https, got %q", u)
+	}
+	secret := strings.TrimSpace(os.Getenv("WEBHOOK_SECRET"))
+	if secret == "" {
+		log.Printf("WEBHOOK_SECRET is empty, webhook requests will not be verified")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	bot := newBot(token)
+	if err := bot.SetWebhook(ctx, tg.SetWebhookRequest{URL: u, SecretToken: secret, AllowedUpdates: tg.AllowedUpdates}); err != nil {
+		return err
+	}
+	info, err := bot.GetWebhookInfo(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("webhook set: url=%s pending=%d allowed_updates=%v", info.URL, info.PendingUpdateCount, info.AllowedUpdates)
+	return nil
 }
 
 func loadDotEnv(path string) error {
@@ -183,3 +253,42 @@ func loadDotEnv(path string) error {
 	}
 	return scanner.Err()
 }
+
+// deleteWebhookCmd removes the webhook, e.g. before switching to polling:
+// go run ./cmd/local deletewebhook [-drop-pending]
+func deleteWebhookCmd(args []string) error {
+	token := strings.TrimSpace(os.Getenv("BOT_TOKEN"))
+	if token == "" {
+		return fmt.Errorf("BOT_TOKEN is empty")
+	}
+	drop := false
+	for _, a := range args {
+		switch a {
+		case "-drop-pending", "--drop-pending":
+			drop = true
+		default:
+			return fmt.Errorf("unknown argument %q", a)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	bot := newBot(token)
+	if err := bot.DeleteWebhook(ctx, drop); err != nil {
+		return err
+	}
+	info, err := bot.GetWebhookInfo(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("webhook deleted: url=%q pending=%d", info.URL, info.PendingUpdateCount)
+	return nil
+}
+
+// newBot builds a client with the TG_RATE_* limits.
+func newBot(token string) *tg.Client {
+	limits, err := tg.RateLimitsFromEnv(os.Getenv)
+	if err != nil {
+		log.Printf("telegram rate limits: %v, using defaults for those", err)
+	}
+	return tg.NewClientWithLimiter(token, tg.NewLimiter(limits))
+}
@@ -1,10 +1,13 @@
 import { apiClient } from './client';
-import type { LibraryItem, MovieDetails } from '../types';
+import type { LibraryPage, LibraryQuery, MovieDetails } from '../types';
 
 export const libraryAPI = {
-  // Get list of all movies/series in the bot library
-  getLibrary(limit = 200) {
-    return apiClient.get<LibraryItem[]>(`/library?limit=${limit}`);
+  // Get one page of the bot library; filtering and sorting happen on the server
+  getLibrary(query: LibraryQuery = {}) {
+    const params = Object.fromEntries(
+      Object.entries(query).filter(([, v]) => v !== undefined && v !== ''),
+    );
+    return apiClient.get<LibraryPage>('/library', { params });
   },
 
   // Get detailed information about a specific item
@@ -50,6 +50,9 @@ export const Filters = ({
             displayEmpty
           >
             <MenuItem value="added">По дате добавления</MenuItem>
+            <MenuItem value="updated">По обновлению</MenuItem>
+            <MenuItem value="rating">По рейтингу</MenuItem>
+            <MenuItem value="year">По году</MenuItem>
             <MenuItem value="title">По названию</MenuItem>
           </Select>
         </FormControl>
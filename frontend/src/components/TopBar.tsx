@@ -84,6 +84,9 @@ export const TopBar = ({
             <FormControl size="small" sx={{ minWidth: 200 }}>
               <Select value={sortBy} onChange={(e) => onSortByChange(e.target.value)} displayEmpty>
                 <MenuItem value="added">По дате добавления</MenuItem>
+                <MenuItem value="updated">По обновлению</MenuItem>
+                <MenuItem value="rating">По рейтингу</MenuItem>
+                <MenuItem value="year">По году</MenuItem>
                 <MenuItem value="title">По названию</MenuItem>
               </Select>
             </FormControl>
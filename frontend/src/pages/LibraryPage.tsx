@@ -1,103 +1,86 @@
 import {
   Box,
+  Button,
   CircularProgress,
   Alert,
-  Pagination,
   Typography,
 } from '@mui/material';
-import { useState, useEffect, useMemo } from 'react';
+import { useState, useEffect } from 'react';
 import { useNavigate } from 'react-router-dom';
 import { MovieCard } from '../components/MovieCard';
 import { libraryAPI } from '../api/library';
-import type { LibraryItem } from '../types';
+import type { LibraryItem, LibrarySort } from '../types';
 import { TopBar } from '../components/TopBar';
 
 export const LibraryPage = () => {
   const navigate = useNavigate();
   const [items, setItems] = useState<LibraryItem[]>([]);
+  const [nextCursor, setNextCursor] = useState<string | undefined>();
+  const [partial, setPartial] = useState(false);
   const [loading, setLoading] = useState(true);
+  const [loadingMore, setLoadingMore] = useState(false);
   const [error, setError] = useState<string | null>(null);
-  const [page, setPage] = useState(1);
   const [search, setSearch] = useState('');
+  const [query, setQuery] = useState('');
   const [type, setType] = useState('');
-  const [sortBy, setSortBy] = useState('added');
+  const [sortBy, setSortBy] = useState<LibrarySort>('added');
   const pageSize = 18;
 
   useEffect(() => {
+    // Debounce typing before hitting the server
+    const t = setTimeout(() => setQuery(search.trim()), 300);
+    return () => clearTimeout(t);
+  }, [search]);
+
+  useEffect(() => {
+    let cancelled = false;
     const loadLibrary = async () => {
       try {
         setLoading(true);
-        const response = await libraryAPI.getLibrary(400);
-        setItems(response.data);
+        setError(null);
+        const response = await libraryAPI.getLibrary({ q: query, type, sort: sortBy, limit: pageSize });
+        if (cancelled) return;
+        setItems(response.data.items);
+        setNextCursor(response.data.next_cursor);
+        setPartial(response.data.partial);
       } catch (err: any) {
-        setError(err.message || 'Failed to load library');
+        if (!cancelled) setError(err.message || 'Failed to load library');
       } finally {
-        setLoading(false);
+        if (!cancelled) setLoading(false);
       }
     };
 
     loadLibrary();
-  }, []);
-
-  const filtered = useMemo(() => {
-    let result = items;
-
-    if (search.trim()) {
-      const query = search.trim().toLowerCase();
-      result = result.filter((i) => i.title.toLowerCase().includes(query));
-    }
-
-    if (type) {
-      result = result.filter((i) => i.type === type);
-    }
-
-    if (sortBy) {
-      result = [...result].sort((a, b) => {
-        if (sortBy === 'title') {
-          return a.title.localeCompare(b.title);
-        }
-
-        const aDate = a.added_at ? new Date(a.added_at).getTime() : 0;
-        const bDate = b.added_at ? new Date(b.added_at).getTime() : 0;
-        return bDate - aDate;
+    return () => {
+      cancelled = true;
+    };
+  }, [query, type, sortBy]);
+
+  const loadMore = async () => {
+    if (!nextCursor) return;
+    try {
+      setLoadingMore(true);
+      const response = await libraryAPI.getLibrary({
+        q: query,
+        type,
+        sort: sortBy,
+        limit: pageSize,
+        cursor: nextCursor,
       });
+      setItems((prev) => [...prev, ...response.data.items]);
+      setNextCursor(response.data.next_cursor);
+      setPartial(response.data.partial);
+    } catch (err: any) {
+      setError(err.message || 'Failed to load library');
+    } finally {
+      setLoadingMore(false);
     }
-
-    return result;
-  }, [items, search, type, sortBy]);
-
-  const pageCount = Math.max(1, Math.ceil(filtered.length / pageSize));
-
-  const pageItems = useMemo(() => {
-    const start = (page - 1) * pageSize;
-    return filtered.slice(start, start + pageSize);
-  }, [filtered, page]);
-
-  useEffect(() => {
-    // Reset page when filters change
-    setPage(1);
-  }, [search, type, sortBy]);
+  };
 
   const handleMovieClick = (item: LibraryItem) => {
     navigate(`/item/${item.kp_id}`);
   };
 
-  if (loading) {
-    return (
-      <Box sx={{ display: 'flex', justifyContent: 'center', py: 4 }}>
-        <CircularProgress />
-      </Box>
-    );
-  }
-
-  if (error) {
-    return (
-      <Box sx={{ py: 4 }}>
-        <Alert severity="error">{error}</Alert>
-      </Box>
-    );
-  }
-
   return (
     <Box>
       <TopBar
@@ -106,7 +89,7 @@ export const LibraryPage = () => {
         type={type}
         sortBy={sortBy}
         onTypeChange={setType}
-        onSortByChange={setSortBy}
+        onSortByChange={(v) => setSortBy(v as LibrarySort)}
       />
 
       <Box sx={{ maxWidth: 1200, mx: 'auto', px: { xs: 2, sm: 3 }, py: { xs: 3, sm: 4 } }}>
@@ -118,7 +101,7 @@ export const LibraryPage = () => {
           <Alert severity="error" sx={{ mb: 3 }}>
             {error}
           </Alert>
-        ) : filtered.length === 0 ? (
+        ) : items.length === 0 ? (
           <Box sx={{ textAlign: 'center', py: 8 }}>
             <Typography variant="h6" color="text.secondary">
               Библиотека пуста
@@ -140,19 +123,24 @@ export const LibraryPage = () => {
                 mb: 4,
               }}
             >
-              {pageItems.map((item) => (
+              {items.map((item) => (
                 <MovieCard key={item.kp_id} item={item} onClick={handleMovieClick} />
               ))}
             </Box>
 
-            <Box sx={{ display: 'flex', justifyContent: 'center' }}>
-              <Pagination
-                count={pageCount}
-                page={page}
-                onChange={(_, p) => setPage(p)}
-                color="primary"
-              />
-            </Box>
+            {partial && (
+              <Alert severity="info" sx={{ mb: 3 }}>
+                Данные части тайтлов ещё загружаются
+              </Alert>
+            )}
+
+            {nextCursor && (
+              <Box sx={{ display: 'flex', justifyContent: 'center' }}>
+                <Button variant="outlined" onClick={loadMore} disabled={loadingMore}>
+                  {loadingMore ? <CircularProgress size={20} /> : 'Показать ещё'}
+                </Button>
+              </Box>
+            )}
           </>
         )}
       </Box>
@@ -14,6 +14,32 @@ export interface LibraryItem {
   seasons_count?: number;
   episodes_count?: number;
   voices?: string[];
+  meta_pending?: boolean;
+}
+
+export type LibrarySort = 'added' | 'updated' | 'rating' | 'title' | 'year';
+
+export interface LibraryQuery {
+  type?: string;
+  genre?: string;
+  voice?: string;
+  quality?: string;
+  year_from?: number;
+  year_to?: number;
+  min_rating?: number;
+  q?: string;
+  sort?: LibrarySort;
+  cursor?: string;
+  limit?: number;
+}
+
+export interface LibraryPage {
+  items: LibraryItem[];
+  // opaque, pass back as `cursor` for the next page
+  next_cursor?: string;
+  // set when some items are served without metadata (meta_pending)
+  partial: boolean;
+  pending?: number[];
 }
 
 export type MovieDetails = LibraryItem;
@@ -0,0 +1,211 @@
+package botcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrUsage makes the dispatcher reply with the command usage line.
+var ErrUsage = errors.New("usage")
+
+// ErrUnknown is returned by Lookup for text that is not a registered command.
+var ErrUnknown = errors.New("unknown command")
+
+// Arg describes one positional argument of a command.
+type Arg struct {
+	Name     string
+	Optional bool
+	// Rest takes the remaining text as is, spaces included. Only valid last.
+	Rest bool
+}
+
+// Args are the parsed arguments of a command invocation.
+type Args struct {
+	Fields []string
+	// Raw is the text after the command name, trimmed.
+	Raw string
+}
+
+func (a Args) Len() int { return len(a.Fields) }
+
+func (a Args) String(i int) string {
+	if i < 0 || i >= len(a.Fields) {
+		return ""
+	}
+	return strings.TrimSpace(a.Fields[i])
+}
+
+func (a Args) Int(i int) int {
+	n, _ := strconv.Atoi(a.String(i))
+	return n
+}
+
+func (a Args) Int64(i int) int64 {
+	n, _ := strconv.ParseInt(a.String(i), 10, 64)
+	return n
+}
+
+// RestFrom returns the raw text starting at field i.
+func (a Args) RestFrom(i int) string {
+	rest := a.Raw
+	for j := 0; j < i && j < len(a.Fields); j++ {
+		rest = strings.TrimSpace(rest)
+		rest = strings.TrimPrefix(rest, a.Fields[j])
+	}
+	return strings.TrimSpace(rest)
+}
+
+type Handler[T any] func(ctx context.Context, env T, args Args) error
+
+type Command[T any] struct {
+	Name string
+	Args []Arg
+	// Description is the short text shown by Telegram in the command menu.
+	Description string
+	// Note is appended to the usage line in /help.
+	Note string
+	// AltForms lists alternative invocations, e.g. a reply-based form.
+	AltForms  []string
+	AdminOnly bool
+	Handler   Handler[T]
+}
+
+// Usage renders the argument schema, e.g. "/del <kp_id>".
+func (c *Command[T]) Usage() string {
+	b := strings.Builder{}
+	b.WriteString("/" + c.Name)
+	for _, a := range c.Args {
+		name := a.Name
+		if a.Rest {
+			name += "..."
+		}
+		if a.Optional {
+			b.WriteString(" [" + name + "]")
+		} else {
+			b.WriteString(" <" + name + ">")
+		}
+	}
+	return b.String()
+}
+
+func (c *Command[T]) validate(args Args) error {
+	min, max := 0, len(c.Args)
+	for _, a := range c.Args {
+		if !a.Optional {
+			min++
+		}
+		if a.Rest {
+			max = -1
+		}
+	}
+	if args.Len() < min || (max >= 0 && args.Len() > max) {
+		return ErrUsage
+	}
+	return nil
+}
+
+type Registry[T any] struct {
+	commands []*Command[T]
+	byName   map[string]*Command[T]
+}
+
+func NewRegistry[T any]() *Registry[T] {
+	return &Registry[T]{byName: map[string]*Command[T]{}}
+}
+
+func (r *Registry[T]) Register(c *Command[T]) {
+	name := strings.ToLower(c.Name)
+	if _, ok := r.byName[name]; ok {
+		panic(fmt.Sprintf("botcmd: duplicate command %q", name))
+	}
+	r.byName[name] = c
+	r.commands = append(r.commands, c)
+}
+
+// Commands returns the registered commands in registration order.
+func (r *Registry[T]) Commands() []*Command[T] {
+	return append([]*Command[T](nil), r.commands...)
+}
+
+// Lookup resolves text to a command and its arguments. Commands addressed
+// to another bot ("/cmd@otherbot") are reported as unknown; botUsername may
+// be empty to accept any suffix.
+func (r *Registry[T]) Lookup(text string, botUsername string) (*Command[T], Args, error) {
+	name, raw, ok := Split(text)
+	if !ok {
+		return nil, Args{}, ErrUnknown
+	}
+	if at := strings.IndexByte(name, '@'); at >= 0 {
+		target := name[at+1:]
+		name = name[:at]
+		if botUsername != "" && !strings.EqualFold(target, strings.TrimPrefix(botUsername, "@")) {
+			return nil, Args{}, ErrUnknown
+		}
+	}
+	c, ok := r.byName[strings.ToLower(name)]
+	if !ok {
+		return nil, Args{}, ErrUnknown
+	}
+	args := Args{Fields: strings.Fields(raw), Raw: raw}
+	return c, args, c.validate(args)
+}
+
+// Split separates "/name rest" into the name (without the slash) and the
+// trimmed rest. ok is false when text is not a command.
+func Split(text string) (name string, rest string, ok bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "/") || len(text) < 2 {
+		return "", "", false
+	}
+	end := strings.IndexAny(text, " \t\n")
+	if end < 0 {
+		return text[1:], "", true
+	}
+	return text[1:end], strings.TrimSpace(text[end:]), true
+}
+
+// UsageText is the reply for a malformed invocation.
+func (c *Command[T]) UsageText() string {
+	return "Usage: " + strings.Join(append([]string{c.Usage()}, c.AltForms...), " OR ")
+}
+
+// HelpText lists usage lines of the commands visible to the caller.
+func (r *Registry[T]) HelpText(admin bool) string {
+	lines := []string{}
+	for _, c := range r.commands {
+		if c.AdminOnly && !admin {
+			continue
+		}
+		line := c.Usage()
+		if c.Note != "" {
+			line += "   " + c.Note
+		}
+		lines = append(lines, line)
+		lines = append(lines, c.AltForms...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// MenuEntry is a command as shown in Telegram's command menu.
+type MenuEntry struct {
+	Command     string
+	Description string
+}
+
+// Menu returns the entries visible to the caller sorted by name. Commands
+// without a Description are left out of the menu.
+func (r *Registry[T]) Menu(admin bool) []MenuEntry {
+	out := []MenuEntry{}
+	for _, c := range r.commands {
+		if (c.AdminOnly && !admin) || c.Description == "" {
+			continue
+		}
+		out = append(out, MenuEntry{Command: c.Name, Description: c.Description})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Command < out[j].Command })
+	return out
+}
@@ -0,0 +1,105 @@
+package botcmd
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func testRegistry() *Registry[struct{}] {
+	r := NewRegistry[struct{}]()
+	r.Register(&Command[struct{}]{Name: "start", Description: "Main menu"})
+	r.Register(&Command[struct{}]{Name: "search", Args: []Arg{{Name: "query", Rest: true}}, Description: "Find a title"})
+	r.Register(&Command[struct{}]{
+		Name:        "del",
+		Args:        []Arg{{Name: "kp_id"}, {Name: "season", Optional: true}},
+		Description: "Delete a title",
+		Note:        "(admin)",
+		AltForms:    []string{"reply /del to a post"},
+		AdminOnly:   true,
+	})
+	r.Register(&Command[struct{}]{Name: "debug", AdminOnly: true})
+	return r
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    string // command name and fields
+		wantErr error
+	}{
+		{text: "/start", want: "start []"},
+		{text: "  /START  ", want: "start []"},
+		{text: "/start@NeoBot", want: "start []"},
+		{text: "/search@neobot dune", want: "search [dune]"},
+		{text: "/start payload", wantErr: ErrUsage},
+		{text: "/start@OtherBot", wantErr: ErrUnknown},
+		{text: "/search  the   office ", want: "search [the office]"},
+		{text: "/search", wantErr: ErrUsage},
+		{text: "/del 326", want: "del [326]"},
+		{text: "/del 326 2", want: "del [326 2]"},
+		{text: "/del 326 2 5", wantErr: ErrUsage},
+		{text: "/nope", wantErr: ErrUnknown},
+		{text: "start", wantErr: ErrUnknown},
+		{text: "/", wantErr: ErrUnknown},
+	}
+	r := testRegistry()
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			c, args, err := r.Lookup(tt.text, "@NeoBot")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if got := fmt.Sprint(c.Name, " ", args.Fields); got != tt.want {
+				t.Errorf("Lookup = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupAnyBot(t *testing.T) {
+	c, _, err := testRegistry().Lookup("/start@OtherBot", "")
+	if err != nil || c.Name != "start" {
+		t.Fatalf("Lookup = %v, %v", c, err)
+	}
+}
+
+func TestLookupAdminOnly(t *testing.T) {
+	// Lookup resolves admin commands for everyone; the dispatcher checks
+	// AdminOnly against the caller.
+	c, _, err := testRegistry().Lookup("/debug", "")
+	if err != nil || !c.AdminOnly {
+		t.Fatalf("Lookup = %+v, %v", c, err)
+	}
+}
+
+func TestHelpText(t *testing.T) {
+	r := testRegistry()
+	if got, want := r.HelpText(false), "/start\n/search <query...>"; got != want {
+		t.Errorf("user help = %q, want %q", got, want)
+	}
+	want := "/start\n/search <query...>\n/del <kp_id> [season]   (admin)\nreply /del to a post\n/debug"
+	if got := r.HelpText(true); got != want {
+		t.Errorf("admin help = %q, want %q", got, want)
+	}
+}
+
+func TestMenu(t *testing.T) {
+	r := testRegistry()
+	if got, want := fmt.Sprint(r.Menu(false)), "[{search Find a title} {start Main menu}]"; got != want {
+		t.Errorf("user menu = %s, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(r.Menu(true)), "[{del Delete a title} {search Find a title} {start Main menu}]"; got != want {
+		t.Errorf("admin menu = %s, want %s", got, want)
+	}
+}
+
+func TestUsageText(t *testing.T) {
+	c, _, _ := testRegistry().Lookup("/del 1", "")
+	if got, want := c.UsageText(), "Usage: /del <kp_id> [season] OR reply /del to a post"; got != want {
+		t.Errorf("UsageText = %q, want %q", got, want)
+	}
+}
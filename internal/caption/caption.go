@@ -0,0 +1,223 @@
+// Package caption extracts season, episode, voice and quality from the
+// captions of storage channel posts.
+package caption
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Result is what a parser found in a caption. EpisodeEnd is set for ranges
+// such as "серии 1-2"; it is 0 for a single episode.
+type Result struct {
+	Season     int
+	Episode    int
+	EpisodeEnd int
+	Voice      string
+	Quality    string
+	// Parser names the parser that matched.
+	Parser string
+}
+
+// OK reports whether a season and an episode were found.
+func (r Result) OK() bool { return r.Season > 0 && r.Episode > 0 }
+
+// Episodes lists the episode numbers covered by r.
+func (r Result) Episodes() []int {
+	if !r.OK() {
+		return nil
+	}
+	if r.EpisodeEnd <= r.Episode {
+		return []int{r.Episode}
+	}
+	out := make([]int, 0, r.EpisodeEnd-r.Episode+1)
+	for ep := r.Episode; ep <= r.EpisodeEnd; ep++ {
+		out = append(out, ep)
+	}
+	return out
+}
+
+// Parser finds the season and episode in a caption. Voice and quality are
+// optional; Chain fills them in from brackets when a parser leaves them
+// empty.
+type Parser interface {
+	Name() string
+	Parse(caption string) (Result, bool)
+}
+
+// Chain tries its parsers in order and returns the first match.
+type Chain []Parser
+
+// Parse returns the first parser's result with a season and an episode. If
+// nothing matches, the result still carries the voice and quality found in
+// brackets.
+func (c Chain) Parse(caption string) Result {
+	caption = strings.TrimSpace(caption)
+	var res Result
+	for _, p := range c {
+		if r, ok := p.Parse(caption); ok && r.OK() {
+			res = r
+			res.Parser = p.Name()
+			break
+		}
+	}
+	if res.EpisodeEnd > 0 && (res.EpisodeEnd <= res.Episode || res.EpisodeEnd-res.Episode >= maxRange) {
+		res.EpisodeEnd = 0
+	}
+	voice, quality := Extras(caption)
+	if res.Voice == "" {
+		res.Voice = voice
+	}
+	if res.Quality == "" {
+		res.Quality = quality
+	}
+	return res
+}
+
+// maxRange caps how many episodes one post may cover.
+const maxRange = 30
+
+// Builtin returns the default parsers, most specific first.
+func Builtin() Chain {
+	return Chain{
+		regexParser{name: "SxxEyy", re: regexp.MustCompile(`(?i)\bS(\d{1,2})\s*E(\d{1,3})(?:\s*-\s*E?(\d{1,3}))?\b`)},
+		regexParser{name: "NxNN", re: regexp.MustCompile(`\b(\d{1,2})[xх](\d{1,3})(?:\s*-\s*(\d{1,3}))?\b`)},
+		regexParser{name: "season/episode", re: regexp.MustCompile(`(?i)\bseason\s*(\d{1,2})\W+episodes?\s*(\d{1,3})(?:\s*-\s*(\d{1,3}))?`)},
+		regexParser{name: "сезон/серия", re: regexp.MustCompile(`(?i)сезон\s*(\d{1,2})\D*?сери[яи]\s*(\d{1,3})(?:\s*-\s*(\d{1,3}))?`)},
+		regexParser{name: "N сезон/N серия", re: regexp.MustCompile(`(?i)(\d{1,2})\s*сезон\D*?(\d{1,3})(?:\s*-\s*(\d{1,3}))?\s*сери[яи]`)},
+	}
+}
+
+// regexParser reads season, episode and an optional range end from the
+// first three groups of re.
+type regexParser struct {
+	name string
+	re   *regexp.Regexp
+}
+
+func (p regexParser) Name() string { return p.name }
+
+func (p regexParser) Parse(caption string) (Result, bool) {
+	m := p.re.FindStringSubmatch(caption)
+	if m == nil {
+		return Result{}, false
+	}
+	var r Result
+	r.Season, _ = strconv.Atoi(m[1])
+	r.Episode, _ = strconv.Atoi(m[2])
+	if len(m) > 3 && m[3] != "" {
+		r.EpisodeEnd, _ = strconv.Atoi(m[3])
+	}
+	return r, true
+}
+
+var (
+	bracketsRe = regexp.MustCompile(`[(\[]([^)\]]+)[)\]]`)
+	qualityRe  = regexp.MustCompile(`(?i)^(?:\d{3,4}[pi]|\d{3,4}x\d{3,4}|[248]k|uhd|fhd|hd)$`)
+	anyQualRe  = regexp.MustCompile(`(?i)\b(\d{3,4}p|[248]k)\b`)
+)
+
+// Extras finds voice and quality in "(LostFilm, 1080p)" or "[1080p]"
+// groups. Without a bracketed quality, a bare "720p" anywhere is used.
+func Extras(caption string) (voice string, quality string) {
+	for _, m := range bracketsRe.FindAllStringSubmatch(caption, -1) {
+		for _, part := range strings.Split(m[1], ",") {
+			part = strings.TrimSpace(part)
+			switch {
+			case part == "":
+			case qualityRe.MatchString(part) || anyQualRe.MatchString(part):
+				if quality == "" {
+					quality = part
+				}
+			case voice == "" && !isRangeOrNumber(part):
+				voice = part
+			}
+		}
+	}
+	if quality == "" {
+		if m := anyQualRe.FindStringSubmatch(caption); len(m) == 2 {
+			quality = m[1]
+		}
+	}
+	return voice, quality
+}
+
+// QualityFromFrame guesses the quality label from the video frame. Widescreen
+// releases are letterboxed (1920x800 is still 1080p), so the width counts
+// as well.
+func QualityFromFrame(width int, height int) string {
+	h := height
+	if w := width * 9 / 16; w > h {
+		h = w
+	}
+	switch {
+	case h <= 0:
+		return ""
+	case h >= 2000:
+		return "2160p"
+	case h >= 1300:
+		return "1440p"
+	case h >= 1000:
+		return "1080p"
+	case h >= 700:
+		return "720p"
+	case h >= 560:
+		return "576p"
+	case h >= 460:
+		return "480p"
+	default:
+		return fmt.Sprintf("%dp", h)
+	}
+}
+
+func isRangeOrNumber(s string) bool {
+	return strings.Trim(s, "0123456789- ") == ""
+}
+
+// ErrTemplate is returned for templates that don't compile or lack the
+// required groups.
+var ErrTemplate = errors.New("invalid caption template")
+
+// Template is an admin-defined regular expression with named groups
+// season and episode, and optionally episode_end, voice and quality.
+type Template struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// NewTemplate compiles pattern and checks its groups.
+func NewTemplate(pattern string) (*Template, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTemplate, err)
+	}
+	if re.SubexpIndex("season") < 0 || re.SubexpIndex("episode") < 0 {
+		return nil, fmt.Errorf("%w: need (?P<season>...) and (?P<episode>...) groups", ErrTemplate)
+	}
+	return &Template{pattern: pattern, re: re}, nil
+}
+
+func (t *Template) Name() string { return "template " + t.pattern }
+
+func (t *Template) Parse(caption string) (Result, bool) {
+	m := t.re.FindStringSubmatch(caption)
+	if m == nil {
+		return Result{}, false
+	}
+	group := func(name string) string {
+		if i := t.re.SubexpIndex(name); i >= 0 {
+			return strings.TrimSpace(m[i])
+		}
+		return ""
+	}
+	var r Result
+	r.Season, _ = strconv.Atoi(group("season"))
+	r.Episode, _ = strconv.Atoi(group("episode"))
+	r.EpisodeEnd, _ = strconv.Atoi(group("episode_end"))
+	r.Voice = group("voice")
+	r.Quality = group("quality")
+	return r, true
+}
@@ -0,0 +1,165 @@
+package caption
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBuiltin(t *testing.T) {
+	tests := []struct {
+		caption string
+		want    string // season:episode-end voice/quality parser
+	}{
+		{"Теория большого взрыва S01E02", "1:2-0 / SxxEyy"},
+		{"s1e5 (LostFilm, 1080p)", "1:5-0 LostFilm/1080p SxxEyy"},
+		{"S02 E10", "2:10-0 / SxxEyy"},
+		{"S01E01-E03 [HDRezka]", "1:1-3 HDRezka/ SxxEyy"},
+		{"S01E01-03", "1:1-3 / SxxEyy"},
+		{"1x05", "1:5-0 / NxNN"},
+		{"2х07 (Кубик в Кубе)", "2:7-0 Кубик в Кубе/ NxNN"},
+		{"3x01-02 720p", "3:1-2 /720p NxNN"},
+		{"Season 2 Episode 4", "2:4-0 / season/episode"},
+		{"season 1, episodes 3-4 (4K)", "1:3-4 /4K season/episode"},
+		{"Сезон 1, серия 3", "1:3-0 / сезон/серия"},
+		{"сезон 2 серии 5-6 (NewStudio)", "2:5-6 NewStudio/ сезон/серия"},
+		{"1 сезон 8 серия", "1:8-0 / N сезон/N серия"},
+		{"3 сезон, 1-4 серии [1080p]", "3:1-4 /1080p N сезон/N серия"},
+		{"the more specific form wins: S01E02 1x05", "1:2-0 / SxxEyy"},
+
+		// ranges that run backwards or are too long are a single episode
+		{"1x05-03", "1:5-0 / NxNN"},
+		{"S01E01-E99", "1:1-0 / SxxEyy"},
+
+		// years and resolutions are not episodes
+		{"S01E01-1080p", "1:1-0 /1080p SxxEyy"},
+		{"Дюна (2021) 1080p", "0:0-0 /1080p "},
+		{"Фильм 1920x1080", "0:0-0 / "},
+		{"S2023E01", "0:0-0 / "},
+		{"S01E1080p", "0:0-0 / "},
+		{"Season 2 (2019) Episode 3", "0:0-0 / "},
+		{"Трейлер (2024, 720p)", "0:0-0 /720p "},
+		{"[1-2]", "0:0-0 / "},
+		{"", "0:0-0 / "},
+	}
+	chain := Builtin()
+	for _, tt := range tests {
+		t.Run(tt.caption, func(t *testing.T) {
+			r := chain.Parse(tt.caption)
+			got := fmt.Sprintf("%d:%d-%d %s/%s %s", r.Season, r.Episode, r.EpisodeEnd, r.Voice, r.Quality, r.Parser)
+			if got != tt.want {
+				t.Errorf("Parse = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEpisodes(t *testing.T) {
+	tests := []struct {
+		r    Result
+		want string
+	}{
+		{Result{Season: 1, Episode: 3}, "[3]"},
+		{Result{Season: 1, Episode: 3, EpisodeEnd: 5}, "[3 4 5]"},
+		{Result{Season: 1, Episode: 3, EpisodeEnd: 2}, "[3]"},
+		{Result{Episode: 3}, "[]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(tt.r.Episodes()); got != tt.want {
+			t.Errorf("%+v.Episodes() = %s, want %s", tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestNewTemplate(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr bool
+	}{
+		{`(?P<season>\d+)\.(?P<episode>\d+)`, false},
+		{`(?P<episode>\d+)/(?P<season>\d+) (?P<voice>\w+)`, false},
+		{`(?P<season>\d+`, true},
+		{`(?P<season>\d+)x(\d+)`, true},
+		{`(\d+)x(?P<episode>\d+)`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			_, err := NewTemplate(tt.pattern)
+			if got := errors.Is(err, ErrTemplate); got != tt.wantErr {
+				t.Errorf("err = %v, want ErrTemplate: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	tests := []struct {
+		pattern string
+		caption string
+		want    string // season:episode-end voice/quality parser
+	}{
+		{
+			pattern: `Серия (?P<episode>\d+) сезона (?P<season>\d+)`,
+			caption: "Серия 4 сезона 2 (LostFilm)",
+			want:    "2:4-0 LostFilm/ template",
+		},
+		{
+			pattern: `^(?P<season>\d+)\.(?P<episode>\d+)(?:-(?P<episode_end>\d+))? (?P<voice>[^|]+)\|(?P<quality>\S+)`,
+			caption: "1.2-3  Кубик в Кубе |720p",
+			want:    "1:2-3 Кубик в Кубе/720p template",
+		},
+		{
+			pattern: `ep(?P<episode>\d+) s(?P<season>\d+)`,
+			caption: "S01E02 no template match",
+			want:    "1:2-0 / SxxEyy",
+		},
+		{
+			pattern: `(?P<season>\d*)x(?P<episode>\d+)`,
+			caption: "x5 without a season falls through",
+			want:    "0:0-0 / ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.caption, func(t *testing.T) {
+			tpl, err := NewTemplate(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chain := append(Chain{tpl}, Builtin()...)
+			r := chain.Parse(tt.caption)
+			parser := r.Parser
+			if parser == tpl.Name() {
+				parser = "template"
+			}
+			got := fmt.Sprintf("%d:%d-%d %s/%s %s", r.Season, r.Episode, r.EpisodeEnd, r.Voice, r.Quality, parser)
+			if got != tt.want {
+				t.Errorf("Parse = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQualityFromFrame(t *testing.T) {
+	tests := []struct {
+		width, height int
+		want          string
+	}{
+		{3840, 2160, "2160p"},
+		{3840, 1600, "2160p"},
+		{2560, 1440, "1440p"},
+		{1920, 1080, "1080p"},
+		{1920, 800, "1080p"},
+		{1440, 1080, "1080p"},
+		{1280, 720, "720p"},
+		{1280, 536, "720p"},
+		{720, 576, "576p"},
+		{854, 480, "480p"},
+		{640, 360, "360p"},
+		{0, 0, ""},
+	}
+	for _, tt := range tests {
+		if got := QualityFromFrame(tt.width, tt.height); got != tt.want {
+			t.Errorf("QualityFromFrame(%d, %d) = %q, want %q", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+// Package cbdata encodes and decodes inline keyboard callback payloads.
+//
+// Payloads look like "v2:s:326:1:3": a version, a short action code and
+// colon-separated fields. Telegram limits callback_data to 64 bytes, which
+// Encode enforces. Unversioned payloads from keyboards sent before the
+// codec existed are still decoded; other versions return ErrStale. v1
+// carried positional voice indexes, v2 carries stable voice IDs.
+package cbdata
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const (
+	Version = "v2"
+	// MaxLen is Telegram's callback_data limit in bytes.
+	MaxLen = 64
+	// NoVoice marks "no voice selected" in VoiceID fields.
+	NoVoice = -1
+)
+
+var (
+	ErrTooLong   = errors.New("callback data exceeds 64 bytes")
+	ErrMalformed = errors.New("malformed callback data")
+	ErrStale     = errors.New("callback data from an unsupported version")
+)
+
+// Action is one decoded callback payload.
+type Action interface {
+	code() string
+	fields() []string
+}
+
+type Close struct{}
+
+type Menu struct {
+	Section string // "new", "movies" or "series"
+}
+
+type Watch struct {
+	KPID int
+}
+
+type Season struct {
+	KPID    int
+	Season  int
+	VoiceID int
+}
+
+type SeasonPage struct {
+	KPID    int
+	Season  int
+	Page    int
+	VoiceID int
+}
+
+type SeriesVoice struct {
+	KPID    int
+	VoiceID int
+}
+
+type SeriesVoices struct {
+	KPID int
+}
+
+type Episode struct {
+	KPID    int
+	Season  int
+	Episode int
+	VoiceID int
+}
+
+type EpisodeNav struct {
+	KPID    int
+	Season  int
+	Episode int
+	Dir     int
+	VoiceID int
+}
+
+type Subscribe struct {
+	KPID int
+}
+
+type Unsubscribe struct {
+	KPID int
+}
+
+type Favorite struct {
+	KPID int
+}
+
+type Unfavorite struct {
+	KPID int
+}
+
+// Card sends the movie card of KPID.
+type Card struct {
+	KPID int
+}
+
+type FavoritesPage struct {
+	Page int
+}
+
+// Request votes for adding KPID to the library.
+type Request struct {
+	KPID int
+}
+
+// RequestDone marks the request for KPID as fulfilled (admin only).
+type RequestDone struct {
+	KPID int
+}
+
+type EpisodeVariant struct {
+	KPID    int
+	Season  int
+	Episode int
+	Variant int
+}
+
+func (Close) code() string          { return "c" }
+func (Menu) code() string           { return "m" }
+func (Watch) code() string          { return "w" }
+func (Season) code() string         { return "s" }
+func (SeasonPage) code() string     { return "sp" }
+func (SeriesVoice) code() string    { return "sv" }
+func (SeriesVoices) code() string   { return "svs" }
+func (Episode) code() string        { return "e" }
+func (EpisodeNav) code() string     { return "en" }
+func (EpisodeVariant) code() string { return "ev" }
+func (Subscribe) code() string      { return "sub" }
+func (Unsubscribe) code() string    { return "unsub" }
+func (Favorite) code() string       { return "fav" }
+func (Unfavorite) code() string     { return "unfav" }
+func (Card) code() string           { return "card" }
+func (FavoritesPage) code() string  { return "fp" }
+func (Request) code() string        { return "req" }
+func (RequestDone) code() string    { return "reqd" }
+
+func (Close) fields() []string           { return nil }
+func (a Menu) fields() []string          { return []string{a.Section} }
+func (a Watch) fields() []string         { return ints(a.KPID) }
+func (a Season) fields() []string        { return ints(a.KPID, a.Season, a.VoiceID) }
+func (a SeasonPage) fields() []string    { return ints(a.KPID, a.Season, a.Page, a.VoiceID) }
+func (a SeriesVoice) fields() []string   { return ints(a.KPID, a.VoiceID) }
+func (a SeriesVoices) fields() []string  { return ints(a.KPID) }
+func (a Episode) fields() []string       { return ints(a.KPID, a.Season, a.Episode, a.VoiceID) }
+func (a EpisodeNav) fields() []string    { return ints(a.KPID, a.Season, a.Episode, a.Dir, a.VoiceID) }
+func (a Subscribe) fields() []string     { return ints(a.KPID) }
+func (a Unsubscribe) fields() []string   { return ints(a.KPID) }
+func (a Favorite) fields() []string      { return ints(a.KPID) }
+func (a Unfavorite) fields() []string    { return ints(a.KPID) }
+func (a Card) fields() []string          { return ints(a.KPID) }
+func (a FavoritesPage) fields() []string { return ints(a.Page) }
+func (a Request) fields() []string       { return ints(a.KPID) }
+func (a RequestDone) fields() []string   { return ints(a.KPID) }
+func (a EpisodeVariant) fields() []string {
+	return ints(a.KPID, a.Season, a.Episode, a.Variant)
+}
+
+func ints(vals ...int) []string {
+	out := make([]string, len(vals))
+	for i, v := range vals {
+		out[i] = strconv.Itoa(v)
+	}
+	return out
+}
+
+// Encode renders a as callback_data.
+func Encode(a Action) (string, error) {
+	parts := append([]string{Version, a.code()}, a.fields()...)
+	s := strings.Join(parts, ":")
+	if len(s) > MaxLen {
+		return "", fmt.Errorf("%w: %q", ErrTooLong, s)
+	}
+	return s, nil
+}
+
+// Inert is what Data puts on a button whose payload can't be encoded. It
+// decodes to ErrMalformed, so the button does nothing instead of something
+// else.
+const Inert = Version + ":-"
+
+// Data is Encode for keyboard builders. A payload over the budget is a bug
+// in the caller; it is logged and the button gets Inert so the keyboard
+// can still be sent.
+func Data(a Action) string {
+	s, err := Encode(a)
+	if err != nil {
+		log.Printf("cbdata: BUG: %T %+v can't be encoded: %v", a, a, err)
+		return Inert
+	}
+	return s
+}
+
+// Decode parses callback_data produced by Encode or by the legacy
+// fmt.Sprintf-based keyboards.
+func Decode(data string) (Action, error) {
+	data = strings.TrimSpace(data)
+	if len(data) > MaxLen {
+		return nil, ErrTooLong
+	}
+	parts := strings.Split(data, ":")
+	if len(parts) > 0 && len(parts[0]) > 1 && parts[0][0] == 'v' {
+		if _, err := strconv.Atoi(parts[0][1:]); err == nil {
+			if parts[0] != Version {
+				return nil, ErrStale
+			}
+			if len(parts) < 2 {
+				return nil, ErrMalformed
+			}
+			return decodeCurrent(parts[1], parts[2:])
+		}
+	}
+	return decodeLegacy(parts)
+}
+
+func decodeCurrent(code string, f []string) (Action, error) {
+	var a Action
+	var err error
+	switch code {
+	case "c":
+		if len(f) != 0 {
+			return nil, ErrMalformed
+		}
+		a = Close{}
+	case "m":
+		if len(f) != 1 {
+			return nil, ErrMalformed
+		}
+		a = Menu{Section: f[0]}
+	case "w":
+		var n []int
+		if n, err = atois(f, 1); err == nil {
+			a = Watch{KPID: n[0]}
+		}
+	case "s":
+		var n []int
+		if n, err = atois(f, 3); err == nil {
+			a = Season{KPID: n[0], Season: n[1], VoiceID: n[2]}
+		}
+	case "sp":
+		var n []int
+		if n, err = atois(f, 4); err == nil {
+			a = SeasonPage{KPID: n[0], Season: n[1], Page: n[2], VoiceID: n[3]}
+		}
+	case "sv":
+		var n []int
+		if n, err = atois(f, 2); err == nil {
+			a = SeriesVoice{KPID: n[0], VoiceID: n[1]}
+		}
+	case "svs":
+		var n []int
+		if n, err = atois(f, 1); err == nil {
+			a = SeriesVoices{KPID: n[0]}
+		}
+	case "e":
+		var n []int
+		if n, err = atois(f, 4); err == nil {
+			a = Episode{KPID: n[0], Season: n[1], Episode: n[2], VoiceID: n[3]}
+		}
+	case "en":
+		var n []int
+		if n, err = atois(f, 5); err == nil {
+			a = EpisodeNav{KPID: n[0], Season: n[1], Episode: n[2], Dir: n[3], VoiceID: n[4]}
+		}
+	case "ev":
+		var n []int
+		if n, err = atois(f, 4); err == nil {
+			a = EpisodeVariant{KPID: n[0], Season: n[1], Episode: n[2], Variant: n[3]}
+		}
+	case "sub":
+		var n []int
+		if n, err = atois(f, 1); err == nil {
+			a = Subscribe{KPID: n[0]}
+		}
+	case "unsub":
+		var n []int
+		if n, err = atois(f, 1); err == nil {
+			a = Unsubscribe{KPID: n[0]}
+		}
+	case "fav":
+		var n []int
+		if n, err = atois(f, 1); err == nil {
+			a = Favorite{KPID: n[0]}
+		}
+	case "unfav":
+		var n []int
+		if n, err = atois(f, 1); err == nil {
+			a = Unfavorite{KPID: n[0]}
+		}
+	case "card":
+		var n []int
+		if n, err = atois(f, 1); err == nil {
+			a = Card{KPID: n[0]}
+		}
+	case "fp":
+		var n []int
+		if n, err = atois(f, 1); err == nil {
+			a = FavoritesPage{Page: n[0]}
+		}
+	case "req":
+		var n []int
+		if n, err = atois(f, 1); err == nil {
+			a = Request{KPID: n[0]}
+		}
+	case "reqd":
+		var n []int
+		if n, err = atois(f, 1); err == nil {
+			a = RequestDone{KPID: n[0]}
+		}
+	default:
+		return nil, ErrMalformed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := validate(a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// decodeLegacy understands the pre-codec formats, e.g. "season:326:1:0" or
+// "ep:326:1:5:select", so buttons in old messages keep working.
+func decodeLegacy(parts []string) (Action, error) {
+	if len(parts) == 0 {
+		return nil, ErrMalformed
+	}
+	f := parts[1:]
+	// Legacy voice fields are positions in a list that shifts whenever a
+	// new voice is added, so they are checked for syntax and dropped.
+	voice := func(i int) error {
+		if i >= len(f) || f[i] == "" || f[i] == "select" {
+			return nil
+		}
+		_, err := strconv.Atoi(f[i])
+		return err
+	}
+	var a Action
+	var err error
+	var n []int
+	switch parts[0] {
+	case "close":
+		if len(f) != 0 {
+			return nil, ErrMalformed
+		}
+		a = Close{}
+	case "menu":
+		if len(f) != 1 {
+			return nil, ErrMalformed
+		}
+		a = Menu{Section: f[0]}
+	case "watch":
+		if n, err = atois(f, 1); err == nil {
+			a = Watch{KPID: n[0]}
+		}
+	case "season":
+		if len(f) != 2 && len(f) != 3 {
+			return nil, ErrMalformed
+		}
+		if n, err = atois(f[:2], 2); err == nil {
+			if err = voice(2); err == nil {
+				a = Season{KPID: n[0], Season: n[1], VoiceID: NoVoice}
+			}
+		}
+	case "seasonpage":
+		if len(f) != 3 && len(f) != 4 {
+			return nil, ErrMalformed
+		}
+		if n, err = atois(f[:3], 3); err == nil {
+			if err = voice(3); err == nil {
+				a = SeasonPage{KPID: n[0], Season: n[1], Page: n[2], VoiceID: NoVoice}
+			}
+		}
+	case "seriesvoice":
+		if n, err = atois(f, 2); err == nil {
+			a = SeriesVoice{KPID: n[0], VoiceID: NoVoice}
+		}
+	case "seriesvoices":
+		if n, err = atois(f, 1); err == nil {
+			a = SeriesVoices{KPID: n[0]}
+		}
+	case "ep":
+		if len(f) != 3 && len(f) != 4 {
+			return nil, ErrMalformed
+		}
+		if n, err = atois(f[:3], 3); err == nil {
+			if err = voice(3); err == nil {
+				a = Episode{KPID: n[0], Season: n[1], Episode: n[2], VoiceID: NoVoice}
+			}
+		}
+	case "epnav":
+		if len(f) != 4 && len(f) != 5 {
+			return nil, ErrMalformed
+		}
+		if n, err = atois(f[:4], 4); err == nil {
+			if err = voice(4); err == nil {
+				a = EpisodeNav{KPID: n[0], Season: n[1], Episode: n[2], Dir: n[3], VoiceID: NoVoice}
+			}
+		}
+	case "epv":
+		if n, err = atois(f, 4); err == nil {
+			a = EpisodeVariant{KPID: n[0], Season: n[1], Episode: n[2], Variant: n[3]}
+		}
+	default:
+		return nil, ErrMalformed
+	}
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if err := validate(a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func atois(f []string, want int) ([]int, error) {
+	if len(f) != want {
+		return nil, ErrMalformed
+	}
+	out := make([]int, want)
+	for i, s := range f {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		out[i] = n
+	}
+	return out, nil
+}
+
+func validate(a Action) error {
+	ok := true
+	switch a := a.(type) {
+	case Menu:
+		ok = a.Section == "new" || a.Section == "movies" || a.Section == "series"
+	case Watch:
+		ok = a.KPID > 0
+	case Season:
+		ok = a.KPID > 0 && a.Season > 0 && voiceOK(a.VoiceID)
+	case SeasonPage:
+		ok = a.KPID > 0 && a.Season > 0 && a.Page > 0 && voiceOK(a.VoiceID)
+	case SeriesVoice:
+		ok = a.KPID > 0 && voiceOK(a.VoiceID)
+	case SeriesVoices:
+		ok = a.KPID > 0
+	case Episode:
+		ok = a.KPID > 0 && a.Season > 0 && a.Episode > 0 && voiceOK(a.VoiceID)
+	case EpisodeNav:
+		ok = a.KPID > 0 && a.Season > 0 && a.Episode > 0 && (a.Dir == -1 || a.Dir == 1) && voiceOK(a.VoiceID)
+	case EpisodeVariant:
+		ok = a.KPID > 0 && a.Season > 0 && a.Episode > 0 && a.Variant >= 0
+	case Subscribe:
+		ok = a.KPID > 0
+	case Unsubscribe:
+		ok = a.KPID > 0
+	case Favorite:
+		ok = a.KPID > 0
+	case Unfavorite:
+		ok = a.KPID > 0
+	case Card:
+		ok = a.KPID > 0
+	case FavoritesPage:
+		ok = a.Page > 0
+	case Request:
+		ok = a.KPID > 0
+	case RequestDone:
+		ok = a.KPID > 0
+	}
+	if !ok {
+		return ErrMalformed
+	}
+	return nil
+}
+
+// voiceOK accepts NoVoice or a voice ID; IDs start at 1.
+func voiceOK(id int) bool {
+	return id == NoVoice || id > 0
+}
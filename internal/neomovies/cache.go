@@ -0,0 +1,257 @@
+package neomovies
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// API is the part of the neomovies API the bot uses. Client talks to the
+// upstream directly, Cached puts a cache in front of it.
+type API interface {
+	GetPopular(ctx context.Context, page int) (*SearchResponse, error)
+	SearchMovies(ctx context.Context, query string, page int) (*SearchResponse, error)
+	GetMovieByKPID(ctx context.Context, kpID int) (*Movie, error)
+	GetTorrentsByIMDB(ctx context.Context, imdbID string, typ string) ([]TorrentResult, error)
+	ImageURL(path string, kpType string, kpID int) string
+	PlayerRedirectURL(provider string, idType string, id int) string
+}
+
+var (
+	_ API = (*Client)(nil)
+	_ API = (*Cached)(nil)
+)
+
+// CacheStore persists cached responses so cold instances start warm.
+// Expired entries must not be returned.
+type CacheStore interface {
+	GetCachedResponse(ctx context.Context, key string) ([]byte, bool, error)
+	PutCachedResponse(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// CacheTTLs sets how long each kind of lookup is cached. Missing is used for
+// titles the API doesn't know, so they aren't looked up on every request.
+type CacheTTLs struct {
+	Movie    time.Duration
+	Search   time.Duration
+	Popular  time.Duration
+	Torrents time.Duration
+	Missing  time.Duration
+}
+
+var DefaultCacheTTLs = CacheTTLs{
+	Movie:    24 * time.Hour,
+	Search:   time.Hour,
+	Popular:  30 * time.Minute,
+	Torrents: 6 * time.Hour,
+	Missing:  15 * time.Minute,
+}
+
+// maxMemEntries bounds the in-process layer; when it is full, expired
+// entries are dropped first and then everything.
+const maxMemEntries = 2000
+
+type memEntry struct {
+	value   any
+	missing bool
+	expires time.Time
+}
+
+// Cached is an API that answers from an in-process map, then from the
+// CacheStore, and only then from the upstream. Concurrent lookups of the
+// same key share one upstream request. Returned values are shared between
+// callers and must not be modified.
+type Cached struct {
+	*Client
+	store CacheStore
+	ttls  CacheTTLs
+
+	group singleflight.Group
+	mu    sync.Mutex
+	mem   map[string]memEntry
+}
+
+// NewCached wraps c. store may be nil to cache in process memory only.
+func NewCached(c *Client, store CacheStore, ttls CacheTTLs) *Cached {
+	return &Cached{Client: c, store: store, ttls: ttls, mem: map[string]memEntry{}}
+}
+
+func (c *Cached) GetPopular(ctx context.Context, page int) (*SearchResponse, error) {
+	key := fmt.Sprintf("popular:%d", page)
+	return cachedCall(ctx, c, key, c.ttls.Popular, func(ctx context.Context) (*SearchResponse, error) {
+		return c.Client.GetPopular(ctx, page)
+	})
+}
+
+func (c *Cached) SearchMovies(ctx context.Context, query string, page int) (*SearchResponse, error) {
+	key := fmt.Sprintf("search:%d:%s", page, strings.ToLower(strings.TrimSpace(query)))
+	return cachedCall(ctx, c, key, c.ttls.Search, func(ctx context.Context) (*SearchResponse, error) {
+		return c.Client.SearchMovies(ctx, query, page)
+	})
+}
+
+func (c *Cached) GetMovieByKPID(ctx context.Context, kpID int) (*Movie, error) {
+	if kpID <= 0 {
+		return nil, fmt.Errorf("invalid kp_id")
+	}
+	key := fmt.Sprintf("movie:kp:%d", kpID)
+	return cachedCall(ctx, c, key, c.ttls.Movie, func(ctx context.Context) (*Movie, error) {
+		return c.Client.GetMovieByKPID(ctx, kpID)
+	})
+}
+
+func (c *Cached) GetTorrentsByIMDB(ctx context.Context, imdbID string, typ string) ([]TorrentResult, error) {
+	key := fmt.Sprintf("torrents:%s:%s", typ, strings.TrimSpace(imdbID))
+	return cachedCall(ctx, c, key, c.ttls.Torrents, func(ctx context.Context) ([]TorrentResult, error) {
+		return c.Client.GetTorrentsByIMDB(ctx, imdbID, typ)
+	})
+}
+
+// isMissing reports errors that mean "the API has nothing for this key",
+// which are worth caching, as opposed to transient failures.
+func isMissing(err error) bool {
+	return IsNotFound(err) || errors.Is(err, ErrEmpty)
+}
+
+// cacheEntry is what goes into the CacheStore. Missing marks a key the API
+// has nothing for. Keeping it apart from Value means a real result that
+// marshals to null, such as no torrents, is not read back as missing.
+type cacheEntry struct {
+	Missing bool            `json:"missing,omitempty"`
+	Value   json.RawMessage `json:"value,omitempty"`
+}
+
+// sharedFetchTimeout bounds a fetch shared by concurrent callers. It runs
+// detached from the caller that started it, so that caller giving up
+// doesn't fail the others.
+const sharedFetchTimeout = 9 * time.Second
+
+func cachedCall[T any](ctx context.Context, c *Cached, key string, ttl time.Duration, load func(context.Context) (T, error)) (T, error) {
+	var zero T
+	if v, missing, ok := c.memGet(key); ok {
+		if missing {
+			return zero, fmt.Errorf("neomovies %s: %w", key, ErrEmpty)
+		}
+		return v.(T), nil
+	}
+	ch := c.group.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sharedFetchTimeout)
+		defer cancel()
+		if val, ok, err := c.storeGet(ctx, key, ttl, func(raw []byte) (any, error) {
+			var val T
+			err := json.Unmarshal(raw, &val)
+			return val, err
+		}); ok {
+			return val, err
+		}
+		val, err := load(ctx)
+		if err != nil {
+			if isMissing(err) {
+				c.memPut(key, nil, true, c.ttls.Missing)
+				c.persist(ctx, key, cacheEntry{Missing: true}, c.ttls.Missing)
+			}
+			return nil, err
+		}
+		c.memPut(key, val, false, ttl)
+		if raw, err := json.Marshal(val); err == nil {
+			c.persist(ctx, key, cacheEntry{Value: raw}, ttl)
+		}
+		return val, nil
+	})
+	select {
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return zero, res.Err
+		}
+		return res.Val.(T), nil
+	}
+}
+
+// storeGet reads key from the CacheStore into the in-process layer. ok is
+// false when the store has no usable entry and the upstream must be asked.
+func (c *Cached) storeGet(ctx context.Context, key string, ttl time.Duration, decode func([]byte) (any, error)) (any, bool, error) {
+	if c.store == nil {
+		return nil, false, nil
+	}
+	raw, ok, err := c.store.GetCachedResponse(ctx, key)
+	if err != nil {
+		log.Printf("neomovies cache read error: %v (key=%s)", err, key)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, false, nil
+	}
+	if e.Missing {
+		c.memPut(key, nil, true, c.ttls.Missing)
+		return nil, true, fmt.Errorf("neomovies %s: %w", key, ErrEmpty)
+	}
+	// entries written before cacheEntry have no value and are refetched
+	if len(e.Value) == 0 {
+		return nil, false, nil
+	}
+	val, err := decode(e.Value)
+	if err != nil {
+		return nil, false, nil
+	}
+	c.memPut(key, val, false, ttl)
+	return val, true, nil
+}
+
+func (c *Cached) persist(ctx context.Context, key string, e cacheEntry, ttl time.Duration) {
+	if c.store == nil || ttl <= 0 {
+		return
+	}
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if err := c.store.PutCachedResponse(ctx, key, raw, ttl); err != nil {
+		log.Printf("neomovies cache write error: %v (key=%s)", err, key)
+	}
+}
+
+func (c *Cached) memGet(key string) (any, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.mem[key]
+	if !ok {
+		return nil, false, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.mem, key)
+		return nil, false, false
+	}
+	return e.value, e.missing, true
+}
+
+func (c *Cached) memPut(key string, value any, missing bool, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.mem) >= maxMemEntries {
+		for k, e := range c.mem {
+			if now.After(e.expires) {
+				delete(c.mem, k)
+			}
+		}
+		if len(c.mem) >= maxMemEntries {
+			c.mem = map[string]memEntry{}
+		}
+	}
+	c.mem[key] = memEntry{value: value, missing: missing, expires: now.Add(ttl)}
+}
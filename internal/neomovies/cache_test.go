@@ -0,0 +1,233 @@
+package neomovies
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memStore is a CacheStore that honours TTLs, like the api_cache collection.
+type memStore struct {
+	mu      sync.Mutex
+	entries map[string]memStoreEntry
+}
+
+type memStoreEntry struct {
+	raw     []byte
+	expires time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{entries: map[string]memStoreEntry{}}
+}
+
+func (s *memStore) GetCachedResponse(ctx context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false, nil
+	}
+	return e.raw, true, nil
+}
+
+func (s *memStore) PutCachedResponse(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = memStoreEntry{raw: append([]byte(nil), value...), expires: time.Now().Add(ttl)}
+	return nil
+}
+
+// upstream serves body with status and counts the requests it gets.
+type upstream struct {
+	srv  *httptest.Server
+	hits atomic.Int32
+}
+
+func newUpstream(t *testing.T, status int, body string) *upstream {
+	t.Helper()
+	u := &upstream{}
+	u.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.hits.Add(1)
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(u.srv.Close)
+	return u
+}
+
+func TestCachedCall(t *testing.T) {
+	const movie = `{"data":{"title":"A","kinopoisk_id":1}}`
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		call      func(ctx context.Context, c *Cached) error
+		wantErr   error
+		wantHits  int32 // over three calls: two on one instance, one on a cold one
+		wantStore bool
+	}{
+		{
+			name: "movie", status: 200, body: movie,
+			call: func(ctx context.Context, c *Cached) error {
+				m, err := c.GetMovieByKPID(ctx, 1)
+				if err == nil && m.Title != "A" {
+					err = fmt.Errorf("title = %q", m.Title)
+				}
+				return err
+			},
+			wantHits: 1, wantStore: true,
+		},
+		{
+			name: "no torrents is cached as a result, not a miss", status: 200, body: `null`,
+			call: func(ctx context.Context, c *Cached) error {
+				trs, err := c.GetTorrentsByIMDB(ctx, "tt1", "movie")
+				if err == nil && len(trs) != 0 {
+					err = fmt.Errorf("got %d torrents", len(trs))
+				}
+				return err
+			},
+			wantHits: 1, wantStore: true,
+		},
+		{
+			name: "unknown title is cached as a miss", status: 404, body: `not found`,
+			call: func(ctx context.Context, c *Cached) error {
+				_, err := c.GetMovieByKPID(ctx, 2)
+				return err
+			},
+			wantErr: ErrEmpty, wantHits: 2, wantStore: true, // unified endpoint, then the fallback
+		},
+		{
+			name: "server errors are not cached", status: 500, body: `boom`,
+			call: func(ctx context.Context, c *Cached) error {
+				_, err := c.SearchMovies(ctx, "q", 1)
+				return err
+			},
+			wantHits: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			up := newUpstream(t, tt.status, tt.body)
+			store := newMemStore()
+			warm := NewCached(NewClient(up.srv.URL), store, DefaultCacheTTLs)
+			first := tt.call(ctx, warm)
+			if tt.status == 200 && first != nil {
+				t.Fatalf("first call: %v", first)
+			}
+			cold := NewCached(NewClient(up.srv.URL), store, DefaultCacheTTLs)
+			for i, c := range []*Cached{warm, cold} {
+				err := tt.call(ctx, c)
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("call %d: err = %v, want %v", i, err, tt.wantErr)
+				}
+				if tt.status == 200 && err != nil {
+					t.Errorf("call %d: %v", i, err)
+				}
+			}
+			if got := up.hits.Load(); got != tt.wantHits {
+				t.Errorf("upstream hits = %d, want %d", got, tt.wantHits)
+			}
+			if got := len(store.entries) > 0; got != tt.wantStore {
+				t.Errorf("stored = %v, want %v", got, tt.wantStore)
+			}
+		})
+	}
+}
+
+func TestCachedTTL(t *testing.T) {
+	ctx := context.Background()
+	up := newUpstream(t, 200, `{"page":1,"results":[{"title":"A"}],"total_pages":1}`)
+	ttls := DefaultCacheTTLs
+	ttls.Popular = 30 * time.Millisecond
+	c := NewCached(NewClient(up.srv.URL), newMemStore(), ttls)
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetPopular(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := up.hits.Load(); got != 1 {
+		t.Fatalf("hits before expiry = %d, want 1", got)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := c.GetPopular(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := up.hits.Load(); got != 2 {
+		t.Errorf("hits after expiry = %d, want 2", got)
+	}
+}
+
+func TestCachedLegacyNullEntryIsRefetched(t *testing.T) {
+	ctx := context.Background()
+	up := newUpstream(t, 200, `[{"title":"a"}]`)
+	store := newMemStore()
+	// misses used to be stored as a bare null
+	_ = store.PutCachedResponse(ctx, "torrents:movie:tt1", []byte("null"), time.Hour)
+	c := NewCached(NewClient(up.srv.URL), store, DefaultCacheTTLs)
+	trs, err := c.GetTorrentsByIMDB(ctx, "tt1", "movie")
+	if err != nil || len(trs) != 1 {
+		t.Fatalf("got %d torrents, %v", len(trs), err)
+	}
+	if got := up.hits.Load(); got != 1 {
+		t.Errorf("hits = %d, want 1", got)
+	}
+}
+
+func TestCachedSharedFetchOutlivesFirstCaller(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		started <- struct{}{}
+		<-release
+		fmt.Fprint(w, `{"data":{"title":"A","kinopoisk_id":1}}`)
+	}))
+	defer srv.Close()
+	defer close(release)
+	c := NewCached(NewClient(srv.URL), nil, DefaultCacheTTLs)
+
+	firstCtx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := c.GetMovieByKPID(firstCtx, 1)
+		firstErr <- err
+	}()
+	<-started
+	type result struct {
+		m   *Movie
+		err error
+	}
+	second := make(chan result, 1)
+	go func() {
+		m, err := c.GetMovieByKPID(context.Background(), 1)
+		second <- result{m, err}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-firstErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("first caller err = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("first caller did not return after its context was canceled")
+	}
+	release <- struct{}{}
+	res := <-second
+	if res.err != nil || res.m.Title != "A" {
+		t.Fatalf("second caller got %+v, %v", res.m, res.err)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hits = %d, want 1", got)
+	}
+}
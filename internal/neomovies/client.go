@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -27,39 +26,7 @@ func (c *Client) GetPopular(ctx context.Context, page int) (*SearchResponse, err
 	q.Set("page", strconv.Itoa(page))
 	q.Set("lang", "ru")
 	u.RawQuery = q.Encode()
-
-	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-	resp, err := c.hc.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		return nil, fmt.Errorf("neomovies popular status %d: %s", resp.StatusCode, string(body))
-	}
-
-	var wrapper struct {
-		Success bool           `json:"success"`
-		Data    SearchResponse `json:"data"`
-	}
-	dec := json.NewDecoder(resp.Body)
-	if err := dec.Decode(&wrapper); err == nil && (wrapper.Data.Results != nil || wrapper.Data.TotalPages != 0) {
-		return &wrapper.Data, nil
-	}
-
-	_ = resp.Body.Close()
-	req2, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-	resp2, err := c.hc.Do(req2)
-	if err != nil {
-		return nil, err
-	}
-	defer resp2.Body.Close()
-	var direct SearchResponse
-	if err := json.NewDecoder(resp2.Body).Decode(&direct); err != nil {
-		return nil, err
-	}
-	return &direct, nil
+	return fetchData(ctx, c, "popular", u.String(), isSearchEmpty)
 }
 
 func NewClient(apiBase string) *Client {
@@ -113,39 +80,11 @@ func (c *Client) SearchMovies(ctx context.Context, query string, page int) (*Sea
 	q.Set("page", strconv.Itoa(page))
 	q.Set("lang", "ru")
 	u.RawQuery = q.Encode()
+	return fetchData(ctx, c, "search", u.String(), isSearchEmpty)
+}
 
-	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-	resp, err := c.hc.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		return nil, fmt.Errorf("neomovies search status %d: %s", resp.StatusCode, string(body))
-	}
-
-	var wrapper struct {
-		Success bool           `json:"success"`
-		Data    SearchResponse `json:"data"`
-	}
-	dec := json.NewDecoder(resp.Body)
-	if err := dec.Decode(&wrapper); err == nil && (wrapper.Data.Results != nil || wrapper.Data.TotalPages != 0) {
-		return &wrapper.Data, nil
-	}
-
-	_ = resp.Body.Close()
-	req2, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-	resp2, err := c.hc.Do(req2)
-	if err != nil {
-		return nil, err
-	}
-	defer resp2.Body.Close()
-	var direct SearchResponse
-	if err := json.NewDecoder(resp2.Body).Decode(&direct); err != nil {
-		return nil, err
-	}
-	return &direct, nil
+func isSearchEmpty(r *SearchResponse) bool {
+	return r.Results == nil && r.TotalPages == 0
 }
 
 func (c *Client) GetMovieByKPID(ctx context.Context, kpID int) (*Movie, error) {
@@ -176,39 +115,7 @@ func (c *Client) GetMovieByKPID(ctx context.Context, kpID int) (*Movie, error) {
 
 func (c *Client) getMovieUnifiedKP(ctx context.Context, kpID int) (*Movie, error) {
 	u := fmt.Sprintf("%s/api/v1/movie/kp_%d", c.apiBase, kpID)
-	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
-	resp, err := c.hc.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		return nil, fmt.Errorf("neomovies getMovie status %d: %s", resp.StatusCode, string(body))
-	}
-
-	var wrapper struct {
-		Success bool  `json:"success"`
-		Data    Movie `json:"data"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&wrapper); err == nil {
-		if wrapper.Data.KinopoiskID != 0 || wrapper.Data.ExternalIDs.KP != 0 || !isMovieEmpty(&wrapper.Data) {
-			return &wrapper.Data, nil
-		}
-	}
-
-	_ = resp.Body.Close()
-	req2, _ := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
-	resp2, err := c.hc.Do(req2)
-	if err != nil {
-		return nil, err
-	}
-	defer resp2.Body.Close()
-	var direct Movie
-	if err := json.NewDecoder(resp2.Body).Decode(&direct); err != nil {
-		return nil, err
-	}
-	return &direct, nil
+	return fetchData(ctx, c, "getMovie", u, isMovieDataEmpty)
 }
 
 func (c *Client) getMovieByIDType(ctx context.Context, kpID int, idType string) (*Movie, error) {
@@ -219,40 +126,12 @@ func (c *Client) getMovieByIDType(ctx context.Context, kpID int, idType string)
 	}
 	q.Set("lang", "ru")
 	u.RawQuery = q.Encode()
+	return fetchData(ctx, c, "movies get", u.String(), isMovieDataEmpty)
+}
 
-	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-	resp, err := c.hc.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		return nil, fmt.Errorf("neomovies movies get status %d: %s", resp.StatusCode, string(body))
-	}
-
-	var wrapper struct {
-		Success bool  `json:"success"`
-		Data    Movie `json:"data"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&wrapper); err == nil {
-		if wrapper.Data.KinopoiskID != 0 || wrapper.Data.ExternalIDs.KP != 0 || !isMovieEmpty(&wrapper.Data) {
-			return &wrapper.Data, nil
-		}
-	}
-
-	_ = resp.Body.Close()
-	req2, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-	resp2, err := c.hc.Do(req2)
-	if err != nil {
-		return nil, err
-	}
-	defer resp2.Body.Close()
-	var direct Movie
-	if err := json.NewDecoder(resp2.Body).Decode(&direct); err != nil {
-		return nil, err
-	}
-	return &direct, nil
+// isMovieDataEmpty accepts a movie that has at least an id or a title.
+func isMovieDataEmpty(m *Movie) bool {
+	return m.KinopoiskID == 0 && m.ExternalIDs.KP == 0 && isMovieEmpty(m)
 }
 
 func isMovieEmpty(m *Movie) bool {
@@ -277,6 +156,8 @@ type TorrentResult struct {
 	Seasons []int    `json:"seasons"`
 }
 
+// GetTorrentsByIMDB returns the torrents found for imdbID. No torrents is
+// not an error.
 func (c *Client) GetTorrentsByIMDB(ctx context.Context, imdbID string, typ string) ([]TorrentResult, error) {
 	imdbID = strings.TrimSpace(imdbID)
 	if imdbID == "" {
@@ -286,40 +167,23 @@ func (c *Client) GetTorrentsByIMDB(ctx context.Context, imdbID string, typ strin
 		typ = "movie"
 	}
 	u := fmt.Sprintf("%s/api/v1/torrents/search/%s?type=%s", c.apiBase, url.PathEscape(imdbID), url.QueryEscape(typ))
-	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
-	resp, err := c.hc.Do(req)
+	body, err := c.get(ctx, "torrents", u)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		return nil, fmt.Errorf("neomovies torrents status %d: %s", resp.StatusCode, string(body))
-	}
-
 	var direct []TorrentResult
-	dec := json.NewDecoder(resp.Body)
-	if err := dec.Decode(&direct); err == nil {
+	if err := json.Unmarshal(body, &direct); err == nil {
 		return direct, nil
 	}
-
-	_ = resp.Body.Close()
-	req2, _ := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
-	resp2, err := c.hc.Do(req2)
+	page, err := decodeData("torrents", body, func(*torrentsPage) bool { return false })
 	if err != nil {
 		return nil, err
 	}
-	defer resp2.Body.Close()
-	var wrapper struct {
-		Success bool `json:"success"`
-		Data    struct {
-			Results []TorrentResult `json:"results"`
-		} `json:"data"`
-	}
-	if err := json.NewDecoder(resp2.Body).Decode(&wrapper); err != nil {
-		return nil, err
-	}
-	return wrapper.Data.Results, nil
+	return page.Results, nil
+}
+
+type torrentsPage struct {
+	Results []TorrentResult `json:"results"`
 }
 
 func UniqueVoices(torrents []TorrentResult) []string {
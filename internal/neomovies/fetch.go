@@ -0,0 +1,96 @@
+package neomovies
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrEmpty is returned when a response decodes but carries no data.
+var ErrEmpty = errors.New("empty payload")
+
+// StatusError is a non-2xx response.
+type StatusError struct {
+	Op         string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("neomovies %s status %d: %s", e.Op, e.StatusCode, e.Body)
+}
+
+// DecodeError is a response body that matches none of the known shapes.
+type DecodeError struct {
+	Op  string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("neomovies %s decode: %v", e.Op, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// IsNotFound reports whether err is a 404 from the API.
+func IsNotFound(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.StatusCode == http.StatusNotFound
+}
+
+// maxBodyBytes bounds how much of a response is read.
+const maxBodyBytes = 4 << 20
+
+// get performs one GET request and returns the body of a 2xx response.
+func (c *Client) get(ctx context.Context, op string, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &StatusError{Op: op, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+}
+
+// fetchData GETs u once and decodes the body either as the
+// {"success": ..., "data": T} envelope or as a bare T. empty tells a
+// decoded but useless value apart from a real one.
+func fetchData[T any](ctx context.Context, c *Client, op string, u string, empty func(*T) bool) (*T, error) {
+	body, err := c.get(ctx, op, u)
+	if err != nil {
+		return nil, err
+	}
+	return decodeData(op, body, empty)
+}
+
+func decodeData[T any](op string, body []byte, empty func(*T) bool) (*T, error) {
+	var wrapper struct {
+		Data *T `json:"data"`
+	}
+	wrapErr := json.Unmarshal(body, &wrapper)
+	if wrapErr == nil && wrapper.Data != nil && !empty(wrapper.Data) {
+		return wrapper.Data, nil
+	}
+	var direct T
+	if err := json.Unmarshal(body, &direct); err != nil {
+		if wrapErr == nil {
+			return nil, fmt.Errorf("neomovies %s: %w", op, ErrEmpty)
+		}
+		return nil, &DecodeError{Op: op, Err: err}
+	}
+	if empty(&direct) {
+		return nil, fmt.Errorf("neomovies %s: %w", op, ErrEmpty)
+	}
+	return &direct, nil
+}
@@ -0,0 +1,92 @@
+package neomovies
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// serve answers every request with status and body.
+func serve(t *testing.T, status int, body string) *Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return NewClient(srv.URL)
+}
+
+func TestSearchMoviesDecoding(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		wantTotal int
+		wantErr   func(error) bool
+	}{
+		{name: "envelope", status: 200, body: `{"success":true,"data":{"page":1,"results":[{"title":"A"}],"total_pages":1,"total_results":1}}`, wantTotal: 1},
+		{name: "bare", status: 200, body: `{"page":1,"results":[{"title":"A"},{"title":"B"}],"total_pages":1,"total_results":2}`, wantTotal: 2},
+		{name: "envelope without data", status: 200, body: `{"success":true,"data":null}`, wantErr: func(err error) bool { return errors.Is(err, ErrEmpty) }},
+		{name: "empty object", status: 200, body: `{}`, wantErr: func(err error) bool { return errors.Is(err, ErrEmpty) }},
+		{name: "not json", status: 200, body: `<html>`, wantErr: func(err error) bool {
+			var de *DecodeError
+			return errors.As(err, &de) && de.Op == "search"
+		}},
+		{name: "wrong shape", status: 200, body: `[1,2]`, wantErr: func(err error) bool {
+			var de *DecodeError
+			return errors.As(err, &de)
+		}},
+		{name: "not found", status: 404, body: `no such page`, wantErr: IsNotFound},
+		{name: "server error", status: 502, body: ` bad gateway `, wantErr: func(err error) bool {
+			var se *StatusError
+			return errors.As(err, &se) && se.StatusCode == 502 && se.Body == "bad gateway" && !IsNotFound(err)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := serve(t, tt.status, tt.body)
+			res, err := c.SearchMovies(context.Background(), "q", 1)
+			if tt.wantErr != nil {
+				if err == nil || !tt.wantErr(err) {
+					t.Fatalf("err = %v (%T)", err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.TotalResult != tt.wantTotal || len(res.Results) != tt.wantTotal {
+				t.Errorf("got %d results (total %d), want %d", len(res.Results), res.TotalResult, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestGetTorrentsByIMDB(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "bare list", body: `[{"title":"a","voice":["LostFilm"]},{"title":"b"}]`, want: 2},
+		{name: "envelope", body: `{"data":{"results":[{"title":"a"}]}}`, want: 1},
+		{name: "empty list", body: `[]`, want: 0},
+		{name: "null", body: `null`, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := serve(t, 200, tt.body)
+			got, err := c.GetTorrentsByIMDB(context.Background(), "tt1", "movie")
+			if err != nil {
+				t.Fatalf("no torrents must not be an error: %v", err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("got %d torrents, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// cachedResponse is a persisted upstream API response, see neomovies.Cached.
+type cachedResponse struct {
+	Key       string    `bson:"_id"`
+	Value     []byte    `bson:"value"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+func (m *Mongo) GetCachedResponse(ctx context.Context, key string) ([]byte, bool, error) {
+	if m == nil {
+		return nil, false, errors.New("mongo not configured")
+	}
+	var doc cachedResponse
+	// The TTL monitor only runs once a minute, so filter expired entries here too.
+	err := m.apiCache.FindOne(ctx, bson.M{"_id": key, "expires_at": bson.M{"$gt": time.Now()}}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return doc.Value, true, nil
+}
+
+func (m *Mongo) PutCachedResponse(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if m == nil {
+		return nil
+	}
+	_, err := m.apiCache.ReplaceOne(ctx,
+		bson.M{"_id": key},
+		cachedResponse{Key: key, Value: value, ExpiresAt: time.Now().Add(ttl)},
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (m *Memory) GetCachedResponse(ctx context.Context, key string) ([]byte, bool, error) {
+	if m == nil {
+		return nil, false, errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc, ok := m.apiCache[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if !time.Now().Before(doc.ExpiresAt) {
+		delete(m.apiCache, key)
+		return nil, false, nil
+	}
+	return append([]byte(nil), doc.Value...), true, nil
+}
+
+func (m *Memory) PutCachedResponse(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	m.apiCache[key] = cachedResponse{Key: key, Value: append([]byte(nil), value...), ExpiresAt: time.Now().Add(ttl)}
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AutoSession is an /autoaddepisodes session bound to an admin chat.
+type AutoSession struct {
+	ChatID        int64     `bson:"chat_id"`
+	KPID          int       `bson:"kp_id"`
+	StartedAt     time.Time `bson:"started_at"`
+	ExpiresAt     time.Time `bson:"expires_at"`
+	EpisodesAdded int       `bson:"episodes_added"`
+	LastSeason    int       `bson:"last_season,omitempty"`
+	LastEpisode   int       `bson:"last_episode,omitempty"`
+}
+
+func (m *Mongo) StartAutoSession(ctx context.Context, chatID int64, kpID int, ttl time.Duration) error {
+	if m == nil {
+		return errors.New("mongo not configured")
+	}
+	now := time.Now()
+	_, err := m.autoSessions.ReplaceOne(ctx,
+		bson.M{"chat_id": chatID},
+		AutoSession{ChatID: chatID, KPID: kpID, StartedAt: now, ExpiresAt: now.Add(ttl)},
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (m *Mongo) GetAutoSession(ctx context.Context, chatID int64) (*AutoSession, error) {
+	if m == nil {
+		return nil, errors.New("mongo not configured")
+	}
+	var s AutoSession
+	// The TTL monitor only runs once a minute, so filter expired sessions here too.
+	err := m.autoSessions.FindOne(ctx, bson.M{"chat_id": chatID, "expires_at": bson.M{"$gt": time.Now()}}).Decode(&s)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (m *Mongo) RecordAutoEpisode(ctx context.Context, chatID int64, seasonNum int, episodeNum int, ttl time.Duration) error {
+	if m == nil {
+		return nil
+	}
+	_, err := m.autoSessions.UpdateOne(ctx,
+		bson.M{"chat_id": chatID},
+		bson.M{
+			"$inc": bson.M{"episodes_added": 1},
+			"$set": bson.M{
+				"last_season":  seasonNum,
+				"last_episode": episodeNum,
+				"expires_at":   time.Now().Add(ttl),
+			},
+		},
+	)
+	return err
+}
+
+func (m *Mongo) StopAutoSession(ctx context.Context, chatID int64) error {
+	if m == nil {
+		return nil
+	}
+	_, err := m.autoSessions.DeleteOne(ctx, bson.M{"chat_id": chatID})
+	return err
+}
+
+func (m *Memory) StartAutoSession(ctx context.Context, chatID int64, kpID int, ttl time.Duration) error {
+	if m == nil {
+		return errors.New("memory store not configured")
+	}
+	now := time.Now()
+	m.mu.Lock()
+	m.autoSessions[chatID] = AutoSession{ChatID: chatID, KPID: kpID, StartedAt: now, ExpiresAt: now.Add(ttl)}
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) GetAutoSession(ctx context.Context, chatID int64) (*AutoSession, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.autoSessions[chatID]
+	if !ok {
+		return nil, nil
+	}
+	if !time.Now().Before(s.ExpiresAt) {
+		delete(m.autoSessions, chatID)
+		return nil, nil
+	}
+	return &s, nil
+}
+
+func (m *Memory) RecordAutoEpisode(ctx context.Context, chatID int64, seasonNum int, episodeNum int, ttl time.Duration) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.autoSessions[chatID]
+	if !ok {
+		return nil
+	}
+	s.EpisodesAdded++
+	s.LastSeason = seasonNum
+	s.LastEpisode = episodeNum
+	s.ExpiresAt = time.Now().Add(ttl)
+	m.autoSessions[chatID] = s
+	return nil
+}
+
+func (m *Memory) StopAutoSession(ctx context.Context, chatID int64) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	delete(m.autoSessions, chatID)
+	m.mu.Unlock()
+	return nil
+}
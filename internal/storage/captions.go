@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CaptionTemplate is an admin-defined caption regex for one storage channel.
+// Templates are tried before the built-in caption parsers, oldest first.
+type CaptionTemplate struct {
+	ChatID    int64     `bson:"chat_id"`
+	Pattern   string    `bson:"pattern"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+func (m *Mongo) AddCaptionTemplate(ctx context.Context, chatID int64, pattern string) error {
+	if m == nil {
+		return errors.New("mongo not configured")
+	}
+	_, err := m.captionTemplates.UpdateOne(ctx,
+		bson.M{"chat_id": chatID, "pattern": pattern},
+		bson.M{"$setOnInsert": CaptionTemplate{ChatID: chatID, Pattern: pattern, CreatedAt: time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (m *Mongo) DeleteCaptionTemplate(ctx context.Context, chatID int64, pattern string) error {
+	if m == nil {
+		return nil
+	}
+	_, err := m.captionTemplates.DeleteOne(ctx, bson.M{"chat_id": chatID, "pattern": pattern})
+	return err
+}
+
+func (m *Mongo) ListCaptionTemplates(ctx context.Context, chatID int64) ([]CaptionTemplate, error) {
+	if m == nil {
+		return nil, errors.New("mongo not configured")
+	}
+	opts := options.Find().SetSort(bson.D{bson.E{Key: "created_at", Value: 1}})
+	cur, err := m.captionTemplates.Find(ctx, bson.M{"chat_id": chatID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	out := []CaptionTemplate{}
+	for cur.Next(ctx) {
+		var t CaptionTemplate
+		if err := cur.Decode(&t); err != nil {
+			continue
+		}
+		out = append(out, t)
+	}
+	return out, cur.Err()
+}
+
+func (m *Memory) AddCaptionTemplate(ctx context.Context, chatID int64, pattern string) error {
+	if m == nil {
+		return errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.captionTemplates[chatID] {
+		if t.Pattern == pattern {
+			return nil
+		}
+	}
+	m.captionTemplates[chatID] = append(m.captionTemplates[chatID], CaptionTemplate{ChatID: chatID, Pattern: pattern, CreatedAt: time.Now()})
+	return nil
+}
+
+func (m *Memory) DeleteCaptionTemplate(ctx context.Context, chatID int64, pattern string) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.captionTemplates[chatID][:0]
+	for _, t := range m.captionTemplates[chatID] {
+		if t.Pattern != pattern {
+			kept = append(kept, t)
+		}
+	}
+	m.captionTemplates[chatID] = kept
+	return nil
+}
+
+func (m *Memory) ListCaptionTemplates(ctx context.Context, chatID int64) ([]CaptionTemplate, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	out := append([]CaptionTemplate{}, m.captionTemplates[chatID]...)
+	m.mu.Unlock()
+	sort.SliceStable(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
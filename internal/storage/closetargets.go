@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CloseTargets groups the copied messages that a "Закрыть" button on
+// MessageID has to delete, e.g. every part of a multi-part movie.
+type CloseTargets struct {
+	ChatID    int64     `bson:"chat_id"`
+	MessageID int       `bson:"message_id"`
+	Targets   []int     `bson:"targets"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+type closeKey struct {
+	chatID    int64
+	messageID int
+}
+
+func (m *Mongo) SaveCloseTargets(ctx context.Context, chatID int64, messageID int, targets []int, ttl time.Duration) error {
+	if m == nil {
+		return errors.New("mongo not configured")
+	}
+	_, err := m.closeTargets.ReplaceOne(ctx,
+		bson.M{"chat_id": chatID, "message_id": messageID},
+		CloseTargets{ChatID: chatID, MessageID: messageID, Targets: targets, ExpiresAt: time.Now().Add(ttl)},
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (m *Mongo) TakeCloseTargets(ctx context.Context, chatID int64, messageID int) ([]int, error) {
+	if m == nil {
+		return nil, errors.New("mongo not configured")
+	}
+	var ct CloseTargets
+	err := m.closeTargets.FindOneAndDelete(ctx, bson.M{"chat_id": chatID, "message_id": messageID}).Decode(&ct)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(ct.ExpiresAt) {
+		return nil, nil
+	}
+	return ct.Targets, nil
+}
+
+func (m *Memory) SaveCloseTargets(ctx context.Context, chatID int64, messageID int, targets []int, ttl time.Duration) error {
+	if m == nil {
+		return errors.New("memory store not configured")
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, ct := range m.closeTargets {
+		if !now.Before(ct.ExpiresAt) {
+			delete(m.closeTargets, k)
+		}
+	}
+	m.closeTargets[closeKey{chatID: chatID, messageID: messageID}] = CloseTargets{
+		ChatID:    chatID,
+		MessageID: messageID,
+		Targets:   append([]int(nil), targets...),
+		ExpiresAt: now.Add(ttl),
+	}
+	return nil
+}
+
+func (m *Memory) TakeCloseTargets(ctx context.Context, chatID int64, messageID int) ([]int, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	key := closeKey{chatID: chatID, messageID: messageID}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ct, ok := m.closeTargets[key]
+	if !ok {
+		return nil, nil
+	}
+	delete(m.closeTargets, key)
+	if !time.Now().Before(ct.ExpiresAt) {
+		return nil, nil
+	}
+	return ct.Targets, nil
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Favorite is a title a user starred. The title does not have to be in the
+// library; Title is a snapshot taken when it was starred.
+type Favorite struct {
+	UserID    int64     `bson:"user_id"`
+	KPID      int       `bson:"kp_id"`
+	Title     string    `bson:"title,omitempty"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+func (m *Mongo) AddFavorite(ctx context.Context, f Favorite) error {
+	if m == nil {
+		return errors.New("mongo not configured")
+	}
+	_, err := m.favorites.UpdateOne(ctx,
+		bson.M{"user_id": f.UserID, "kp_id": f.KPID},
+		bson.M{
+			"$set":         bson.M{"title": f.Title},
+			"$setOnInsert": bson.M{"created_at": time.Now()},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (m *Mongo) RemoveFavorite(ctx context.Context, userID int64, kpID int) error {
+	if m == nil {
+		return nil
+	}
+	_, err := m.favorites.DeleteOne(ctx, bson.M{"user_id": userID, "kp_id": kpID})
+	return err
+}
+
+func (m *Mongo) IsFavorite(ctx context.Context, userID int64, kpID int) (bool, error) {
+	if m == nil {
+		return false, errors.New("mongo not configured")
+	}
+	n, err := m.favorites.CountDocuments(ctx, bson.M{"user_id": userID, "kp_id": kpID}, options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+// ListFavorites returns one page of userID's favorites, newest first, and
+// the total number of favorites.
+func (m *Mongo) ListFavorites(ctx context.Context, userID int64, offset int, limit int) ([]Favorite, int, error) {
+	if m == nil {
+		return nil, 0, errors.New("mongo not configured")
+	}
+	limit = clampListLimit(limit)
+	if offset < 0 {
+		offset = 0
+	}
+	filter := bson.M{"user_id": userID}
+	total, err := m.favorites.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := options.Find().
+		SetSort(bson.D{bson.E{Key: "created_at", Value: -1}, bson.E{Key: "kp_id", Value: 1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit))
+	cur, err := m.favorites.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cur.Close(ctx)
+	out := make([]Favorite, 0, limit)
+	for cur.Next(ctx) {
+		var f Favorite
+		if err := cur.Decode(&f); err != nil {
+			continue
+		}
+		out = append(out, f)
+	}
+	return out, int(total), cur.Err()
+}
+
+func (m *Memory) AddFavorite(ctx context.Context, f Favorite) error {
+	if m == nil {
+		return errors.New("memory store not configured")
+	}
+	key := userTitleKey{userID: f.UserID, kpID: f.KPID}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.favorites[key]; ok {
+		f.CreatedAt = old.CreatedAt
+	} else {
+		f.CreatedAt = time.Now()
+	}
+	m.favorites[key] = f
+	return nil
+}
+
+func (m *Memory) RemoveFavorite(ctx context.Context, userID int64, kpID int) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	delete(m.favorites, userTitleKey{userID: userID, kpID: kpID})
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) IsFavorite(ctx context.Context, userID int64, kpID int) (bool, error) {
+	if m == nil {
+		return false, errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.favorites[userTitleKey{userID: userID, kpID: kpID}]
+	return ok, nil
+}
+
+func (m *Memory) ListFavorites(ctx context.Context, userID int64, offset int, limit int) ([]Favorite, int, error) {
+	if m == nil {
+		return nil, 0, errors.New("memory store not configured")
+	}
+	limit = clampListLimit(limit)
+	if offset < 0 {
+		offset = 0
+	}
+	m.mu.Lock()
+	all := []Favorite{}
+	for k, f := range m.favorites {
+		if k.userID == userID {
+			all = append(all, f)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		if !all[i].CreatedAt.Equal(all[j].CreatedAt) {
+			return all[i].CreatedAt.After(all[j].CreatedAt)
+		}
+		return all[i].KPID < all[j].KPID
+	})
+	total := len(all)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return all[offset:end], total, nil
+}
@@ -3,41 +3,41 @@ package storage
 import (
 	"fmt"
 	"sort"
-	"strconv"
 	"strings"
 
+	"handler/internal/cbdata"
 	"handler/internal/tg"
 )
 
 func (w *WatchItem) SeriesKeyboard() *tg.InlineKeyboardMarkup {
-	return w.SeriesKeyboardWithVoice("", -1)
+	return w.SeriesKeyboardWithVoice(cbdata.NoVoice)
 }
 
-func (w *WatchItem) SeriesKeyboardWithVoice(voice string, voiceIdx int) *tg.InlineKeyboardMarkup {
+func (w *WatchItem) SeriesKeyboardWithVoice(voiceID int) *tg.InlineKeyboardMarkup {
 	if w == nil {
 		return nil
 	}
-	voice = strings.TrimSpace(voice)
+	voice, ok := w.VoiceByID(voiceID)
+	if !ok {
+		voiceID = cbdata.NoVoice
+	}
 	rows := make([][]tg.InlineKeyboardButton, 0, len(w.Seasons)+1)
 	for _, s := range w.Seasons {
-		if voice != "" && !seasonHasVoice(&s, voice) {
+		if ok && !seasonHasVoice(&s, voice.Name) {
 			continue
 		}
-		cb := fmt.Sprintf("season:%d:%d", w.KPID, s.Number)
-		if voiceIdx >= 0 {
-			cb = fmt.Sprintf("season:%d:%d:%d", w.KPID, s.Number, voiceIdx)
-		}
+		cb := cbdata.Data(cbdata.Season{KPID: w.KPID, Season: s.Number, VoiceID: voiceID})
 		rows = append(rows, []tg.InlineKeyboardButton{{Text: fmt.Sprintf("%d сезон", s.Number), CallbackData: cb}})
 	}
 	rows = append(rows, []tg.InlineKeyboardButton{
-		{Text: "Назад", CallbackData: fmt.Sprintf("seriesvoices:%d", w.KPID)},
-		{Text: "Закрыть", CallbackData: "close"},
+		{Text: "Назад", CallbackData: cbdata.Data(cbdata.SeriesVoices{KPID: w.KPID})},
+		{Text: "Закрыть", CallbackData: cbdata.Data(cbdata.Close{})},
 	})
 	kb := tg.NewInlineKeyboardMarkup(rows)
 	return &kb
 }
 
-func (w *WatchItem) SeasonKeyboard(seasonNum int, page int, voice string, voiceIdx int) *tg.InlineKeyboardMarkup {
+func (w *WatchItem) SeasonKeyboard(seasonNum int, page int, voiceID int) *tg.InlineKeyboardMarkup {
 	if w == nil {
 		return nil
 	}
@@ -52,7 +52,12 @@ func (w *WatchItem) SeasonKeyboard(seasonNum int, page int, voice string, voiceI
 		return w.SeriesKeyboard()
 	}
 
-	voice = strings.TrimSpace(voice)
+	voice := ""
+	if v, ok := w.VoiceByID(voiceID); ok {
+		voice = v.Name
+	} else {
+		voiceID = cbdata.NoVoice
+	}
 
 	if page < 1 {
 		page = 1
@@ -60,13 +65,7 @@ func (w *WatchItem) SeasonKeyboard(seasonNum int, page int, voice string, voiceI
 	const perPage = 24
 	filtered := make([]Episode, 0, len(season.Episodes))
 	for _, ep := range season.Episodes {
-		if voice == "" {
-			filtered = append(filtered, ep)
-			continue
-		}
-		// If episode has multiple variants, filter by voice.
-		// If episode has 0/1 variant, show it regardless of selected voice.
-		if len(ep.Variants) <= 1 || episodeHasVoice(&ep, voice) {
+		if episodeVisible(&ep, voice) {
 			filtered = append(filtered, ep)
 		}
 	}
@@ -86,20 +85,14 @@ func (w *WatchItem) SeasonKeyboard(seasonNum int, page int, voice string, voiceI
 
 	rows := make([][]tg.InlineKeyboardButton, 0, perPage/3+4)
 	// Header row (tap to go back to season list)
-	rows = append(rows, []tg.InlineKeyboardButton{{Text: fmt.Sprintf("%d сезон", seasonNum), CallbackData: fmt.Sprintf("watch:%d", w.KPID)}})
+	rows = append(rows, []tg.InlineKeyboardButton{{Text: fmt.Sprintf("%d сезон", seasonNum), CallbackData: cbdata.Data(cbdata.Watch{KPID: w.KPID})}})
 
 	row := []tg.InlineKeyboardButton{}
 	for i := start; i < end; i++ {
 		ep := filtered[i]
-		cbVoice := ""
-		if voiceIdx >= 0 {
-			cbVoice = strconv.Itoa(voiceIdx)
-		} else if len(ep.Variants) > 1 {
-			cbVoice = "select"
-		}
 		row = append(row, tg.InlineKeyboardButton{
 			Text:         fmt.Sprintf("%d серия", ep.Number),
-			CallbackData: fmt.Sprintf("ep:%d:%d:%d:%s", w.KPID, seasonNum, ep.Number, cbVoice),
+			CallbackData: cbdata.Data(cbdata.Episode{KPID: w.KPID, Season: seasonNum, Episode: ep.Number, VoiceID: voiceID}),
 		})
 		if len(row) == 3 {
 			rows = append(rows, row)
@@ -113,45 +106,85 @@ func (w *WatchItem) SeasonKeyboard(seasonNum int, page int, voice string, voiceI
 	if totalPages > 1 {
 		nav := []tg.InlineKeyboardButton{}
 		if page > 1 {
-			if voiceIdx >= 0 {
-				nav = append(nav, tg.InlineKeyboardButton{Text: "<<<", CallbackData: fmt.Sprintf("seasonpage:%d:%d:%d:%d", w.KPID, seasonNum, page-1, voiceIdx)})
-			} else {
-				nav = append(nav, tg.InlineKeyboardButton{Text: "<<<", CallbackData: fmt.Sprintf("seasonpage:%d:%d:%d", w.KPID, seasonNum, page-1)})
-			}
+			nav = append(nav, tg.InlineKeyboardButton{Text: "<<<", CallbackData: cbdata.Data(cbdata.SeasonPage{KPID: w.KPID, Season: seasonNum, Page: page - 1, VoiceID: voiceID})})
 		}
 		if page < totalPages {
-			if voiceIdx >= 0 {
-				nav = append(nav, tg.InlineKeyboardButton{Text: ">>>", CallbackData: fmt.Sprintf("seasonpage:%d:%d:%d:%d", w.KPID, seasonNum, page+1, voiceIdx)})
-			} else {
-				nav = append(nav, tg.InlineKeyboardButton{Text: ">>>", CallbackData: fmt.Sprintf("seasonpage:%d:%d:%d", w.KPID, seasonNum, page+1)})
-			}
+			nav = append(nav, tg.InlineKeyboardButton{Text: ">>>", CallbackData: cbdata.Data(cbdata.SeasonPage{KPID: w.KPID, Season: seasonNum, Page: page + 1, VoiceID: voiceID})})
 		}
 		if len(nav) > 0 {
 			rows = append(rows, nav)
 		}
 	}
 
-	if voiceIdx >= 0 {
+	if voiceID != cbdata.NoVoice {
 		rows = append(rows, []tg.InlineKeyboardButton{
-			{Text: "Назад", CallbackData: fmt.Sprintf("seriesvoice:%d:%d", w.KPID, voiceIdx)},
-			{Text: "Закрыть", CallbackData: "close"},
+			{Text: "Назад", CallbackData: cbdata.Data(cbdata.SeriesVoice{KPID: w.KPID, VoiceID: voiceID})},
+			{Text: "Закрыть", CallbackData: cbdata.Data(cbdata.Close{})},
 		})
 	} else {
 		rows = append(rows, []tg.InlineKeyboardButton{
-			{Text: "Назад", CallbackData: fmt.Sprintf("watch:%d", w.KPID)},
-			{Text: "Закрыть", CallbackData: "close"},
+			{Text: "Назад", CallbackData: cbdata.Data(cbdata.Watch{KPID: w.KPID})},
+			{Text: "Закрыть", CallbackData: cbdata.Data(cbdata.Close{})},
 		})
 	}
 	kb := tg.NewInlineKeyboardMarkup(rows)
 	return &kb
 }
 
+// AdjacentEpisode finds the episode before (dir -1) or after (dir 1)
+// seasonNum/epNum in stored order. Missing episode numbers are skipped and
+// the search continues into the neighbouring seasons. With voice set, only
+// episodes shown for that voice are considered.
+func (w *WatchItem) AdjacentEpisode(seasonNum int, epNum int, dir int, voice string) (int, int, bool) {
+	if w == nil || (dir != -1 && dir != 1) {
+		return 0, 0, false
+	}
+	voice = strings.TrimSpace(voice)
+	before := func(s1, e1, s2, e2 int) bool { return s1 < s2 || (s1 == s2 && e1 < e2) }
+	found := false
+	var bestSeason, bestEp int
+	for si := range w.Seasons {
+		s := &w.Seasons[si]
+		for ei := range s.Episodes {
+			ep := &s.Episodes[ei]
+			if !episodeVisible(ep, voice) {
+				continue
+			}
+			if dir == 1 {
+				if !before(seasonNum, epNum, s.Number, ep.Number) {
+					continue
+				}
+				if !found || before(s.Number, ep.Number, bestSeason, bestEp) {
+					bestSeason, bestEp, found = s.Number, ep.Number, true
+				}
+			} else {
+				if !before(s.Number, ep.Number, seasonNum, epNum) {
+					continue
+				}
+				if !found || before(bestSeason, bestEp, s.Number, ep.Number) {
+					bestSeason, bestEp, found = s.Number, ep.Number, true
+				}
+			}
+		}
+	}
+	return bestSeason, bestEp, found
+}
+
+// episodeVisible reports whether ep is listed when voice is selected.
+// Episodes with 0/1 variant are shown regardless of the selected voice.
+func episodeVisible(ep *Episode, voice string) bool {
+	if voice == "" {
+		return true
+	}
+	return len(ep.Variants) <= 1 || episodeHasVoice(ep, voice)
+}
+
 func seasonHasVoice(season *Season, voice string) bool {
 	if season == nil {
 		return false
 	}
 	for i := range season.Episodes {
-		if len(season.Episodes[i].Variants) <= 1 || episodeHasVoice(&season.Episodes[i], voice) {
+		if episodeVisible(&season.Episodes[i], voice) {
 			return true
 		}
 	}
@@ -0,0 +1,458 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LibrarySort is the order of a library listing.
+type LibrarySort string
+
+const (
+	SortAdded   LibrarySort = "added"
+	SortUpdated LibrarySort = "updated"
+	SortRating  LibrarySort = "rating"
+	SortTitle   LibrarySort = "title"
+	SortYear    LibrarySort = "year"
+)
+
+// librarySortSpec orders by field, then by _id in the same direction. Items
+// without the field come last in descending and first in ascending order,
+// as in Mongo. An empty field orders by _id alone, i.e. by insertion.
+type librarySortSpec struct {
+	field string
+	desc  bool
+}
+
+var librarySorts = map[LibrarySort]librarySortSpec{
+	SortAdded:   {field: "", desc: true},
+	SortUpdated: {field: "updated_at", desc: true},
+	SortRating:  {field: "meta.rating", desc: true},
+	SortYear:    {field: "meta.year", desc: true},
+	SortTitle:   {field: "meta.title", desc: false},
+}
+
+// ParseLibrarySort accepts the sort names; "" is SortAdded.
+func ParseLibrarySort(s string) (LibrarySort, bool) {
+	if s == "" {
+		return SortAdded, true
+	}
+	_, ok := librarySorts[LibrarySort(s)]
+	return LibrarySort(s), ok
+}
+
+// ErrBadCursor is returned for a cursor that wasn't issued for this sort.
+var ErrBadCursor = errors.New("invalid cursor")
+
+// LibraryQuery selects one page of the library. Zero fields don't filter.
+// Genre, Voice and Quality match whole values ignoring case; Search is a
+// case-insensitive substring of the stored, synced or original title.
+// Year and rating filters only match items with synced metadata.
+type LibraryQuery struct {
+	Type      string
+	Genre     string
+	Voice     string
+	Quality   string
+	YearFrom  int
+	YearTo    int
+	MinRating float64
+	Search    string
+	Sort      LibrarySort
+	Cursor    string
+	Limit     int
+}
+
+// LibraryResult is a page of items; NextCursor is empty on the last page.
+type LibraryResult struct {
+	Items      []WatchItem
+	NextCursor string
+}
+
+func clampPageLimit(limit int) int {
+	if limit <= 0 {
+		return 20
+	}
+	return min(limit, 100)
+}
+
+// librarySortKey is the sort value of one item. Titles are compared by the
+// Mongo collation, so lower is only used by Memory.
+type librarySortKey struct {
+	null  bool
+	str   string
+	num   float64
+	lower string
+}
+
+func (s librarySortSpec) key(item *WatchItem) librarySortKey {
+	switch s.field {
+	case "updated_at":
+		return librarySortKey{num: float64(item.UpdatedAt.UnixMilli())}
+	case "meta.rating":
+		if item.Meta == nil || item.Meta.Rating == 0 {
+			return librarySortKey{null: true}
+		}
+		return librarySortKey{num: item.Meta.Rating}
+	case "meta.year":
+		if item.Meta == nil || item.Meta.Year == 0 {
+			return librarySortKey{null: true}
+		}
+		return librarySortKey{num: float64(item.Meta.Year)}
+	case "meta.title":
+		if item.Meta == nil || item.Meta.Title == "" {
+			return librarySortKey{null: true}
+		}
+		return librarySortKey{str: item.Meta.Title, lower: strings.ToLower(item.Meta.Title)}
+	}
+	return librarySortKey{null: true}
+}
+
+// compare orders two items in listing order.
+func (s librarySortSpec) compare(a librarySortKey, aID primitive.ObjectID, b librarySortKey, bID primitive.ObjectID) int {
+	c := 0
+	switch {
+	case a.null && b.null:
+	case a.null:
+		c = -1
+	case b.null:
+		c = 1
+	case s.field == "meta.title":
+		c = strings.Compare(a.lower, b.lower)
+	default:
+		c = cmp.Compare(a.num, b.num)
+	}
+	if c == 0 {
+		c = bytes.Compare(aID[:], bID[:])
+	}
+	if s.desc {
+		c = -c
+	}
+	return c
+}
+
+// bsonValue is the key as stored in Mongo.
+func (s librarySortSpec) bsonValue(k librarySortKey) any {
+	switch s.field {
+	case "updated_at":
+		return time.UnixMilli(int64(k.num))
+	case "meta.title":
+		return k.str
+	}
+	return k.num
+}
+
+type libraryCursor struct {
+	Sort LibrarySort `json:"s"`
+	ID   string      `json:"id"`
+	Null bool        `json:"n,omitempty"`
+	Str  string      `json:"t,omitempty"`
+	Num  float64     `json:"f,omitempty"`
+}
+
+func encodeLibraryCursor(sortBy LibrarySort, spec librarySortSpec, item *WatchItem) string {
+	k := spec.key(item)
+	raw, _ := json.Marshal(libraryCursor{Sort: sortBy, ID: item.ID.Hex(), Null: k.null, Str: k.str, Num: k.num})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeLibraryCursor(sortBy LibrarySort, s string) (librarySortKey, primitive.ObjectID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return librarySortKey{}, primitive.NilObjectID, ErrBadCursor
+	}
+	var c libraryCursor
+	if err := json.Unmarshal(raw, &c); err != nil || c.Sort != sortBy {
+		return librarySortKey{}, primitive.NilObjectID, ErrBadCursor
+	}
+	id, err := primitive.ObjectIDFromHex(c.ID)
+	if err != nil {
+		return librarySortKey{}, primitive.NilObjectID, ErrBadCursor
+	}
+	return librarySortKey{null: c.Null, str: c.Str, num: c.Num, lower: strings.ToLower(c.Str)}, id, nil
+}
+
+// libraryCollation makes string matches and the title sort case-insensitive.
+// The library indexes are built with it, so queries must use it too.
+var libraryCollation = &options.Collation{Locale: "ru", Strength: 2}
+
+func libraryFilter(q LibraryQuery) bson.M {
+	var conds []bson.M
+	if q.Type != "" {
+		conds = append(conds, bson.M{"type": q.Type})
+	}
+	if q.Genre != "" {
+		conds = append(conds, bson.M{"meta.genres": q.Genre})
+	}
+	if q.Voice != "" {
+		conds = append(conds, bson.M{"$or": bson.A{
+			bson.M{"voice": q.Voice},
+			bson.M{"voices.name": q.Voice},
+			bson.M{"seasons.episodes.variants.voice": q.Voice},
+		}})
+	}
+	if q.Quality != "" {
+		conds = append(conds, bson.M{"$or": bson.A{
+			bson.M{"quality": q.Quality},
+			bson.M{"seasons.episodes.variants.quality": q.Quality},
+		}})
+	}
+	if q.YearFrom > 0 || q.YearTo > 0 {
+		year := bson.M{}
+		if q.YearFrom > 0 {
+			year["$gte"] = q.YearFrom
+		}
+		if q.YearTo > 0 {
+			year["$lte"] = q.YearTo
+		}
+		conds = append(conds, bson.M{"meta.year": year})
+	}
+	if q.MinRating > 0 {
+		conds = append(conds, bson.M{"meta.rating": bson.M{"$gte": q.MinRating}})
+	}
+	if q.Search != "" {
+		re := primitive.Regex{Pattern: regexp.QuoteMeta(q.Search), Options: "i"}
+		conds = append(conds, bson.M{"$or": bson.A{
+			bson.M{"title": re},
+			bson.M{"meta.title": re},
+			bson.M{"meta.original_title": re},
+		}})
+	}
+	if len(conds) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": conds}
+}
+
+// afterCursor matches the items that follow the cursor in spec's order.
+func (s librarySortSpec) afterCursor(k librarySortKey, id primitive.ObjectID) bson.M {
+	idOp := "$gt"
+	valOp := "$gt"
+	if s.desc {
+		idOp = "$lt"
+		valOp = "$lt"
+	}
+	if s.field == "" {
+		return bson.M{"_id": bson.M{idOp: id}}
+	}
+	if k.null {
+		sameNull := bson.M{s.field: nil, "_id": bson.M{idOp: id}}
+		if s.desc {
+			return sameNull
+		}
+		return bson.M{"$or": bson.A{sameNull, bson.M{s.field: bson.M{"$ne": nil}}}}
+	}
+	v := s.bsonValue(k)
+	or := bson.A{
+		bson.M{s.field: bson.M{valOp: v}},
+		bson.M{s.field: v, "_id": bson.M{idOp: id}},
+	}
+	if s.desc {
+		or = append(or, bson.M{s.field: nil})
+	}
+	return bson.M{"$or": or}
+}
+
+// QueryLibrary returns one page of the library, see LibraryQuery.
+func (m *Mongo) QueryLibrary(ctx context.Context, q LibraryQuery) (*LibraryResult, error) {
+	if m == nil {
+		return nil, errors.New("mongo not configured")
+	}
+	sortBy, ok := ParseLibrarySort(string(q.Sort))
+	if !ok {
+		return nil, errors.New("unknown sort")
+	}
+	spec := librarySorts[sortBy]
+	limit := clampPageLimit(q.Limit)
+
+	filter := libraryFilter(q)
+	if q.Cursor != "" {
+		k, id, err := decodeLibraryCursor(sortBy, q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after := spec.afterCursor(k, id)
+		if and, ok := filter["$and"].([]bson.M); ok {
+			filter["$and"] = append(and, after)
+		} else {
+			filter = bson.M{"$and": []bson.M{after}}
+		}
+	}
+
+	dir := 1
+	if spec.desc {
+		dir = -1
+	}
+	order := bson.D{}
+	if spec.field != "" {
+		order = append(order, bson.E{Key: spec.field, Value: dir})
+	}
+	order = append(order, bson.E{Key: "_id", Value: dir})
+	opts := options.Find().
+		SetSort(order).
+		SetLimit(int64(limit + 1)).
+		SetCollation(libraryCollation)
+	cur, err := m.col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	items := make([]WatchItem, 0, limit+1)
+	for cur.Next(ctx) {
+		var it WatchItem
+		if err := cur.Decode(&it); err != nil {
+			continue
+		}
+		items = append(items, it)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+	return libraryResult(sortBy, spec, items, limit), nil
+}
+
+// libraryResult trims the extra item fetched to detect a next page.
+func libraryResult(sortBy LibrarySort, spec librarySortSpec, items []WatchItem, limit int) *LibraryResult {
+	out := &LibraryResult{Items: items}
+	if len(items) > limit {
+		out.Items = items[:limit]
+		out.NextCursor = encodeLibraryCursor(sortBy, spec, &out.Items[limit-1])
+	}
+	return out
+}
+
+// libraryIndexes back the QueryLibrary sorts and the type and genre filters.
+func libraryIndexes() []mongo.IndexModel {
+	opts := func() *options.IndexOptions { return options.Index().SetCollation(libraryCollation) }
+	return []mongo.IndexModel{
+		{Keys: bson.D{bson.E{Key: "updated_at", Value: -1}, bson.E{Key: "_id", Value: -1}}, Options: opts()},
+		{Keys: bson.D{bson.E{Key: "meta.rating", Value: -1}, bson.E{Key: "_id", Value: -1}}, Options: opts()},
+		{Keys: bson.D{bson.E{Key: "meta.year", Value: -1}, bson.E{Key: "_id", Value: -1}}, Options: opts()},
+		{Keys: bson.D{bson.E{Key: "meta.title", Value: 1}, bson.E{Key: "_id", Value: 1}}, Options: opts()},
+		{Keys: bson.D{bson.E{Key: "type", Value: 1}, bson.E{Key: "_id", Value: -1}}, Options: opts()},
+		{Keys: bson.D{bson.E{Key: "meta.genres", Value: 1}}, Options: opts()},
+	}
+}
+
+func (m *Memory) QueryLibrary(ctx context.Context, q LibraryQuery) (*LibraryResult, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	sortBy, ok := ParseLibrarySort(string(q.Sort))
+	if !ok {
+		return nil, errors.New("unknown sort")
+	}
+	spec := librarySorts[sortBy]
+	limit := clampPageLimit(q.Limit)
+	var (
+		after   bool
+		afterK  librarySortKey
+		afterID primitive.ObjectID
+	)
+	if q.Cursor != "" {
+		k, id, err := decodeLibraryCursor(sortBy, q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after, afterK, afterID = true, k, id
+	}
+
+	m.mu.Lock()
+	items := []WatchItem{}
+	for _, it := range m.items {
+		if !matchLibrary(it, q) {
+			continue
+		}
+		if after && spec.compare(spec.key(it), it.ID, afterK, afterID) <= 0 {
+			continue
+		}
+		items = append(items, *cloneWatchItem(it))
+	}
+	m.mu.Unlock()
+	sort.Slice(items, func(i, j int) bool {
+		return spec.compare(spec.key(&items[i]), items[i].ID, spec.key(&items[j]), items[j].ID) < 0
+	})
+	if len(items) > limit+1 {
+		items = items[:limit+1]
+	}
+	return libraryResult(sortBy, spec, items, limit), nil
+}
+
+// matchLibrary is libraryFilter for Memory.
+func matchLibrary(item *WatchItem, q LibraryQuery) bool {
+	if q.Type != "" && !strings.EqualFold(item.Type, q.Type) {
+		return false
+	}
+	meta := item.Meta
+	if meta == nil {
+		meta = &TitleMeta{}
+	}
+	if q.Genre != "" && !containsFold(meta.Genres, q.Genre) {
+		return false
+	}
+	if q.Voice != "" || q.Quality != "" {
+		voices := []string{item.Voice}
+		qualities := []string{item.Quality}
+		for _, v := range item.Voices {
+			voices = append(voices, v.Name)
+		}
+		for _, s := range item.Seasons {
+			for _, ep := range s.Episodes {
+				for _, v := range ep.Variants {
+					voices = append(voices, v.Voice)
+					qualities = append(qualities, v.Quality)
+				}
+			}
+		}
+		if q.Voice != "" && !containsFold(voices, q.Voice) {
+			return false
+		}
+		if q.Quality != "" && !containsFold(qualities, q.Quality) {
+			return false
+		}
+	}
+	if q.YearFrom > 0 && (meta.Year == 0 || meta.Year < q.YearFrom) {
+		return false
+	}
+	if q.YearTo > 0 && (meta.Year == 0 || meta.Year > q.YearTo) {
+		return false
+	}
+	if q.MinRating > 0 && meta.Rating < q.MinRating {
+		return false
+	}
+	if q.Search != "" {
+		needle := strings.ToLower(q.Search)
+		found := false
+		for _, s := range []string{item.Title, meta.Title, meta.OriginalTitle} {
+			if strings.Contains(strings.ToLower(s), needle) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(vals []string, want string) bool {
+	for _, v := range vals {
+		if strings.EqualFold(strings.TrimSpace(v), want) {
+			return true
+		}
+	}
+	return false
+}
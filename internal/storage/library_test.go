@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// seedLibrary stores items 1..8 with ascending _ids. Some share a sort value
+// and some lack it, so every sort breaks ties by _id and places missing keys.
+// Titles are Cyrillic only: Memory orders them by lowercase code points,
+// which matches the ru collation within one script.
+func seedLibrary(t *testing.T, db Store) {
+	t.Helper()
+	base := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	items := []struct {
+		updated int // seconds after base
+		meta    *TitleMeta
+	}{
+		1: {updated: 1},
+		2: {updated: 3, meta: &TitleMeta{Title: "Бета", Year: 2020, Rating: 7.5}},
+		3: {updated: 3, meta: &TitleMeta{Title: "альфа", Year: 2020, Rating: 8}},
+		4: {updated: 2, meta: &TitleMeta{Title: "Альфа", Year: 2019}},
+		5: {updated: 5, meta: &TitleMeta{Rating: 7.5}},
+		6: {updated: 1, meta: &TitleMeta{Title: "яблоко", Year: 2021, Rating: 6}},
+		7: {updated: 4},
+		8: {updated: 0, meta: &TitleMeta{Title: "БЕТА", Year: 2020, Rating: 8}},
+	}
+	for kpID := 1; kpID < len(items); kpID++ {
+		it := items[kpID]
+		var id primitive.ObjectID
+		id[11] = byte(kpID)
+		seedItem(t, db, WatchItem{
+			ID:        id,
+			KPID:      kpID,
+			Type:      "movie",
+			Title:     fmt.Sprint("item ", kpID),
+			Meta:      it.meta,
+			UpdatedAt: base.Add(time.Duration(it.updated) * time.Second),
+		})
+	}
+}
+
+func TestQueryLibraryPages(t *testing.T) {
+	tests := []struct {
+		sort LibrarySort
+		want string // KP IDs in listing order
+	}{
+		{SortAdded, "[8 7 6 5 4 3 2 1]"},
+		{SortUpdated, "[5 7 3 2 4 6 1 8]"},
+		{SortRating, "[8 3 5 2 6 7 4 1]"},
+		{SortYear, "[6 8 3 2 4 7 5 1]"},
+		{SortTitle, "[1 5 7 3 4 2 8 6]"},
+	}
+	for backend, db := range testStores(t) {
+		seedLibrary(t, db)
+		for _, tt := range tests {
+			for _, limit := range []int{1, 3, 8, 20} {
+				t.Run(fmt.Sprintf("%s/%s/limit%d", backend, tt.sort, limit), func(t *testing.T) {
+					ctx := context.Background()
+					got := []int{}
+					seen := map[int]bool{}
+					cursor := ""
+					for page := 0; ; page++ {
+						if page > 8 {
+							t.Fatalf("no last page after %v", got)
+						}
+						res, err := db.QueryLibrary(ctx, LibraryQuery{Sort: tt.sort, Cursor: cursor, Limit: limit})
+						if err != nil {
+							t.Fatal(err)
+						}
+						if len(res.Items) > limit {
+							t.Fatalf("page %d has %d items", page, len(res.Items))
+						}
+						for _, it := range res.Items {
+							if seen[it.KPID] {
+								t.Errorf("page %d repeats %d", page, it.KPID)
+							}
+							seen[it.KPID] = true
+							got = append(got, it.KPID)
+						}
+						if res.NextCursor == "" {
+							break
+						}
+						cursor = res.NextCursor
+					}
+					if fmt.Sprint(got) != tt.want {
+						t.Errorf("order = %v, want %s", got, tt.want)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestQueryLibraryBadCursor(t *testing.T) {
+	for backend, db := range testStores(t) {
+		seedLibrary(t, db)
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			res, err := db.QueryLibrary(ctx, LibraryQuery{Sort: SortRating, Limit: 2})
+			if err != nil || res.NextCursor == "" {
+				t.Fatalf("first page: %+v, %v", res, err)
+			}
+			for _, tt := range []struct {
+				name   string
+				sort   LibrarySort
+				cursor string
+			}{
+				{"cursor of another sort", SortYear, res.NextCursor},
+				{"cursor of the default sort", "", res.NextCursor},
+				{"not base64", SortRating, "!!"},
+				{"not json", SortRating, "bm9wZQ"},
+			} {
+				_, err := db.QueryLibrary(ctx, LibraryQuery{Sort: tt.sort, Cursor: tt.cursor})
+				if !errors.Is(err, ErrBadCursor) {
+					t.Errorf("%s: err = %v, want ErrBadCursor", tt.name, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MediaGroupPart is one message of a buffered album.
+type MediaGroupPart struct {
+	MessageID int    `bson:"message_id"`
+	Caption   string `bson:"caption,omitempty"`
+	FileName  string `bson:"file_name,omitempty"`
+	Width     int    `bson:"width,omitempty"`
+	Height    int    `bson:"height,omitempty"`
+}
+
+// MediaGroup collects the messages of a Telegram album. Telegram delivers
+// every album message as its own update, so the parts are buffered until
+// none has arrived for a moment (DueAt) and then filed together.
+// ReportChatID is where the result goes; 0 means only failures are reported.
+type MediaGroup struct {
+	StorageChatID int64            `bson:"storage_chat_id"`
+	GroupID       string           `bson:"group_id"`
+	ReportChatID  int64            `bson:"report_chat_id,omitempty"`
+	Parts         []MediaGroupPart `bson:"parts"`
+	FirstAt       time.Time        `bson:"first_at"`
+	DueAt         time.Time        `bson:"due_at"`
+}
+
+// MessageIDs returns the ids of the parts in posting order.
+func (g *MediaGroup) MessageIDs() []int {
+	ids := make([]int, 0, len(g.Parts))
+	for _, p := range g.Parts {
+		ids = append(ids, p.MessageID)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+type mediaGroupKey struct {
+	storageChatID int64
+	groupID       string
+}
+
+func (m *Mongo) AddMediaGroupPart(ctx context.Context, storageChatID int64, groupID string, reportChatID int64, part MediaGroupPart, delay time.Duration) error {
+	if m == nil {
+		return errors.New("mongo not configured")
+	}
+	now := time.Now()
+	_, err := m.mediaGroups.UpdateOne(ctx,
+		bson.M{"storage_chat_id": storageChatID, "group_id": groupID},
+		bson.M{
+			"$addToSet":    bson.M{"parts": part},
+			"$set":         bson.M{"due_at": now.Add(delay)},
+			"$setOnInsert": bson.M{"report_chat_id": reportChatID, "first_at": now},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// TakeDueMediaGroups removes and returns the albums whose window has closed.
+// Like TakeDueNotices, each album is claimed with FindOneAndDelete.
+func (m *Mongo) TakeDueMediaGroups(ctx context.Context, now time.Time) ([]MediaGroup, error) {
+	if m == nil {
+		return nil, errors.New("mongo not configured")
+	}
+	out := []MediaGroup{}
+	for len(out) < maxNoticesPerTake {
+		var g MediaGroup
+		err := m.mediaGroups.FindOneAndDelete(ctx, bson.M{"due_at": bson.M{"$lte": now}}).Decode(&g)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return out, err
+		}
+		out = append(out, g)
+	}
+	return out, nil
+}
+
+func (m *Memory) AddMediaGroupPart(ctx context.Context, storageChatID int64, groupID string, reportChatID int64, part MediaGroupPart, delay time.Duration) error {
+	if m == nil {
+		return errors.New("memory store not configured")
+	}
+	now := time.Now()
+	key := mediaGroupKey{storageChatID: storageChatID, groupID: groupID}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.mediaGroups[key]
+	if !ok {
+		g = MediaGroup{StorageChatID: storageChatID, GroupID: groupID, ReportChatID: reportChatID, FirstAt: now}
+	}
+	dup := false
+	for _, p := range g.Parts {
+		if p == part {
+			dup = true
+			break
+		}
+	}
+	if !dup {
+		g.Parts = append(g.Parts, part)
+	}
+	g.DueAt = now.Add(delay)
+	m.mediaGroups[key] = g
+	return nil
+}
+
+func (m *Memory) TakeDueMediaGroups(ctx context.Context, now time.Time) ([]MediaGroup, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []MediaGroup{}
+	for key, g := range m.mediaGroups {
+		if len(out) >= maxNoticesPerTake {
+			break
+		}
+		if !now.Before(g.DueAt) {
+			out = append(out, g)
+			delete(m.mediaGroups, key)
+		}
+	}
+	return out, nil
+}
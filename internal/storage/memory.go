@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Memory is an in-process Store with the same semantics as Mongo.
+// It is meant for local runs and tests, nothing is persisted.
+type Memory struct {
+	mu               sync.Mutex
+	items            map[int]*WatchItem
+	autoSessions     map[int64]AutoSession
+	closeTargets     map[closeKey]CloseTargets
+	progress         map[userTitleKey]WatchProgress
+	subscriptions    map[userTitleKey]Subscription
+	notices          map[int]EpisodeNotice
+	deliveries       []NoticeDelivery
+	favorites        map[userTitleKey]Favorite
+	requests         map[int]*ContentRequest
+	captionTemplates map[int64][]CaptionTemplate
+	mediaGroups      map[mediaGroupKey]MediaGroup
+	apiCache         map[string]cachedResponse
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		items:            map[int]*WatchItem{},
+		autoSessions:     map[int64]AutoSession{},
+		closeTargets:     map[closeKey]CloseTargets{},
+		progress:         map[userTitleKey]WatchProgress{},
+		subscriptions:    map[userTitleKey]Subscription{},
+		notices:          map[int]EpisodeNotice{},
+		favorites:        map[userTitleKey]Favorite{},
+		requests:         map[int]*ContentRequest{},
+		captionTemplates: map[int64][]CaptionTemplate{},
+		mediaGroups:      map[mediaGroupKey]MediaGroup{},
+		apiCache:         map[string]cachedResponse{},
+	}
+}
+
+func (m *Memory) Ping(ctx context.Context) error {
+	if m == nil {
+		return errors.New("memory store not configured")
+	}
+	return nil
+}
+
+func (m *Memory) GetWatchItemByKPID(ctx context.Context, kpID int) (*WatchItem, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.items[kpID]
+	if !ok {
+		return nil, nil
+	}
+	out := cloneWatchItem(item)
+	syncVoices(out)
+	return out, nil
+}
+
+func (m *Memory) HasWatchItems(ctx context.Context, kpIDs []int) (map[int]bool, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := map[int]bool{}
+	for _, id := range kpIDs {
+		if _, ok := m.items[id]; ok {
+			out[id] = true
+		}
+	}
+	return out, nil
+}
+
+func (m *Memory) UpsertWatchMovie(ctx context.Context, kpID int, voice string, quality string, storageChatID int64, storageMessageIDs []int) error {
+	if m == nil {
+		return nil
+	}
+	storageMessageID := 0
+	if len(storageMessageIDs) > 0 {
+		storageMessageID = storageMessageIDs[0]
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item := m.getOrCreate(kpID)
+	item.Type = "movie"
+	item.Voice = voice
+	item.Quality = quality
+	item.StorageChatID = storageChatID
+	item.StorageMessageID = storageMessageID
+	item.StorageMessageIDs = append([]int(nil), storageMessageIDs...)
+	item.UpdatedAt = time.Now()
+	return nil
+}
+
+func (m *Memory) AppendMovieParts(ctx context.Context, kpID int, storageChatID int64, storageMessageIDs []int) error {
+	if m == nil {
+		return nil
+	}
+	if kpID <= 0 || storageChatID == 0 || len(storageMessageIDs) == 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.items[kpID]
+	if !ok {
+		return errors.New("item not found")
+	}
+	next := cloneWatchItem(item)
+	if err := mergeMovieParts(next, storageChatID, storageMessageIDs); err != nil {
+		return err
+	}
+	m.items[kpID] = next
+	return nil
+}
+
+func (m *Memory) UpsertWatchSeries(ctx context.Context, kpID int, title string) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item := m.getOrCreate(kpID)
+	item.Type = "series"
+	item.Title = title
+	item.UpdatedAt = time.Now()
+	return nil
+}
+
+func (m *Memory) UpsertSeriesEpisode(ctx context.Context, kpID int, seasonNum int, episodeNum int, v EpisodeVariant) (bool, error) {
+	if m == nil {
+		return false, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item := m.getOrCreate(kpID)
+	// register the voices as reads number them before the new one is added
+	syncVoices(item)
+	return mergeSeriesEpisode(item, seasonNum, episodeNum, v), nil
+}
+
+func (m *Memory) DeleteSeriesEpisode(ctx context.Context, kpID int, seasonNum int, episodeNum int) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if item, ok := m.items[kpID]; ok {
+		syncVoices(item)
+		removeSeriesEpisode(item, seasonNum, episodeNum)
+	}
+	return nil
+}
+
+func (m *Memory) DeleteSeason(ctx context.Context, kpID int, seasonNum int) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if item, ok := m.items[kpID]; ok {
+		syncVoices(item)
+		removeSeason(item, seasonNum)
+	}
+	return nil
+}
+
+func (m *Memory) DeleteByKPID(ctx context.Context, kpID int) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	delete(m.items, kpID)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) ListRecent(ctx context.Context, limit int) ([]WatchItem, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	limit = clampListLimit(limit)
+	m.mu.Lock()
+	items := make([]WatchItem, 0, len(m.items))
+	for _, it := range m.items {
+		items = append(items, *cloneWatchItem(it))
+	}
+	m.mu.Unlock()
+	sort.Slice(items, func(i, j int) bool { return items[i].UpdatedAt.After(items[j].UpdatedAt) })
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+func (m *Memory) getOrCreate(kpID int) *WatchItem {
+	item, ok := m.items[kpID]
+	if !ok {
+		item = &WatchItem{ID: primitive.NewObjectID(), KPID: kpID}
+		m.items[kpID] = item
+	}
+	return item
+}
+
+func cloneWatchItem(item *WatchItem) *WatchItem {
+	out := *item
+	out.StorageMessageIDs = append([]int(nil), item.StorageMessageIDs...)
+	out.Voices = append([]Voice(nil), item.Voices...)
+	if item.Meta != nil {
+		meta := *item.Meta
+		meta.Genres = append([]string(nil), item.Meta.Genres...)
+		meta.Voices = append([]string(nil), item.Meta.Voices...)
+		out.Meta = &meta
+	}
+	if item.Seasons != nil {
+		out.Seasons = make([]Season, len(item.Seasons))
+		for i, s := range item.Seasons {
+			out.Seasons[i] = Season{Number: s.Number, Episodes: make([]Episode, len(s.Episodes))}
+			for j, ep := range s.Episodes {
+				ep.Variants = append([]EpisodeVariant(nil), ep.Variants...)
+				out.Seasons[i].Episodes[j] = ep
+			}
+		}
+	}
+	return &out
+}
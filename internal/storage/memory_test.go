@@ -0,0 +1,494 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStores returns the backends a table runs against: Memory always, and
+// Mongo when MONGODB_TEST_URI is set.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	stores := map[string]Store{"memory": NewMemory()}
+	if m := openTestMongo(t); m != nil {
+		stores["mongo"] = m
+	}
+	return stores
+}
+
+// layout renders the seasons of item as "season:episode x variants,...",
+// e.g. "1:1x2,2x1|2:1x1".
+func layout(item *WatchItem) string {
+	if item == nil {
+		return "<nil>"
+	}
+	seasons := make([]string, 0, len(item.Seasons))
+	for _, s := range item.Seasons {
+		eps := make([]string, 0, len(s.Episodes))
+		for _, ep := range s.Episodes {
+			eps = append(eps, fmt.Sprintf("%dx%d", ep.Number, len(ep.Variants)))
+		}
+		seasons = append(seasons, fmt.Sprintf("%d:%s", s.Number, strings.Join(eps, ",")))
+	}
+	return strings.Join(seasons, "|")
+}
+
+type episodeOp struct {
+	season, episode int
+	v               EpisodeVariant
+}
+
+func variant(msgID int, voice string) EpisodeVariant {
+	return EpisodeVariant{StorageChatID: -100, StorageMessageID: msgID, Voice: voice, Quality: "1080p"}
+}
+
+func TestUpsertSeriesEpisode(t *testing.T) {
+	tests := []struct {
+		name       string
+		ops        []episodeOp
+		wantAdded  []bool
+		wantLayout string
+		wantVoice  string // legacy Voice of the first episode
+	}{
+		{
+			name:       "new episode",
+			ops:        []episodeOp{{1, 1, variant(10, "LostFilm")}},
+			wantAdded:  []bool{true},
+			wantLayout: "1:1x1",
+			wantVoice:  "LostFilm",
+		},
+		{
+			name:       "duplicate variant is ignored regardless of case",
+			ops:        []episodeOp{{1, 1, variant(10, "LostFilm")}, {1, 1, variant(10, " lostfilm ")}},
+			wantAdded:  []bool{true, false},
+			wantLayout: "1:1x1",
+			wantVoice:  "LostFilm",
+		},
+		{
+			name:       "another voice becomes a variant, legacy fields follow the first",
+			ops:        []episodeOp{{1, 1, variant(10, "LostFilm")}, {1, 1, variant(11, "HDRezka")}},
+			wantAdded:  []bool{true, true},
+			wantLayout: "1:1x2",
+			wantVoice:  "LostFilm",
+		},
+		{
+			name: "seasons and episodes are kept sorted",
+			ops: []episodeOp{
+				{2, 3, variant(1, "A")}, {1, 2, variant(2, "A")}, {2, 1, variant(3, "A")}, {1, 1, variant(4, "A")},
+			},
+			wantAdded:  []bool{true, true, true, true},
+			wantLayout: "1:1x1,2x1|2:1x1,3x1",
+			wantVoice:  "A",
+		},
+	}
+	for backend, db := range testStores(t) {
+		for i, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				kpID := 1000 + i
+				for j, op := range tt.ops {
+					added, err := db.UpsertSeriesEpisode(ctx, kpID, op.season, op.episode, op.v)
+					if err != nil {
+						t.Fatalf("op %d: %v", j, err)
+					}
+					if added != tt.wantAdded[j] {
+						t.Errorf("op %d: added = %v, want %v", j, added, tt.wantAdded[j])
+					}
+				}
+				item, err := db.GetWatchItemByKPID(ctx, kpID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := layout(item); got != tt.wantLayout {
+					t.Errorf("layout = %q, want %q", got, tt.wantLayout)
+				}
+				if item.Type != "series" {
+					t.Errorf("type = %q, want series", item.Type)
+				}
+				if got := item.Seasons[0].Episodes[0].Voice; got != tt.wantVoice {
+					t.Errorf("legacy voice = %q, want %q", got, tt.wantVoice)
+				}
+			})
+		}
+	}
+}
+
+func TestDeleteEpisodeAndSeason(t *testing.T) {
+	seed := []episodeOp{{1, 1, variant(1, "A")}, {1, 2, variant(2, "A")}, {2, 1, variant(3, "A")}}
+	tests := []struct {
+		name       string
+		apply      func(ctx context.Context, db Store, kpID int) error
+		wantLayout string
+	}{
+		{
+			name:       "episode",
+			apply:      func(ctx context.Context, db Store, kpID int) error { return db.DeleteSeriesEpisode(ctx, kpID, 1, 2) },
+			wantLayout: "1:1x1|2:1x1",
+		},
+		{
+			name:       "missing episode is a no-op",
+			apply:      func(ctx context.Context, db Store, kpID int) error { return db.DeleteSeriesEpisode(ctx, kpID, 3, 1) },
+			wantLayout: "1:1x1,2x1|2:1x1",
+		},
+		{
+			name:       "season",
+			apply:      func(ctx context.Context, db Store, kpID int) error { return db.DeleteSeason(ctx, kpID, 1) },
+			wantLayout: "2:1x1",
+		},
+		{
+			name:       "missing season is a no-op",
+			apply:      func(ctx context.Context, db Store, kpID int) error { return db.DeleteSeason(ctx, kpID, 5) },
+			wantLayout: "1:1x1,2x1|2:1x1",
+		},
+	}
+	for backend, db := range testStores(t) {
+		for i, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				kpID := 2000 + i
+				for _, op := range seed {
+					if _, err := db.UpsertSeriesEpisode(ctx, kpID, op.season, op.episode, op.v); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := tt.apply(ctx, db, kpID); err != nil {
+					t.Fatal(err)
+				}
+				item, _ := db.GetWatchItemByKPID(ctx, kpID)
+				if got := layout(item); got != tt.wantLayout {
+					t.Errorf("layout = %q, want %q", got, tt.wantLayout)
+				}
+			})
+		}
+	}
+}
+
+func TestAppendMovieParts(t *testing.T) {
+	tests := []struct {
+		name    string
+		series  bool
+		initial []int
+		chatID  int64
+		appends []int
+		wantIDs string
+		wantErr bool
+	}{
+		{name: "parts are merged sorted and unique", initial: []int{5}, chatID: -100, appends: []int{3, 5, 7}, wantIDs: "[3 5 7]"},
+		{name: "other storage chat is rejected", initial: []int{5}, chatID: -200, appends: []int{6}, wantIDs: "[5]", wantErr: true},
+		{name: "series can't take parts", series: true, chatID: -100, appends: []int{6}, wantErr: true},
+	}
+	for backend, db := range testStores(t) {
+		for i, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				kpID := 3000 + i
+				if tt.series {
+					_ = db.UpsertWatchSeries(ctx, kpID, "series")
+				} else {
+					_ = db.UpsertWatchMovie(ctx, kpID, "Dub", "1080p", -100, tt.initial)
+				}
+				err := db.AppendMovieParts(ctx, kpID, tt.chatID, tt.appends)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+				}
+				if tt.series {
+					return
+				}
+				item, _ := db.GetWatchItemByKPID(ctx, kpID)
+				if got := fmt.Sprint(item.StorageMessageIDs); got != tt.wantIDs {
+					t.Errorf("ids = %s, want %s", got, tt.wantIDs)
+				}
+				if item.StorageMessageID != item.StorageMessageIDs[0] {
+					t.Errorf("legacy id = %d, want %d", item.StorageMessageID, item.StorageMessageIDs[0])
+				}
+			})
+		}
+	}
+	for backend, db := range testStores(t) {
+		if err := db.AppendMovieParts(context.Background(), 3999, -100, []int{1}); err == nil {
+			t.Errorf("%s: append to a missing item succeeded", backend)
+		}
+	}
+}
+
+func TestListRecent(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		want  string
+	}{
+		{name: "default limit returns everything newest first", limit: 0, want: "[4003 4002 4001]"},
+		{name: "limit", limit: 2, want: "[4003 4002]"},
+	}
+	for backend, db := range testStores(t) {
+		ctx := context.Background()
+		for _, kpID := range []int{4001, 4002, 4003} {
+			_ = db.UpsertWatchSeries(ctx, kpID, "s")
+			// Mongo keeps milliseconds
+			time.Sleep(2 * time.Millisecond)
+		}
+		for _, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				items, err := db.ListRecent(ctx, tt.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids := make([]int, 0, len(items))
+				for _, it := range items {
+					ids = append(ids, it.KPID)
+				}
+				if got := fmt.Sprint(ids); got != tt.want {
+					t.Errorf("ids = %s, want %s", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestDuplicateEpisodeKeepsRecentOrder(t *testing.T) {
+	for backend, db := range testStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			for _, kpID := range []int{4101, 4102} {
+				if _, err := db.UpsertSeriesEpisode(ctx, kpID, 1, 1, variant(10, "LostFilm")); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(2 * time.Millisecond)
+			}
+			before, _ := db.GetWatchItemByKPID(ctx, 4101)
+			added, err := db.UpsertSeriesEpisode(ctx, 4101, 1, 1, variant(10, "LostFilm"))
+			if err != nil || added {
+				t.Fatalf("re-post: added = %v, %v", added, err)
+			}
+			after, _ := db.GetWatchItemByKPID(ctx, 4101)
+			if !after.UpdatedAt.Equal(before.UpdatedAt) {
+				t.Errorf("updated_at moved from %v to %v", before.UpdatedAt, after.UpdatedAt)
+			}
+			items, err := db.ListRecent(ctx, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]int, 0, len(items))
+			for _, it := range items {
+				ids = append(ids, it.KPID)
+			}
+			if got := fmt.Sprint(ids); got != "[4102 4101]" {
+				t.Errorf("recent = %s, want [4102 4101]", got)
+			}
+		})
+	}
+}
+
+// seedItem stores item as is, bypassing the write paths that would upgrade
+// legacy fields.
+func seedItem(t *testing.T, db Store, item WatchItem) {
+	t.Helper()
+	switch db := db.(type) {
+	case *Memory:
+		db.mu.Lock()
+		db.items[item.KPID] = cloneWatchItem(&item)
+		db.mu.Unlock()
+	case *Mongo:
+		if _, err := db.col.InsertOne(context.Background(), item); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("can't seed %T", db)
+	}
+}
+
+func TestGetWatchItemVoices(t *testing.T) {
+	legacy := func(n int, voice string) Episode {
+		return Episode{Number: n, StorageChatID: -100, StorageMessageID: n, Voice: voice}
+	}
+	tests := []struct {
+		name       string
+		episodes   []Episode
+		voices     []Voice
+		wantVoices string
+		wantIDs    string // VoiceID of every variant
+	}{
+		{
+			name:       "legacy episodes without variants",
+			episodes:   []Episode{legacy(1, "LostFilm"), legacy(2, "HDRezka"), legacy(3, " lostfilm ")},
+			wantVoices: "[{1 HDRezka} {2 LostFilm}]",
+			wantIDs:    "[]",
+		},
+		{
+			name: "legacy and variant episodes share voices",
+			episodes: []Episode{
+				legacy(1, "LostFilm"),
+				{Number: 2, Variants: []EpisodeVariant{variant(2, "LostFilm"), variant(3, "Kubik")}},
+			},
+			wantVoices: "[{1 Kubik} {2 LostFilm}]",
+			wantIDs:    "[2 1]",
+		},
+		{
+			name:       "registered voices keep their IDs",
+			episodes:   []Episode{legacy(1, "HDRezka"), {Number: 2, Variants: []EpisodeVariant{variant(2, "LostFilm")}}},
+			voices:     []Voice{{ID: 4, Name: "LostFilm"}},
+			wantVoices: "[{4 LostFilm} {5 HDRezka}]",
+			wantIDs:    "[4]",
+		},
+	}
+	for backend, db := range testStores(t) {
+		for i, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				kpID := 6000 + i
+				seedItem(t, db, WatchItem{
+					KPID:    kpID,
+					Type:    "series",
+					Voices:  tt.voices,
+					Seasons: []Season{{Number: 1, Episodes: tt.episodes}},
+				})
+				item, err := db.GetWatchItemByKPID(ctx, kpID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := fmt.Sprint(item.Voices); got != tt.wantVoices {
+					t.Errorf("voices = %s, want %s", got, tt.wantVoices)
+				}
+				ids := []int{}
+				for _, ep := range item.Seasons[0].Episodes {
+					for _, v := range ep.Variants {
+						ids = append(ids, v.VoiceID)
+					}
+				}
+				if got := fmt.Sprint(ids); got != tt.wantIDs {
+					t.Errorf("variant voice IDs = %s, want %s", got, tt.wantIDs)
+				}
+			})
+		}
+	}
+}
+
+func TestVoiceIDsSurviveWrites(t *testing.T) {
+	legacy := func(n int, voice string) Episode {
+		return Episode{Number: n, StorageChatID: -100, StorageMessageID: n, Voice: voice}
+	}
+	tests := []struct {
+		name  string
+		write func(ctx context.Context, db Store, kpID int) error
+		want  string
+	}{
+		{
+			name: "delete the last episode of a voice",
+			write: func(ctx context.Context, db Store, kpID int) error {
+				return db.DeleteSeriesEpisode(ctx, kpID, 1, 1)
+			},
+			want: "[{1 HDRezka} {2 LostFilm}]",
+		},
+		{
+			name: "delete the season of a voice",
+			write: func(ctx context.Context, db Store, kpID int) error {
+				return db.DeleteSeason(ctx, kpID, 1)
+			},
+			want: "[{1 HDRezka} {2 LostFilm}]",
+		},
+		{
+			name: "add a voice that sorts first",
+			write: func(ctx context.Context, db Store, kpID int) error {
+				_, err := db.UpsertSeriesEpisode(ctx, kpID, 2, 2, variant(30, "AlexFilm"))
+				return err
+			},
+			want: "[{1 HDRezka} {2 LostFilm} {3 AlexFilm}]",
+		},
+	}
+	for backend, db := range testStores(t) {
+		for i, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				kpID := 6100 + i
+				seedItem(t, db, WatchItem{
+					KPID: kpID,
+					Type: "series",
+					Seasons: []Season{
+						{Number: 1, Episodes: []Episode{legacy(1, "HDRezka")}},
+						{Number: 2, Episodes: []Episode{legacy(1, "LostFilm")}},
+					},
+				})
+				if err := tt.write(ctx, db, kpID); err != nil {
+					t.Fatal(err)
+				}
+				item, err := db.GetWatchItemByKPID(ctx, kpID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := fmt.Sprint(item.Voices); got != tt.want {
+					t.Errorf("voices = %s, want %s", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestNoticeDeliveries(t *testing.T) {
+	now := time.Now().Truncate(time.Millisecond)
+	for backend, db := range testStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			eps := []NewEpisode{{Season: 1, Episode: 2, Voice: "A"}}
+			err := db.QueueNoticeDeliveries(ctx, []NoticeDelivery{
+				{UserID: 3, KPID: 7001, Episodes: eps, DueAt: now.Add(time.Minute)},
+				{UserID: 1, KPID: 7001, Episodes: eps, DueAt: now.Add(-2 * time.Second)},
+				{UserID: 2, KPID: 7001, Episodes: eps, DueAt: now.Add(-time.Second)},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []int64{}
+			for {
+				d, err := db.TakeNoticeDelivery(ctx, now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if d == nil {
+					break
+				}
+				if fmt.Sprint(d.Episodes) != fmt.Sprint(eps) {
+					t.Errorf("episodes = %v, want %v", d.Episodes, eps)
+				}
+				got = append(got, d.UserID)
+			}
+			if fmt.Sprint(got) != "[1 2]" {
+				t.Errorf("taken = %v, want [1 2]", got)
+			}
+			d, _ := db.TakeNoticeDelivery(ctx, now.Add(time.Minute))
+			if d == nil || d.UserID != 3 {
+				t.Errorf("later delivery = %+v, want user 3", d)
+			}
+		})
+	}
+}
+
+func TestSampleMissingMeta(t *testing.T) {
+	for backend, db := range testStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			for _, kpID := range []int{8001, 8002, 8003} {
+				_ = db.UpsertWatchSeries(ctx, kpID, "s")
+			}
+			if err := db.SetTitleMeta(ctx, 8002, TitleMeta{Title: "synced", SyncedAt: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+			items, err := db.SampleMissingMeta(ctx, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := map[int]bool{}
+			for _, it := range items {
+				ids[it.KPID] = true
+			}
+			if len(ids) != 2 || !ids[8001] || !ids[8003] {
+				t.Errorf("sampled %v, want 8001 and 8003", ids)
+			}
+			if items, _ := db.SampleMissingMeta(ctx, 1); len(items) != 1 {
+				t.Errorf("limit 1 sampled %d items", len(items))
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TitleMeta is a snapshot of the upstream card for a title. It is taken when
+// the title is added and re-synced by /refreshmeta, so listings don't have to
+// ask the API.
+type TitleMeta struct {
+	Title         string    `bson:"title,omitempty"`
+	OriginalTitle string    `bson:"original_title,omitempty"`
+	Year          int       `bson:"year,omitempty"`
+	PosterURL     string    `bson:"poster_url,omitempty"`
+	Genres        []string  `bson:"genres,omitempty"`
+	Rating        float64   `bson:"rating,omitempty"`
+	Overview      string    `bson:"overview,omitempty"`
+	IMDBID        string    `bson:"imdb_id,omitempty"`
+	Voices        []string  `bson:"voices,omitempty"`
+	SyncedAt      time.Time `bson:"synced_at"`
+}
+
+// SetTitleMeta replaces the metadata of an existing item. It doesn't touch
+// updated_at, a refresh is not a library change.
+func (m *Mongo) SetTitleMeta(ctx context.Context, kpID int, meta TitleMeta) error {
+	if m == nil {
+		return nil
+	}
+	res, err := m.col.UpdateOne(ctx,
+		bson.M{"kp_id": kpID},
+		bson.M{"$set": bson.M{"meta": meta}, "$inc": bson.M{"version": 1}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errors.New("item not found")
+	}
+	return nil
+}
+
+// SampleMissingMeta returns up to limit random items that have no metadata
+// yet. Picking at random keeps titles the API can't resolve from starving
+// the rest of a backfill.
+func (m *Mongo) SampleMissingMeta(ctx context.Context, limit int) ([]WatchItem, error) {
+	if m == nil {
+		return nil, errors.New("mongo not configured")
+	}
+	cur, err := m.col.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"meta": bson.M{"$exists": false}}}},
+		{{Key: "$sample", Value: bson.M{"size": limit}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	out := []WatchItem{}
+	if err := cur.All(ctx, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (m *Memory) SetTitleMeta(ctx context.Context, kpID int, meta TitleMeta) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.items[kpID]
+	if !ok {
+		return errors.New("item not found")
+	}
+	next := cloneWatchItem(item)
+	next.Meta = &meta
+	next.Meta.Genres = append([]string(nil), meta.Genres...)
+	next.Meta.Voices = append([]string(nil), meta.Voices...)
+	next.Version++
+	m.items[kpID] = next
+	return nil
+}
+
+func (m *Memory) SampleMissingMeta(ctx context.Context, limit int) ([]WatchItem, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []WatchItem{}
+	// map order is random
+	for _, item := range m.items {
+		if len(out) >= limit {
+			break
+		}
+		if item.Meta == nil {
+			out = append(out, *cloneWatchItem(item))
+		}
+	}
+	return out, nil
+}
@@ -3,19 +3,33 @@ package storage
 import (
 	"context"
 	"errors"
-	"sort"
-	"strings"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 type Mongo struct {
-	client *mongo.Client
-	col    *mongo.Collection
+	client           *mongo.Client
+	col              *mongo.Collection
+	autoSessions     *mongo.Collection
+	closeTargets     *mongo.Collection
+	progress         *mongo.Collection
+	subscriptions    *mongo.Collection
+	notices          *mongo.Collection
+	deliveries       *mongo.Collection
+	favorites        *mongo.Collection
+	requests         *mongo.Collection
+	captionTemplates *mongo.Collection
+	mediaGroups      *mongo.Collection
+	apiCache         *mongo.Collection
 }
 
 type WatchItem struct {
@@ -29,7 +43,10 @@ type WatchItem struct {
 	StorageMessageID  int                `bson:"storage_message_id,omitempty"`
 	StorageMessageIDs []int              `bson:"storage_message_ids,omitempty"`
 	Seasons           []Season           `bson:"seasons,omitempty"`
+	Voices            []Voice            `bson:"voices,omitempty"`
+	Meta              *TitleMeta         `bson:"meta,omitempty"`
 	UpdatedAt         time.Time          `bson:"updated_at"`
+	Version           int64              `bson:"version"`
 }
 
 type Season struct {
@@ -41,7 +58,11 @@ type EpisodeVariant struct {
 	StorageChatID    int64  `bson:"storage_chat_id"`
 	StorageMessageID int    `bson:"storage_message_id"`
 	Voice            string `bson:"voice,omitempty"`
+	VoiceID          int    `bson:"voice_id,omitempty"`
 	Quality          string `bson:"quality,omitempty"`
+	// FileSize (bytes) and Duration (seconds) come from the uploaded file.
+	FileSize int64 `bson:"file_size,omitempty"`
+	Duration int   `bson:"duration,omitempty"`
 }
 
 type Episode struct {
@@ -53,7 +74,35 @@ type Episode struct {
 	Variants         []EpisodeVariant `bson:"variants,omitempty"`
 }
 
+var (
+	sharedMu    sync.Mutex
+	sharedMongo *Mongo
+	sharedURI   string
+)
+
+// SharedMongo returns a process-wide Mongo for uri. The first call connects
+// and creates indexes, later calls on a warm instance reuse the pool.
+func SharedMongo(ctx context.Context, uri string) (*Mongo, error) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if sharedMongo != nil && sharedURI == uri {
+		return sharedMongo, nil
+	}
+	m, err := NewMongo(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	sharedMongo = m
+	sharedURI = uri
+	return m, nil
+}
+
 func NewMongo(ctx context.Context, uri string) (*Mongo, error) {
+	return newMongo(ctx, uri, "neomovies")
+}
+
+// newMongo lets tests run against a throwaway database.
+func newMongo(ctx context.Context, uri string, dbName string) (*Mongo, error) {
 	if uri == "" {
 		return nil, errors.New("MONGODB_URI is empty")
 	}
@@ -61,10 +110,106 @@ func NewMongo(ctx context.Context, uri string) (*Mongo, error) {
 	if err != nil {
 		return nil, err
 	}
-	db := client.Database("neomovies")
-	col := db.Collection("watch_items")
-	_, _ = col.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{bson.E{Key: "kp_id", Value: 1}}, Options: options.Index().SetUnique(true)})
-	return &Mongo{client: client, col: col}, nil
+	db := client.Database(dbName)
+	m := &Mongo{
+		client:           client,
+		col:              db.Collection("watch_items"),
+		autoSessions:     db.Collection("auto_sessions"),
+		closeTargets:     db.Collection("close_targets"),
+		progress:         db.Collection("watch_progress"),
+		subscriptions:    db.Collection("subscriptions"),
+		notices:          db.Collection("episode_notices"),
+		deliveries:       db.Collection("notice_deliveries"),
+		favorites:        db.Collection("favorites"),
+		requests:         db.Collection("content_requests"),
+		captionTemplates: db.Collection("caption_templates"),
+		mediaGroups:      db.Collection("media_groups"),
+		apiCache:         db.Collection("api_cache"),
+	}
+	if err := m.ensureIndexes(ctx); err != nil {
+		_ = client.Disconnect(ctx)
+		return nil, err
+	}
+	return m, nil
+}
+
+// ensureIndexes fails only for the unique kp_id index, which updateItem
+// relies on to detect upsert races. The others are logged and retried on the
+// next cold start.
+func (m *Mongo) ensureIndexes(ctx context.Context) error {
+	if _, err := m.col.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{bson.E{Key: "kp_id", Value: 1}}, Options: options.Index().SetUnique(true)}); err != nil {
+		return fmt.Errorf("watch_items kp_id index: %w", err)
+	}
+	var err error
+	_, err = m.col.Indexes().CreateMany(ctx, libraryIndexes())
+	logIndexError(m.col.Name(), err)
+	_, err = m.autoSessions.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{bson.E{Key: "chat_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{bson.E{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	logIndexError(m.autoSessions.Name(), err)
+	_, err = m.closeTargets.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{bson.E{Key: "chat_id", Value: 1}, bson.E{Key: "message_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{bson.E{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	logIndexError(m.closeTargets.Name(), err)
+	_, err = m.progress.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{bson.E{Key: "user_id", Value: 1}, bson.E{Key: "kp_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{bson.E{Key: "user_id", Value: 1}, bson.E{Key: "updated_at", Value: -1}}},
+	})
+	logIndexError(m.progress.Name(), err)
+	_, err = m.subscriptions.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{bson.E{Key: "user_id", Value: 1}, bson.E{Key: "kp_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{bson.E{Key: "kp_id", Value: 1}}},
+	})
+	logIndexError(m.subscriptions.Name(), err)
+	_, err = m.notices.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{bson.E{Key: "kp_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{bson.E{Key: "due_at", Value: 1}}},
+		{Keys: bson.D{bson.E{Key: "max_due_at", Value: 1}}},
+	})
+	logIndexError(m.notices.Name(), err)
+	_, err = m.deliveries.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{bson.E{Key: "due_at", Value: 1}}})
+	logIndexError(m.deliveries.Name(), err)
+	_, err = m.favorites.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{bson.E{Key: "user_id", Value: 1}, bson.E{Key: "kp_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{bson.E{Key: "user_id", Value: 1}, bson.E{Key: "created_at", Value: -1}}},
+	})
+	logIndexError(m.favorites.Name(), err)
+	_, err = m.requests.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{bson.E{Key: "kp_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{bson.E{Key: "status", Value: 1}, bson.E{Key: "votes", Value: -1}}},
+	})
+	logIndexError(m.requests.Name(), err)
+	_, err = m.captionTemplates.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{bson.E{Key: "chat_id", Value: 1}, bson.E{Key: "pattern", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	logIndexError(m.captionTemplates.Name(), err)
+	_, err = m.mediaGroups.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{bson.E{Key: "storage_chat_id", Value: 1}, bson.E{Key: "group_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{bson.E{Key: "due_at", Value: 1}}},
+	})
+	logIndexError(m.mediaGroups.Name(), err)
+	_, err = m.apiCache.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{bson.E{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	logIndexError(m.apiCache.Name(), err)
+	return nil
+}
+
+func logIndexError(collection string, err error) {
+	if err != nil {
+		log.Printf("mongo index error: %v (collection=%s)", err, collection)
+	}
+}
+
+func (m *Mongo) Ping(ctx context.Context) error {
+	if m == nil {
+		return errors.New("mongo not configured")
+	}
+	return m.client.Ping(ctx, readpref.Primary())
 }
 
 func (m *Mongo) GetWatchItemByKPID(ctx context.Context, kpID int) (*WatchItem, error) {
@@ -76,7 +221,38 @@ func (m *Mongo) GetWatchItemByKPID(ctx context.Context, kpID int) (*WatchItem, e
 	if err == mongo.ErrNoDocuments {
 		return nil, nil
 	}
-	return &item, err
+	if err != nil {
+		return nil, err
+	}
+	syncVoices(&item)
+	return &item, nil
+}
+
+// HasWatchItems reports which of kpIDs are in the library.
+func (m *Mongo) HasWatchItems(ctx context.Context, kpIDs []int) (map[int]bool, error) {
+	if m == nil {
+		return nil, errors.New("mongo not configured")
+	}
+	out := map[int]bool{}
+	if len(kpIDs) == 0 {
+		return out, nil
+	}
+	opts := options.Find().SetProjection(bson.M{"kp_id": 1})
+	cur, err := m.col.Find(ctx, bson.M{"kp_id": bson.M{"$in": kpIDs}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var it struct {
+			KPID int `bson:"kp_id"`
+		}
+		if err := cur.Decode(&it); err != nil {
+			continue
+		}
+		out[it.KPID] = true
+	}
+	return out, cur.Err()
 }
 
 func (m *Mongo) UpsertWatchMovie(ctx context.Context, kpID int, voice string, quality string, storageChatID int64, storageMessageIDs []int) error {
@@ -89,16 +265,19 @@ func (m *Mongo) UpsertWatchMovie(ctx context.Context, kpID int, voice string, qu
 	}
 	_, err := m.col.UpdateOne(ctx,
 		bson.M{"kp_id": kpID},
-		bson.M{"$set": bson.M{
-			"kp_id":               kpID,
-			"type":                "movie",
-			"voice":               voice,
-			"quality":             quality,
-			"storage_chat_id":     storageChatID,
-			"storage_message_id":  storageMessageID,
-			"storage_message_ids": storageMessageIDs,
-			"updated_at":          time.Now(),
-		}},
+		bson.M{
+			"$set": bson.M{
+				"kp_id":               kpID,
+				"type":                "movie",
+				"voice":               voice,
+				"quality":             quality,
+				"storage_chat_id":     storageChatID,
+				"storage_message_id":  storageMessageID,
+				"storage_message_ids": storageMessageIDs,
+				"updated_at":          time.Now(),
+			},
+			"$inc": bson.M{"version": 1},
+		},
 		options.Update().SetUpsert(true),
 	)
 	return err
@@ -111,54 +290,20 @@ func (m *Mongo) AppendMovieParts(ctx context.Context, kpID int, storageChatID in
 	if kpID <= 0 || storageChatID == 0 || len(storageMessageIDs) == 0 {
 		return nil
 	}
-	item, err := m.GetWatchItemByKPID(ctx, kpID)
-	if err != nil {
-		return err
-	}
-	if item == nil {
-		return errors.New("item not found")
-	}
-	if item.Type != "movie" {
-		return errors.New("item is not movie")
-	}
-	if item.StorageChatID != 0 && item.StorageChatID != storageChatID {
-		return errors.New("storage chat id mismatch")
-	}
-	item.StorageChatID = storageChatID
-	ids := map[int]struct{}{}
-	for _, id := range item.StorageMessageIDs {
-		if id > 0 {
-			ids[id] = struct{}{}
+	return m.updateItem(ctx, kpID, false, func(item *WatchItem) (bson.M, error) {
+		if item == nil {
+			return nil, errors.New("item not found")
 		}
-	}
-	if item.StorageMessageID > 0 {
-		ids[item.StorageMessageID] = struct{}{}
-	}
-	for _, id := range storageMessageIDs {
-		if id > 0 {
-			ids[id] = struct{}{}
+		if err := mergeMovieParts(item, storageChatID, storageMessageIDs); err != nil {
+			return nil, err
 		}
-	}
-	merged := make([]int, 0, len(ids))
-	for id := range ids {
-		merged = append(merged, id)
-	}
-	sort.Ints(merged)
-	item.StorageMessageIDs = merged
-	if len(merged) > 0 {
-		item.StorageMessageID = merged[0]
-	}
-	item.UpdatedAt = time.Now()
-	_, err = m.col.UpdateOne(ctx,
-		bson.M{"kp_id": kpID},
-		bson.M{"$set": bson.M{
+		return bson.M{
 			"storage_chat_id":     item.StorageChatID,
 			"storage_message_id":  item.StorageMessageID,
 			"storage_message_ids": item.StorageMessageIDs,
 			"updated_at":          item.UpdatedAt,
-		}},
-	)
-	return err
+		}, nil
+	})
 }
 
 func (m *Mongo) UpsertWatchSeries(ctx context.Context, kpID int, title string) error {
@@ -167,193 +312,157 @@ func (m *Mongo) UpsertWatchSeries(ctx context.Context, kpID int, title string) e
 	}
 	_, err := m.col.UpdateOne(ctx,
 		bson.M{"kp_id": kpID},
-		bson.M{"$set": bson.M{
-			"kp_id":      kpID,
-			"type":       "series",
-			"title":      title,
-			"updated_at": time.Now(),
-		}},
+		bson.M{
+			"$set": bson.M{
+				"kp_id":      kpID,
+				"type":       "series",
+				"title":      title,
+				"updated_at": time.Now(),
+			},
+			"$inc": bson.M{"version": 1},
+		},
 		options.Update().SetUpsert(true),
 	)
 	return err
 }
 
-func (m *Mongo) UpsertSeriesEpisode(ctx context.Context, kpID int, seasonNum int, episodeNum int, voice string, quality string, storageChatID int64, storageMessageID int) error {
+func (m *Mongo) UpsertSeriesEpisode(ctx context.Context, kpID int, seasonNum int, episodeNum int, v EpisodeVariant) (bool, error) {
 	if m == nil {
-		return nil
-	}
-
-	item, err := m.GetWatchItemByKPID(ctx, kpID)
-	if err != nil {
-		return err
-	}
-	if item == nil {
-		item = &WatchItem{KPID: kpID, Type: "series"}
-	}
-	item.Type = "series"
-	if item.Seasons == nil {
-		item.Seasons = []Season{}
+		return false, nil
 	}
-
-	seasonIdx := -1
-	for i := range item.Seasons {
-		if item.Seasons[i].Number == seasonNum {
-			seasonIdx = i
-			break
+	added := false
+	err := m.updateItem(ctx, kpID, true, func(item *WatchItem) (bson.M, error) {
+		if item == nil {
+			item = &WatchItem{KPID: kpID, Type: "series"}
 		}
-	}
-	if seasonIdx == -1 {
-		item.Seasons = append(item.Seasons, Season{Number: seasonNum, Episodes: []Episode{}})
-		seasonIdx = len(item.Seasons) - 1
-	}
-
-	eps := item.Seasons[seasonIdx].Episodes
-	epIdx := -1
-	for i := range eps {
-		if eps[i].Number == episodeNum {
-			epIdx = i
-			break
+		added = mergeSeriesEpisode(item, seasonNum, episodeNum, v)
+		if !added {
+			return nil, nil
 		}
-	}
-	newVar := EpisodeVariant{
-		StorageChatID:    storageChatID,
-		StorageMessageID: storageMessageID,
-		Voice:            strings.TrimSpace(voice),
-		Quality:          strings.TrimSpace(quality),
-	}
-	newEp := Episode{
-		Number:           episodeNum,
-		StorageChatID:    storageChatID,
-		StorageMessageID: storageMessageID,
-		Voice:            newVar.Voice,
-		Quality:          newVar.Quality,
-		Variants:         []EpisodeVariant{newVar},
-	}
-	if epIdx == -1 {
-		eps = append(eps, newEp)
-	} else {
-		ep := eps[epIdx]
-		if len(ep.Variants) == 0 {
-			if ep.StorageChatID != 0 && ep.StorageMessageID != 0 {
-				ep.Variants = append(ep.Variants, EpisodeVariant{
-					StorageChatID:    ep.StorageChatID,
-					StorageMessageID: ep.StorageMessageID,
-					Voice:            strings.TrimSpace(ep.Voice),
-					Quality:          strings.TrimSpace(ep.Quality),
-				})
-			}
-		}
-		dup := false
-		for _, v := range ep.Variants {
-			if v.StorageChatID == newVar.StorageChatID &&
-				v.StorageMessageID == newVar.StorageMessageID &&
-				strings.EqualFold(strings.TrimSpace(v.Voice), newVar.Voice) &&
-				strings.EqualFold(strings.TrimSpace(v.Quality), newVar.Quality) {
-				dup = true
-				break
-			}
-		}
-		if !dup {
-			ep.Variants = append(ep.Variants, newVar)
-		}
-		// Keep legacy fields in sync with first variant
-		if len(ep.Variants) > 0 {
-			ep.StorageChatID = ep.Variants[0].StorageChatID
-			ep.StorageMessageID = ep.Variants[0].StorageMessageID
-			ep.Voice = ep.Variants[0].Voice
-			ep.Quality = ep.Variants[0].Quality
-		}
-		eps[epIdx] = ep
-	}
-	sort.Slice(eps, func(i, j int) bool { return eps[i].Number < eps[j].Number })
-	item.Seasons[seasonIdx].Episodes = eps
-	item.UpdatedAt = time.Now()
-
-	sort.Slice(item.Seasons, func(i, j int) bool { return item.Seasons[i].Number < item.Seasons[j].Number })
-
-	_, err = m.col.UpdateOne(ctx,
-		bson.M{"kp_id": kpID},
-		bson.M{"$set": bson.M{
+		return bson.M{
 			"kp_id":      item.KPID,
 			"type":       item.Type,
 			"title":      item.Title,
 			"seasons":    item.Seasons,
+			"voices":     item.Voices,
 			"updated_at": item.UpdatedAt,
-		}},
-		options.Update().SetUpsert(true),
-	)
-	return err
+		}, nil
+	})
+	return added, err
 }
 
 func (m *Mongo) DeleteSeriesEpisode(ctx context.Context, kpID int, seasonNum int, episodeNum int) error {
 	if m == nil {
 		return nil
 	}
-	item, err := m.GetWatchItemByKPID(ctx, kpID)
-	if err != nil || item == nil {
-		return err
-	}
-	updated := false
-	for si := range item.Seasons {
-		if item.Seasons[si].Number != seasonNum {
-			continue
+	return m.updateItem(ctx, kpID, false, func(item *WatchItem) (bson.M, error) {
+		if item == nil || !removeSeriesEpisode(item, seasonNum, episodeNum) {
+			return nil, nil
 		}
-		eps := item.Seasons[si].Episodes
-		out := make([]Episode, 0, len(eps))
-		for _, ep := range eps {
-			if ep.Number == episodeNum {
-				updated = true
-				continue
-			}
-			out = append(out, ep)
-		}
-		item.Seasons[si].Episodes = out
-		break
-	}
-	if !updated {
-		return nil
-	}
-	item.UpdatedAt = time.Now()
-	_, err = m.col.UpdateOne(ctx,
-		bson.M{"kp_id": kpID},
-		bson.M{"$set": bson.M{
+		// voices holds the IDs read back for a legacy item, so the
+		// remaining voices keep them once their episodes are gone
+		return bson.M{
 			"seasons":    item.Seasons,
+			"voices":     item.Voices,
 			"updated_at": item.UpdatedAt,
-		}},
-	)
-	return err
+		}, nil
+	})
 }
 
 func (m *Mongo) DeleteSeason(ctx context.Context, kpID int, seasonNum int) error {
 	if m == nil {
 		return nil
 	}
-	item, err := m.GetWatchItemByKPID(ctx, kpID)
-	if err != nil || item == nil {
-		return err
+	return m.updateItem(ctx, kpID, false, func(item *WatchItem) (bson.M, error) {
+		if item == nil || !removeSeason(item, seasonNum) {
+			return nil, nil
+		}
+		// voices holds the IDs read back for a legacy item, so the
+		// remaining voices keep them once their episodes are gone
+		return bson.M{
+			"seasons":    item.Seasons,
+			"voices":     item.Voices,
+			"updated_at": item.UpdatedAt,
+		}, nil
+	})
+}
+
+// maxUpdateAttempts bounds the optimistic-locking retries in updateItem.
+const maxUpdateAttempts = 10
+
+var errUpdateConflict = errors.New("watch item update conflict")
+
+// updateBackoff is the base delay between updateItem attempts; it doubles per
+// attempt up to maxUpdateBackoff and is jittered so that racing writers
+// don't retry in lockstep.
+const (
+	updateBackoff    = 5 * time.Millisecond
+	maxUpdateBackoff = 200 * time.Millisecond
+)
+
+// waitRetry sleeps before retry attempt (1-based) or returns ctx's error.
+func waitRetry(ctx context.Context, attempt int) error {
+	d := min(updateBackoff<<(attempt-1), maxUpdateBackoff)
+	d = d/2 + rand.N(d/2+1)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	out := make([]Season, 0, len(item.Seasons))
-	removed := false
-	for _, s := range item.Seasons {
-		if s.Number == seasonNum {
-			removed = true
+}
+
+// updateItem does a read-modify-write of one watch item with optimistic
+// locking. mutate gets the current item (nil if missing) and returns the
+// fields to $set, or nil to skip the write. The write only lands if the
+// version is unchanged since the read; otherwise the item is re-read and
+// mutate runs again, so concurrent upserts never drop each other's changes.
+func (m *Mongo) updateItem(ctx context.Context, kpID int, upsert bool, mutate func(item *WatchItem) (bson.M, error)) error {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		if attempt > 0 {
+			if err := waitRetry(ctx, attempt); err != nil {
+				return err
+			}
+		}
+		item, err := m.GetWatchItemByKPID(ctx, kpID)
+		if err != nil {
+			return err
+		}
+		version := int64(0)
+		if item != nil {
+			version = item.Version
+		} else if !upsert {
+			_, err := mutate(nil)
+			return err
+		}
+		set, err := mutate(item)
+		if err != nil || set == nil {
+			return err
+		}
+		filter := bson.M{"kp_id": kpID, "version": version}
+		if version == 0 {
+			// documents written before versioning have no version field
+			filter["version"] = bson.M{"$in": bson.A{0, nil}}
+		}
+		res, err := m.col.UpdateOne(ctx, filter,
+			bson.M{"$set": set, "$inc": bson.M{"version": 1}},
+			options.Update().SetUpsert(upsert),
+		)
+		if mongo.IsDuplicateKeyError(err) {
+			// lost an upsert race: another writer created or bumped the item
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 && res.UpsertedCount == 0 {
 			continue
 		}
-		out = append(out, s)
-	}
-	if !removed {
 		return nil
 	}
-	item.Seasons = out
-	item.UpdatedAt = time.Now()
-	_, err = m.col.UpdateOne(ctx,
-		bson.M{"kp_id": kpID},
-		bson.M{"$set": bson.M{
-			"seasons":    item.Seasons,
-			"updated_at": item.UpdatedAt,
-		}},
-	)
-	return err
+	return errUpdateConflict
 }
 
 func (m *Mongo) DeleteByKPID(ctx context.Context, kpID int) error {
@@ -368,12 +477,7 @@ func (m *Mongo) ListRecent(ctx context.Context, limit int) ([]WatchItem, error)
 	if m == nil {
 		return nil, errors.New("mongo not configured")
 	}
-	if limit <= 0 {
-		limit = 200
-	}
-	if limit > 500 {
-		limit = 500
-	}
+	limit = clampListLimit(limit)
 	opts := options.Find().SetSort(bson.D{bson.E{Key: "updated_at", Value: -1}}).SetLimit(int64(limit))
 	cur, err := m.col.Find(ctx, bson.M{}, opts)
 	if err != nil {
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestMongo connects to MONGODB_TEST_URI, or returns nil when it is
+// unset. Each call gets a throwaway database that is dropped when the test
+// ends.
+func openTestMongo(t *testing.T) *Mongo {
+	t.Helper()
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	name := fmt.Sprintf("neomovies_test_%d", time.Now().UnixNano())
+	m, err := newMongo(ctx, uri, name)
+	if err != nil {
+		t.Fatalf("mongo: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = m.client.Database(name).Drop(ctx)
+		_ = m.client.Disconnect(ctx)
+	})
+	return m
+}
+
+func requireTestMongo(t *testing.T) *Mongo {
+	t.Helper()
+	m := openTestMongo(t)
+	if m == nil {
+		t.Skip("MONGODB_TEST_URI not set")
+	}
+	return m
+}
+
+// concurrentWriters is enough to make updateItem retry on every run.
+const concurrentWriters = 16
+
+func TestMongoConcurrentEpisodeUpserts(t *testing.T) {
+	m := requireTestMongo(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	const kpID = 5001
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrentWriters)
+	for i := 1; i <= concurrentWriters; i++ {
+		wg.Add(1)
+		go func(ep int) {
+			defer wg.Done()
+			// the first writers race on creating the document
+			_, err := m.UpsertSeriesEpisode(ctx, kpID, 1, ep, variant(ep, "LostFilm"))
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("upsert: %v", err)
+		}
+	}
+
+	item, err := m.GetWatchItemByKPID(ctx, kpID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(item.Seasons) != 1 || len(item.Seasons[0].Episodes) != concurrentWriters {
+		t.Fatalf("layout = %q, want %d episodes in one season", layout(item), concurrentWriters)
+	}
+	for i, ep := range item.Seasons[0].Episodes {
+		if ep.Number != i+1 {
+			t.Fatalf("episode %d is %d, an upsert was lost: %q", i, ep.Number, layout(item))
+		}
+	}
+}
+
+func TestMongoConcurrentMovieParts(t *testing.T) {
+	m := requireTestMongo(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	const kpID = 5002
+	if err := m.UpsertWatchMovie(ctx, kpID, "Dub", "1080p", -100, []int{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrentWriters)
+	for i := 0; i < concurrentWriters; i++ {
+		wg.Add(1)
+		go func(part int) {
+			defer wg.Done()
+			errs <- m.AppendMovieParts(ctx, kpID, -100, []int{part})
+		}(i + 2)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	item, err := m.GetWatchItemByKPID(ctx, kpID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(item.StorageMessageIDs) != concurrentWriters+1 {
+		t.Fatalf("parts = %v, want 1..%d", item.StorageMessageIDs, concurrentWriters+1)
+	}
+	for i, id := range item.StorageMessageIDs {
+		if id != i+1 {
+			t.Fatalf("parts = %v, a part was lost", item.StorageMessageIDs)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// WatchProgress is the last thing a Telegram user opened for one title.
+// Season and Episode are zero for movies.
+type WatchProgress struct {
+	UserID    int64     `bson:"user_id"`
+	KPID      int       `bson:"kp_id"`
+	Season    int       `bson:"season,omitempty"`
+	Episode   int       `bson:"episode,omitempty"`
+	VoiceID   int       `bson:"voice_id"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+type userTitleKey struct {
+	userID int64
+	kpID   int
+}
+
+func (m *Mongo) SaveProgress(ctx context.Context, p WatchProgress) error {
+	if m == nil {
+		return nil
+	}
+	p.UpdatedAt = time.Now()
+	_, err := m.progress.ReplaceOne(ctx,
+		bson.M{"user_id": p.UserID, "kp_id": p.KPID},
+		p,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (m *Mongo) GetProgress(ctx context.Context, userID int64, kpID int) (*WatchProgress, error) {
+	if m == nil {
+		return nil, errors.New("mongo not configured")
+	}
+	var p WatchProgress
+	err := m.progress.FindOne(ctx, bson.M{"user_id": userID, "kp_id": kpID}).Decode(&p)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (m *Mongo) RecentProgress(ctx context.Context, userID int64, limit int) ([]WatchProgress, error) {
+	if m == nil {
+		return nil, errors.New("mongo not configured")
+	}
+	limit = clampListLimit(limit)
+	opts := options.Find().SetSort(bson.D{bson.E{Key: "updated_at", Value: -1}}).SetLimit(int64(limit))
+	cur, err := m.progress.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	out := make([]WatchProgress, 0, limit)
+	for cur.Next(ctx) {
+		var p WatchProgress
+		if err := cur.Decode(&p); err != nil {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out, cur.Err()
+}
+
+func (m *Memory) SaveProgress(ctx context.Context, p WatchProgress) error {
+	if m == nil {
+		return nil
+	}
+	p.UpdatedAt = time.Now()
+	m.mu.Lock()
+	m.progress[userTitleKey{userID: p.UserID, kpID: p.KPID}] = p
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) GetProgress(ctx context.Context, userID int64, kpID int) (*WatchProgress, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.progress[userTitleKey{userID: userID, kpID: kpID}]
+	if !ok {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+func (m *Memory) RecentProgress(ctx context.Context, userID int64, limit int) ([]WatchProgress, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	limit = clampListLimit(limit)
+	m.mu.Lock()
+	out := []WatchProgress{}
+	for k, p := range m.progress {
+		if k.userID == userID {
+			out = append(out, p)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].UpdatedAt.After(out[j].UpdatedAt) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
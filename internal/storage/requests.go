@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ContentRequest is a title users asked to be added to the library. Each
+// user counts once; Votes is len(Voters).
+type ContentRequest struct {
+	KPID      int       `bson:"kp_id"`
+	Title     string    `bson:"title,omitempty"`
+	Voters    []int64   `bson:"voters"`
+	Votes     int       `bson:"votes"`
+	Status    string    `bson:"status"`
+	CreatedAt time.Time `bson:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at"`
+	DoneAt    time.Time `bson:"done_at,omitempty"`
+}
+
+const (
+	RequestOpen = "open"
+	RequestDone = "done"
+)
+
+// AddContentRequest records userID's vote for kpID and returns the vote
+// count. added is false if the user had already voted for the open request.
+// Voting for a request that was marked done reopens it.
+func (m *Mongo) AddContentRequest(ctx context.Context, kpID int, title string, userID int64) (int, bool, error) {
+	if m == nil {
+		return 0, false, errors.New("mongo not configured")
+	}
+	now := time.Now()
+	// Reopen a finished request with a fresh voter list first, so the vote
+	// below counts and the requesters get notified again.
+	_, err := m.requests.UpdateOne(ctx,
+		bson.M{"kp_id": kpID, "status": RequestDone},
+		bson.M{"$set": bson.M{"status": RequestOpen, "voters": bson.A{}, "votes": 0, "updated_at": now}},
+	)
+	if err != nil {
+		return 0, false, err
+	}
+	var req ContentRequest
+	err = m.requests.FindOneAndUpdate(ctx,
+		bson.M{"kp_id": kpID, "voters": bson.M{"$ne": userID}},
+		bson.M{
+			"$addToSet":    bson.M{"voters": userID},
+			"$inc":         bson.M{"votes": 1},
+			"$set":         bson.M{"title": title, "status": RequestOpen, "updated_at": now},
+			"$setOnInsert": bson.M{"created_at": now},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&req)
+	if mongo.IsDuplicateKeyError(err) {
+		// the request exists and the filter did not match: already voted
+		if err := m.requests.FindOne(ctx, bson.M{"kp_id": kpID}).Decode(&req); err != nil {
+			return 0, false, err
+		}
+		return req.Votes, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return req.Votes, true, nil
+}
+
+// ListContentRequests returns open requests, most votes first.
+func (m *Mongo) ListContentRequests(ctx context.Context, limit int) ([]ContentRequest, error) {
+	if m == nil {
+		return nil, errors.New("mongo not configured")
+	}
+	limit = clampListLimit(limit)
+	opts := options.Find().
+		SetSort(bson.D{bson.E{Key: "votes", Value: -1}, bson.E{Key: "created_at", Value: 1}}).
+		SetLimit(int64(limit))
+	cur, err := m.requests.Find(ctx, bson.M{"status": RequestOpen}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	out := make([]ContentRequest, 0, limit)
+	for cur.Next(ctx) {
+		var req ContentRequest
+		if err := cur.Decode(&req); err != nil {
+			continue
+		}
+		out = append(out, req)
+	}
+	return out, cur.Err()
+}
+
+// CompleteContentRequest marks the open request for kpID as done and returns
+// it, or nil if there was no open request.
+func (m *Mongo) CompleteContentRequest(ctx context.Context, kpID int) (*ContentRequest, error) {
+	if m == nil {
+		return nil, nil
+	}
+	now := time.Now()
+	var req ContentRequest
+	err := m.requests.FindOneAndUpdate(ctx,
+		bson.M{"kp_id": kpID, "status": RequestOpen},
+		bson.M{"$set": bson.M{"status": RequestDone, "done_at": now, "updated_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&req)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (m *Memory) AddContentRequest(ctx context.Context, kpID int, title string, userID int64) (int, bool, error) {
+	if m == nil {
+		return 0, false, errors.New("memory store not configured")
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	req, ok := m.requests[kpID]
+	if !ok {
+		req = &ContentRequest{KPID: kpID, CreatedAt: now}
+		m.requests[kpID] = req
+	}
+	if req.Status == RequestDone {
+		req.Voters = nil
+		req.Votes = 0
+	}
+	req.Status = RequestOpen
+	for _, id := range req.Voters {
+		if id == userID {
+			return req.Votes, false, nil
+		}
+	}
+	req.Voters = append(req.Voters, userID)
+	req.Votes = len(req.Voters)
+	req.Title = title
+	req.UpdatedAt = now
+	return req.Votes, true, nil
+}
+
+func (m *Memory) ListContentRequests(ctx context.Context, limit int) ([]ContentRequest, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	limit = clampListLimit(limit)
+	m.mu.Lock()
+	out := []ContentRequest{}
+	for _, req := range m.requests {
+		if req.Status == RequestOpen {
+			cp := *req
+			cp.Voters = append([]int64(nil), req.Voters...)
+			out = append(out, cp)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Votes != out[j].Votes {
+			return out[i].Votes > out[j].Votes
+		}
+		return out[i].CreatedAt.Before(out[j].CreatedAt)
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (m *Memory) CompleteContentRequest(ctx context.Context, kpID int) (*ContentRequest, error) {
+	if m == nil {
+		return nil, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	req, ok := m.requests[kpID]
+	if !ok || req.Status != RequestOpen {
+		return nil, nil
+	}
+	now := time.Now()
+	req.Status = RequestDone
+	req.DoneAt = now
+	req.UpdatedAt = now
+	cp := *req
+	cp.Voters = append([]int64(nil), req.Voters...)
+	return &cp, nil
+}
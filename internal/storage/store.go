@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Store is the persistence API used by the webhook handlers.
+// Mongo is the production implementation, Memory is used for local runs.
+type Store interface {
+	Ping(ctx context.Context) error
+
+	GetWatchItemByKPID(ctx context.Context, kpID int) (*WatchItem, error)
+	UpsertWatchMovie(ctx context.Context, kpID int, voice string, quality string, storageChatID int64, storageMessageIDs []int) error
+	AppendMovieParts(ctx context.Context, kpID int, storageChatID int64, storageMessageIDs []int) error
+	UpsertWatchSeries(ctx context.Context, kpID int, title string) error
+	// UpsertSeriesEpisode reports whether the episode or its variant is new.
+	UpsertSeriesEpisode(ctx context.Context, kpID int, seasonNum int, episodeNum int, v EpisodeVariant) (bool, error)
+	DeleteSeriesEpisode(ctx context.Context, kpID int, seasonNum int, episodeNum int) error
+	DeleteSeason(ctx context.Context, kpID int, seasonNum int) error
+	DeleteByKPID(ctx context.Context, kpID int) error
+	ListRecent(ctx context.Context, limit int) ([]WatchItem, error)
+	// QueryLibrary returns ErrBadCursor for a cursor from another sort.
+	QueryLibrary(ctx context.Context, q LibraryQuery) (*LibraryResult, error)
+	HasWatchItems(ctx context.Context, kpIDs []int) (map[int]bool, error)
+	SetTitleMeta(ctx context.Context, kpID int, meta TitleMeta) error
+	SampleMissingMeta(ctx context.Context, limit int) ([]WatchItem, error)
+
+	StartAutoSession(ctx context.Context, chatID int64, kpID int, ttl time.Duration) error
+	GetAutoSession(ctx context.Context, chatID int64) (*AutoSession, error)
+	RecordAutoEpisode(ctx context.Context, chatID int64, seasonNum int, episodeNum int, ttl time.Duration) error
+	StopAutoSession(ctx context.Context, chatID int64) error
+
+	SaveCloseTargets(ctx context.Context, chatID int64, messageID int, targets []int, ttl time.Duration) error
+	TakeCloseTargets(ctx context.Context, chatID int64, messageID int) ([]int, error)
+
+	SaveProgress(ctx context.Context, p WatchProgress) error
+	GetProgress(ctx context.Context, userID int64, kpID int) (*WatchProgress, error)
+	RecentProgress(ctx context.Context, userID int64, limit int) ([]WatchProgress, error)
+
+	Subscribe(ctx context.Context, userID int64, kpID int) error
+	Unsubscribe(ctx context.Context, userID int64, kpID int) error
+	IsSubscribed(ctx context.Context, userID int64, kpID int) (bool, error)
+	Subscribers(ctx context.Context, kpID int) ([]int64, error)
+	QueueEpisodeNotice(ctx context.Context, kpID int, ep NewEpisode, delay time.Duration, maxDelay time.Duration) error
+	TakeDueNotices(ctx context.Context, now time.Time) ([]EpisodeNotice, error)
+	QueueNoticeDeliveries(ctx context.Context, ds []NoticeDelivery) error
+	TakeNoticeDelivery(ctx context.Context, now time.Time) (*NoticeDelivery, error)
+
+	AddFavorite(ctx context.Context, f Favorite) error
+	RemoveFavorite(ctx context.Context, userID int64, kpID int) error
+	IsFavorite(ctx context.Context, userID int64, kpID int) (bool, error)
+	ListFavorites(ctx context.Context, userID int64, offset int, limit int) ([]Favorite, int, error)
+
+	AddContentRequest(ctx context.Context, kpID int, title string, userID int64) (int, bool, error)
+	ListContentRequests(ctx context.Context, limit int) ([]ContentRequest, error)
+	CompleteContentRequest(ctx context.Context, kpID int) (*ContentRequest, error)
+
+	AddCaptionTemplate(ctx context.Context, chatID int64, pattern string) error
+	DeleteCaptionTemplate(ctx context.Context, chatID int64, pattern string) error
+	ListCaptionTemplates(ctx context.Context, chatID int64) ([]CaptionTemplate, error)
+
+	AddMediaGroupPart(ctx context.Context, storageChatID int64, groupID string, reportChatID int64, part MediaGroupPart, delay time.Duration) error
+	TakeDueMediaGroups(ctx context.Context, now time.Time) ([]MediaGroup, error)
+
+	// GetCachedResponse and PutCachedResponse back neomovies.Cached.
+	GetCachedResponse(ctx context.Context, key string) ([]byte, bool, error)
+	PutCachedResponse(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+var (
+	_ Store = (*Mongo)(nil)
+	_ Store = (*Memory)(nil)
+)
+
+func clampListLimit(limit int) int {
+	if limit <= 0 {
+		limit = 200
+	}
+	if limit > 500 {
+		limit = 500
+	}
+	return limit
+}
+
+// mergeMovieParts adds storageMessageIDs to a movie item, keeping ids unique
+// and sorted. The first id is mirrored into the legacy StorageMessageID field.
+func mergeMovieParts(item *WatchItem, storageChatID int64, storageMessageIDs []int) error {
+	if item.Type != "movie" {
+		return errors.New("item is not movie")
+	}
+	if item.StorageChatID != 0 && item.StorageChatID != storageChatID {
+		return errors.New("storage chat id mismatch")
+	}
+	item.StorageChatID = storageChatID
+	ids := map[int]struct{}{}
+	for _, id := range item.StorageMessageIDs {
+		if id > 0 {
+			ids[id] = struct{}{}
+		}
+	}
+	if item.StorageMessageID > 0 {
+		ids[item.StorageMessageID] = struct{}{}
+	}
+	for _, id := range storageMessageIDs {
+		if id > 0 {
+			ids[id] = struct{}{}
+		}
+	}
+	merged := make([]int, 0, len(ids))
+	for id := range ids {
+		merged = append(merged, id)
+	}
+	sort.Ints(merged)
+	item.StorageMessageIDs = merged
+	if len(merged) > 0 {
+		item.StorageMessageID = merged[0]
+	}
+	item.UpdatedAt = time.Now()
+	return nil
+}
+
+// mergeSeriesEpisode adds an episode variant to item and reports whether it
+// was new. Duplicate variants are ignored, seasons and episodes are kept
+// sorted and the legacy episode fields follow the first variant.
+func mergeSeriesEpisode(item *WatchItem, seasonNum int, episodeNum int, v EpisodeVariant) bool {
+	item.Type = "series"
+	if item.Seasons == nil {
+		item.Seasons = []Season{}
+	}
+
+	seasonIdx := -1
+	for i := range item.Seasons {
+		if item.Seasons[i].Number == seasonNum {
+			seasonIdx = i
+			break
+		}
+	}
+	if seasonIdx == -1 {
+		item.Seasons = append(item.Seasons, Season{Number: seasonNum, Episodes: []Episode{}})
+		seasonIdx = len(item.Seasons) - 1
+	}
+
+	eps := item.Seasons[seasonIdx].Episodes
+	epIdx := -1
+	for i := range eps {
+		if eps[i].Number == episodeNum {
+			epIdx = i
+			break
+		}
+	}
+	newVar := v
+	newVar.Voice = strings.TrimSpace(v.Voice)
+	newVar.Quality = strings.TrimSpace(v.Quality)
+	newVar.VoiceID = 0
+	newEp := Episode{
+		Number:           episodeNum,
+		StorageChatID:    newVar.StorageChatID,
+		StorageMessageID: newVar.StorageMessageID,
+		Voice:            newVar.Voice,
+		Quality:          newVar.Quality,
+		Variants:         []EpisodeVariant{newVar},
+	}
+	added := true
+	if epIdx == -1 {
+		eps = append(eps, newEp)
+	} else {
+		ep := eps[epIdx]
+		if len(ep.Variants) == 0 {
+			if ep.StorageChatID != 0 && ep.StorageMessageID != 0 {
+				ep.Variants = append(ep.Variants, EpisodeVariant{
+					StorageChatID:    ep.StorageChatID,
+					StorageMessageID: ep.StorageMessageID,
+					Voice:            strings.TrimSpace(ep.Voice),
+					Quality:          strings.TrimSpace(ep.Quality),
+				})
+			}
+		}
+		dup := false
+		for _, v := range ep.Variants {
+			if v.StorageChatID == newVar.StorageChatID &&
+				v.StorageMessageID == newVar.StorageMessageID &&
+				strings.EqualFold(strings.TrimSpace(v.Voice), newVar.Voice) &&
+				strings.EqualFold(strings.TrimSpace(v.Quality), newVar.Quality) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			ep.Variants = append(ep.Variants, newVar)
+		}
+		added = !dup
+		// Keep legacy fields in sync with first variant
+		if len(ep.Variants) > 0 {
+			ep.StorageChatID = ep.Variants[0].StorageChatID
+			ep.StorageMessageID = ep.Variants[0].StorageMessageID
+			ep.Voice = ep.Variants[0].Voice
+			ep.Quality = ep.Variants[0].Quality
+		}
+		eps[epIdx] = ep
+	}
+	sort.Slice(eps, func(i, j int) bool { return eps[i].Number < eps[j].Number })
+	item.Seasons[seasonIdx].Episodes = eps
+	if added {
+		// a re-posted duplicate must not bump the item in "recent"
+		item.UpdatedAt = time.Now()
+	}
+
+	sort.Slice(item.Seasons, func(i, j int) bool { return item.Seasons[i].Number < item.Seasons[j].Number })
+	syncVoices(item)
+	return added
+}
+
+// removeSeriesEpisode drops an episode from a season and reports whether
+// anything changed.
+func removeSeriesEpisode(item *WatchItem, seasonNum int, episodeNum int) bool {
+	updated := false
+	for si := range item.Seasons {
+		if item.Seasons[si].Number != seasonNum {
+			continue
+		}
+		eps := item.Seasons[si].Episodes
+		out := make([]Episode, 0, len(eps))
+		for _, ep := range eps {
+			if ep.Number == episodeNum {
+				updated = true
+				continue
+			}
+			out = append(out, ep)
+		}
+		item.Seasons[si].Episodes = out
+		break
+	}
+	if updated {
+		item.UpdatedAt = time.Now()
+	}
+	return updated
+}
+
+// removeSeason drops a whole season and reports whether anything changed.
+func removeSeason(item *WatchItem, seasonNum int) bool {
+	out := make([]Season, 0, len(item.Seasons))
+	removed := false
+	for _, s := range item.Seasons {
+		if s.Number == seasonNum {
+			removed = true
+			continue
+		}
+		out = append(out, s)
+	}
+	if !removed {
+		return false
+	}
+	item.Seasons = out
+	item.UpdatedAt = time.Now()
+	return true
+}
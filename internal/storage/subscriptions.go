@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Subscription asks for a message whenever a series gets new episodes.
+type Subscription struct {
+	UserID    int64     `bson:"user_id"`
+	KPID      int       `bson:"kp_id"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// NewEpisode is one added episode (or voice of an episode) waiting to be
+// announced.
+type NewEpisode struct {
+	Season  int    `bson:"season"`
+	Episode int    `bson:"episode"`
+	Voice   string `bson:"voice,omitempty"`
+}
+
+// EpisodeNotice collects the new episodes of one series so that uploading a
+// whole season sends one message per subscriber. It is due once no episode
+// has been added for a while (DueAt) or when it has waited long enough
+// (MaxDueAt), whichever comes first.
+type EpisodeNotice struct {
+	KPID     int          `bson:"kp_id"`
+	Episodes []NewEpisode `bson:"episodes"`
+	FirstAt  time.Time    `bson:"first_at"`
+	DueAt    time.Time    `bson:"due_at"`
+	MaxDueAt time.Time    `bson:"max_due_at"`
+}
+
+func (n *EpisodeNotice) due(now time.Time) bool {
+	return !now.Before(n.DueAt) || !now.Before(n.MaxDueAt)
+}
+
+// maxNoticesPerTake bounds how many series one TakeDueNotices call claims.
+const maxNoticesPerTake = 20
+
+// NoticeDelivery is one notice message waiting for one subscriber. A due
+// EpisodeNotice is expanded into deliveries, which are then claimed one by
+// one, so a flush that runs out of time leaves the rest queued instead of
+// dropping them.
+type NoticeDelivery struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	UserID   int64              `bson:"user_id"`
+	KPID     int                `bson:"kp_id"`
+	Episodes []NewEpisode       `bson:"episodes"`
+	Attempts int                `bson:"attempts,omitempty"`
+	DueAt    time.Time          `bson:"due_at"`
+}
+
+func (m *Mongo) Subscribe(ctx context.Context, userID int64, kpID int) error {
+	if m == nil {
+		return errors.New("mongo not configured")
+	}
+	_, err := m.subscriptions.UpdateOne(ctx,
+		bson.M{"user_id": userID, "kp_id": kpID},
+		bson.M{"$setOnInsert": Subscription{UserID: userID, KPID: kpID, CreatedAt: time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (m *Mongo) Unsubscribe(ctx context.Context, userID int64, kpID int) error {
+	if m == nil {
+		return nil
+	}
+	_, err := m.subscriptions.DeleteOne(ctx, bson.M{"user_id": userID, "kp_id": kpID})
+	return err
+}
+
+func (m *Mongo) IsSubscribed(ctx context.Context, userID int64, kpID int) (bool, error) {
+	if m == nil {
+		return false, errors.New("mongo not configured")
+	}
+	n, err := m.subscriptions.CountDocuments(ctx, bson.M{"user_id": userID, "kp_id": kpID}, options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+func (m *Mongo) Subscribers(ctx context.Context, kpID int) ([]int64, error) {
+	if m == nil {
+		return nil, errors.New("mongo not configured")
+	}
+	cur, err := m.subscriptions.Find(ctx, bson.M{"kp_id": kpID})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	out := []int64{}
+	for cur.Next(ctx) {
+		var s Subscription
+		if err := cur.Decode(&s); err != nil {
+			continue
+		}
+		out = append(out, s.UserID)
+	}
+	return out, cur.Err()
+}
+
+func (m *Mongo) QueueEpisodeNotice(ctx context.Context, kpID int, ep NewEpisode, delay time.Duration, maxDelay time.Duration) error {
+	if m == nil {
+		return nil
+	}
+	now := time.Now()
+	_, err := m.notices.UpdateOne(ctx,
+		bson.M{"kp_id": kpID},
+		bson.M{
+			"$addToSet":    bson.M{"episodes": ep},
+			"$set":         bson.M{"due_at": now.Add(delay)},
+			"$setOnInsert": bson.M{"first_at": now, "max_due_at": now.Add(maxDelay)},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// TakeDueNotices removes and returns the notices that are due. Each notice
+// is claimed with FindOneAndDelete, so concurrent callers never both send it.
+func (m *Mongo) TakeDueNotices(ctx context.Context, now time.Time) ([]EpisodeNotice, error) {
+	if m == nil {
+		return nil, errors.New("mongo not configured")
+	}
+	filter := bson.M{"$or": bson.A{
+		bson.M{"due_at": bson.M{"$lte": now}},
+		bson.M{"max_due_at": bson.M{"$lte": now}},
+	}}
+	out := []EpisodeNotice{}
+	for len(out) < maxNoticesPerTake {
+		var n EpisodeNotice
+		err := m.notices.FindOneAndDelete(ctx, filter).Decode(&n)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return out, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func (m *Mongo) QueueNoticeDeliveries(ctx context.Context, ds []NoticeDelivery) error {
+	if m == nil {
+		return errors.New("mongo not configured")
+	}
+	if len(ds) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(ds))
+	for i, d := range ds {
+		docs[i] = d
+	}
+	_, err := m.deliveries.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	return err
+}
+
+// TakeNoticeDelivery removes and returns the delivery that has been due the
+// longest, or nil if none is due.
+func (m *Mongo) TakeNoticeDelivery(ctx context.Context, now time.Time) (*NoticeDelivery, error) {
+	if m == nil {
+		return nil, errors.New("mongo not configured")
+	}
+	var d NoticeDelivery
+	err := m.deliveries.FindOneAndDelete(ctx,
+		bson.M{"due_at": bson.M{"$lte": now}},
+		options.FindOneAndDelete().SetSort(bson.D{bson.E{Key: "due_at", Value: 1}}),
+	).Decode(&d)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (m *Memory) Subscribe(ctx context.Context, userID int64, kpID int) error {
+	if m == nil {
+		return errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := userTitleKey{userID: userID, kpID: kpID}
+	if _, ok := m.subscriptions[key]; !ok {
+		m.subscriptions[key] = Subscription{UserID: userID, KPID: kpID, CreatedAt: time.Now()}
+	}
+	return nil
+}
+
+func (m *Memory) Unsubscribe(ctx context.Context, userID int64, kpID int) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	delete(m.subscriptions, userTitleKey{userID: userID, kpID: kpID})
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) IsSubscribed(ctx context.Context, userID int64, kpID int) (bool, error) {
+	if m == nil {
+		return false, errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.subscriptions[userTitleKey{userID: userID, kpID: kpID}]
+	return ok, nil
+}
+
+func (m *Memory) Subscribers(ctx context.Context, kpID int) ([]int64, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []int64{}
+	for k := range m.subscriptions {
+		if k.kpID == kpID {
+			out = append(out, k.userID)
+		}
+	}
+	return out, nil
+}
+
+func (m *Memory) QueueEpisodeNotice(ctx context.Context, kpID int, ep NewEpisode, delay time.Duration, maxDelay time.Duration) error {
+	if m == nil {
+		return nil
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.notices[kpID]
+	if !ok {
+		n = EpisodeNotice{KPID: kpID, FirstAt: now, MaxDueAt: now.Add(maxDelay)}
+	}
+	dup := false
+	for _, e := range n.Episodes {
+		if e == ep {
+			dup = true
+			break
+		}
+	}
+	if !dup {
+		n.Episodes = append(n.Episodes, ep)
+	}
+	n.DueAt = now.Add(delay)
+	m.notices[kpID] = n
+	return nil
+}
+
+func (m *Memory) TakeDueNotices(ctx context.Context, now time.Time) ([]EpisodeNotice, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []EpisodeNotice{}
+	for kpID, n := range m.notices {
+		if len(out) >= maxNoticesPerTake {
+			break
+		}
+		if n.due(now) {
+			out = append(out, n)
+			delete(m.notices, kpID)
+		}
+	}
+	return out, nil
+}
+
+func (m *Memory) QueueNoticeDeliveries(ctx context.Context, ds []NoticeDelivery) error {
+	if m == nil {
+		return errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	m.deliveries = append(m.deliveries, ds...)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) TakeNoticeDelivery(ctx context.Context, now time.Time) (*NoticeDelivery, error) {
+	if m == nil {
+		return nil, errors.New("memory store not configured")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	best := -1
+	for i, d := range m.deliveries {
+		if d.DueAt.After(now) {
+			continue
+		}
+		if best < 0 || d.DueAt.Before(m.deliveries[best].DueAt) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil, nil
+	}
+	d := m.deliveries[best]
+	m.deliveries = append(m.deliveries[:best], m.deliveries[best+1:]...)
+	return &d, nil
+}
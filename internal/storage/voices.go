@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+)
+
+// Voice is a dub available for a series. IDs are assigned once per item and
+// never reused, so keyboards keep pointing at the same voice when new dubs
+// are added later.
+type Voice struct {
+	ID   int    `bson:"id"`
+	Name string `bson:"name"`
+}
+
+// VoiceByID returns the voice registered under id.
+func (w *WatchItem) VoiceByID(id int) (Voice, bool) {
+	if w == nil || id <= 0 {
+		return Voice{}, false
+	}
+	for _, v := range w.Voices {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return Voice{}, false
+}
+
+// VoiceName returns the name of voice id, or "" if there is no such voice.
+func (w *WatchItem) VoiceName(id int) string {
+	v, _ := w.VoiceByID(id)
+	return v.Name
+}
+
+// FindVoice looks a voice up by name, ignoring case.
+func (w *WatchItem) FindVoice(name string) (Voice, bool) {
+	name = strings.TrimSpace(name)
+	if w == nil || name == "" {
+		return Voice{}, false
+	}
+	for _, v := range w.Voices {
+		if strings.EqualFold(v.Name, name) {
+			return v, true
+		}
+	}
+	return Voice{}, false
+}
+
+// syncVoices registers every voice used by the episodes of item and stamps
+// the variants with their voice IDs. Episodes stored before variants existed
+// only have the legacy Voice field, which counts too. Unregistered names get
+// new IDs in name order, so items stored before voices existed get the same
+// IDs on every read until the first write persists them.
+func syncVoices(item *WatchItem) {
+	if item == nil || item.Type != "series" {
+		return
+	}
+	next := 1
+	for _, v := range item.Voices {
+		if v.ID >= next {
+			next = v.ID + 1
+		}
+	}
+	var missing []string
+	seen := map[string]struct{}{}
+	for _, s := range item.Seasons {
+		for _, ep := range s.Episodes {
+			names := []string{ep.Voice}
+			if len(ep.Variants) > 0 {
+				names = names[:0]
+				for _, v := range ep.Variants {
+					names = append(names, v.Voice)
+				}
+			}
+			for _, name := range names {
+				name = strings.TrimSpace(name)
+				key := strings.ToLower(name)
+				if name == "" {
+					continue
+				}
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
+				if _, ok := item.FindVoice(name); !ok {
+					missing = append(missing, name)
+				}
+			}
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		item.Voices = append(item.Voices, Voice{ID: next, Name: name})
+		next++
+	}
+	for si := range item.Seasons {
+		eps := item.Seasons[si].Episodes
+		for ei := range eps {
+			for vi := range eps[ei].Variants {
+				v := &eps[ei].Variants[vi]
+				if found, ok := item.FindVoice(v.Voice); ok {
+					v.VoiceID = found.ID
+				}
+			}
+		}
+	}
+}
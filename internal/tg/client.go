@@ -4,21 +4,34 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"time"
 )
 
 type Client struct {
-	baseURL string
-	hc      *http.Client
+	baseURL    string
+	hc         *http.Client
+	maxRetries int
+	limiter    *Limiter
 }
 
 func NewClient(token string) *Client {
+	return NewClientWithLimiter(token, NewLimiter(DefaultRateLimits()))
+}
+
+// NewClientWithLimiter takes the limits from the caller's configuration and
+// lets several clients share one Limiter. A nil limiter disables
+// client-side throttling.
+func NewClientWithLimiter(token string, limiter *Limiter) *Client {
 	return &Client{
-		baseURL: fmt.Sprintf("https://api.telegram.org/bot%s", token),
-		hc:      &http.Client{Timeout: 9 * time.Second},
+		baseURL:    fmt.Sprintf("https://api.telegram.org/bot%s", token),
+		hc:         &http.Client{Timeout: 9 * time.Second},
+		maxRetries: 3,
+		limiter:    limiter,
 	}
 }
 
@@ -77,7 +90,7 @@ type AnswerInlineQueryRequest struct {
 }
 
 func (c *Client) AnswerInlineQuery(ctx context.Context, req AnswerInlineQueryRequest) error {
-	return c.post(ctx, "/answerInlineQuery", req)
+	return c.post(ctx, 0, "/answerInlineQuery", req)
 }
 
 func (c *Client) AnswerCallbackQuery(ctx context.Context, callbackQueryID string, text string) error {
@@ -85,11 +98,11 @@ func (c *Client) AnswerCallbackQuery(ctx context.Context, callbackQueryID string
 	if text != "" {
 		payload["text"] = text
 	}
-	return c.post(ctx, "/answerCallbackQuery", payload)
+	return c.post(ctx, 0, "/answerCallbackQuery", payload)
 }
 
 func (c *Client) DeleteMessage(ctx context.Context, chatID int64, messageID int) error {
-	return c.post(ctx, "/deleteMessage", map[string]any{"chat_id": chatID, "message_id": messageID})
+	return c.post(ctx, 0, "/deleteMessage", map[string]any{"chat_id": chatID, "message_id": messageID})
 }
 
 type SendMessageRequest struct {
@@ -101,7 +114,22 @@ type SendMessageRequest struct {
 }
 
 func (c *Client) SendMessage(ctx context.Context, req SendMessageRequest) error {
-	return c.post(ctx, "/sendMessage", req)
+	return c.post(ctx, req.ChatID, "/sendMessage", req)
+}
+
+// SendMessageWithResult is SendMessage that returns the new message id.
+func (c *Client) SendMessageWithResult(ctx context.Context, req SendMessageRequest) (int, error) {
+	resp, err := c.postWithResult(ctx, req.ChatID, "/sendMessage", req)
+	if err != nil {
+		return 0, err
+	}
+	var result struct {
+		MessageID int `json:"message_id"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return 0, err
+	}
+	return result.MessageID, nil
 }
 
 type SendPhotoRequest struct {
@@ -113,7 +141,7 @@ type SendPhotoRequest struct {
 }
 
 func (c *Client) SendPhoto(ctx context.Context, req SendPhotoRequest) error {
-	return c.post(ctx, "/sendPhoto", req)
+	return c.post(ctx, req.ChatID, "/sendPhoto", req)
 }
 
 type EditMessageTextRequest struct {
@@ -124,8 +152,10 @@ type EditMessageTextRequest struct {
 	ReplyMarkup *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
 }
 
+// Edits don't count against the per-chat limit, which Telegram applies to
+// new messages, so they only take a token from the global bucket.
 func (c *Client) EditMessageText(ctx context.Context, req EditMessageTextRequest) error {
-	return c.post(ctx, "/editMessageText", req)
+	return c.post(ctx, 0, "/editMessageText", req)
 }
 
 type InputMediaPhoto struct {
@@ -144,7 +174,7 @@ type EditMessageMediaRequest struct {
 }
 
 func (c *Client) EditMessageMedia(ctx context.Context, req EditMessageMediaRequest) error {
-	return c.post(ctx, "/editMessageMedia", req)
+	return c.post(ctx, 0, "/editMessageMedia", req)
 }
 
 type EditMessageReplyMarkupRequest struct {
@@ -155,11 +185,11 @@ type EditMessageReplyMarkupRequest struct {
 }
 
 func (c *Client) EditMessageReplyMarkup(ctx context.Context, req EditMessageReplyMarkupRequest) error {
-	return c.post(ctx, "/editMessageReplyMarkup", req)
+	return c.post(ctx, 0, "/editMessageReplyMarkup", req)
 }
 
 func (c *Client) CopyMessage(ctx context.Context, toChatID int64, fromChatID int64, messageID int) (int, error) {
-	resp, err := c.postWithResult(ctx, "/copyMessage", map[string]any{"chat_id": toChatID, "from_chat_id": fromChatID, "message_id": messageID})
+	resp, err := c.postWithResult(ctx, toChatID, "/copyMessage", map[string]any{"chat_id": toChatID, "from_chat_id": fromChatID, "message_id": messageID})
 	if err != nil {
 		return 0, err
 	}
@@ -172,24 +202,165 @@ func (c *Client) CopyMessage(ctx context.Context, toChatID int64, fromChatID int
 	return result.MessageID, nil
 }
 
-func (c *Client) post(ctx context.Context, method string, payload any) error {
-	_, err := c.postWithResult(ctx, method, payload)
+// CopyMessages copies messageIDs in one call, so albums arrive as albums.
+// The ids must be in increasing order. It returns the new message ids. Each
+// message takes a global token; the chat is charged once, as for any send.
+func (c *Client) CopyMessages(ctx context.Context, toChatID int64, fromChatID int64, messageIDs []int) ([]int, error) {
+	resp, err := c.send(ctx, toChatID, len(messageIDs), "/copyMessages", map[string]any{"chat_id": toChatID, "from_chat_id": fromChatID, "message_ids": messageIDs})
+	if err != nil {
+		return nil, err
+	}
+	var result []struct {
+		MessageID int `json:"message_id"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(result))
+	for _, r := range result {
+		ids = append(ids, r.MessageID)
+	}
+	return ids, nil
+}
+
+// AllowedUpdates lists the update types the bot handles. It is sent with
+// setWebhook and getUpdates.
+var AllowedUpdates = []string{"message", "channel_post", "callback_query", "inline_query", "chosen_inline_result"}
+
+type SetWebhookRequest struct {
+	URL                string   `json:"url"`
+	SecretToken        string   `json:"secret_token,omitempty"`
+	AllowedUpdates     []string `json:"allowed_updates,omitempty"`
+	DropPendingUpdates bool     `json:"drop_pending_updates,omitempty"`
+	MaxConnections     int      `json:"max_connections,omitempty"`
+}
+
+func (c *Client) SetWebhook(ctx context.Context, req SetWebhookRequest) error {
+	return c.post(ctx, 0, "/setWebhook", req)
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, dropPendingUpdates bool) error {
+	return c.post(ctx, 0, "/deleteWebhook", map[string]any{"drop_pending_updates": dropPendingUpdates})
+}
+
+type WebhookInfo struct {
+	URL                  string   `json:"url"`
+	HasCustomCertificate bool     `json:"has_custom_certificate"`
+	PendingUpdateCount   int      `json:"pending_update_count"`
+	IPAddress            string   `json:"ip_address,omitempty"`
+	LastErrorDate        int64    `json:"last_error_date,omitempty"`
+	LastErrorMessage     string   `json:"last_error_message,omitempty"`
+	MaxConnections       int      `json:"max_connections,omitempty"`
+	AllowedUpdates       []string `json:"allowed_updates,omitempty"`
+}
+
+func (c *Client) GetWebhookInfo(ctx context.Context) (*WebhookInfo, error) {
+	resp, err := c.postWithResult(ctx, 0, "/getWebhookInfo", map[string]any{})
+	if err != nil {
+		return nil, err
+	}
+	var info WebhookInfo
+	if err := json.Unmarshal(resp, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+type BotCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+// BotCommandScope selects who sees a command list, e.g. {Type: "chat", ChatID: id}.
+type BotCommandScope struct {
+	Type   string `json:"type"`
+	ChatID int64  `json:"chat_id,omitempty"`
+}
+
+type SetMyCommandsRequest struct {
+	Commands []BotCommand     `json:"commands"`
+	Scope    *BotCommandScope `json:"scope,omitempty"`
+}
+
+func (c *Client) SetMyCommands(ctx context.Context, req SetMyCommandsRequest) error {
+	return c.post(ctx, 0, "/setMyCommands", req)
+}
+
+type User struct {
+	ID        int64  `json:"id"`
+	IsBot     bool   `json:"is_bot"`
+	FirstName string `json:"first_name"`
+	Username  string `json:"username,omitempty"`
+}
+
+func (c *Client) GetMe(ctx context.Context) (*User, error) {
+	resp, err := c.postWithResult(ctx, 0, "/getMe", map[string]any{})
+	if err != nil {
+		return nil, err
+	}
+	var u User
+	if err := json.Unmarshal(resp, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (c *Client) post(ctx context.Context, chatID int64, method string, payload any) error {
+	_, err := c.postWithResult(ctx, chatID, method, payload)
 	return err
 }
 
-func (c *Client) postWithResult(ctx context.Context, method string, payload any) ([]byte, error) {
-	b, _ := json.Marshal(payload)
-	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+method, bytes.NewReader(b))
+// postWithResult calls a Bot API method. chatID is the chat the request
+// writes to, it selects the per-chat rate limit (0 for none).
+func (c *Client) postWithResult(ctx context.Context, chatID int64, method string, payload any) ([]byte, error) {
+	return c.send(ctx, chatID, 1, method, payload)
+}
+
+// send is postWithResult for a request that sends n messages at once.
+func (c *Client) send(ctx context.Context, chatID int64, n int, method string, payload any) ([]byte, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.WaitN(ctx, chatID, n); err != nil {
+			return nil, err
+		}
+		result, err := c.do(ctx, method, b)
+		if err == nil || !IsTooManyRequests(err) || attempt >= c.maxRetries {
+			return result, err
+		}
+		var apiErr *APIError
+		errors.As(err, &apiErr)
+		wait := apiErr.RetryAfter()
+		if wait <= 0 {
+			wait = time.Second << attempt
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return nil, err
+		}
+		log.Printf("telegram api %s flood wait %s (attempt %d)", method, wait, attempt+1)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, method string, payload []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+method, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := c.hc.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		return nil, fmt.Errorf("telegram api %s status %d: %s", method, resp.StatusCode, string(body))
-	}
 	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
 	if err != nil {
 		return nil, err
@@ -197,9 +368,28 @@ func (c *Client) postWithResult(ctx context.Context, method string, payload any)
 	var wrapper struct {
 		Ok     bool            `json:"ok"`
 		Result json.RawMessage `json:"result"`
+		APIError
 	}
-	if err := json.Unmarshal(body, &wrapper); err == nil && wrapper.Ok {
-		return wrapper.Result, nil
+	if err := json.Unmarshal(body, &wrapper); err != nil {
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return nil, &APIError{Method: method, ErrorCode: resp.StatusCode, Description: truncate(string(body), 4096)}
+		}
+		return nil, fmt.Errorf("telegram api %s: decode response: %w", method, err)
+	}
+	if !wrapper.Ok || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := wrapper.APIError
+		apiErr.Method = method
+		if apiErr.ErrorCode == 0 {
+			apiErr.ErrorCode = resp.StatusCode
+		}
+		return nil, &apiErr
+	}
+	return wrapper.Result, nil
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
 	}
-	return body, nil
+	return s[:max]
 }
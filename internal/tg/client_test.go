@@ -0,0 +1,157 @@
+package tg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// botAPI serves the Bot API from respond and counts the calls.
+type botAPI struct {
+	srv   *httptest.Server
+	calls atomic.Int32
+}
+
+func newBotAPI(t *testing.T, respond func(call int32, w http.ResponseWriter)) *botAPI {
+	t.Helper()
+	b := &botAPI{}
+	b.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond(b.calls.Add(1), w)
+	}))
+	t.Cleanup(b.srv.Close)
+	return b
+}
+
+func (b *botAPI) client(limiter *Limiter) *Client {
+	c := NewClientWithLimiter("test", limiter)
+	c.baseURL = b.srv.URL
+	return c
+}
+
+func reply(w http.ResponseWriter, status int, body any) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func ok(w http.ResponseWriter) {
+	reply(w, http.StatusOK, map[string]any{"ok": true, "result": map[string]any{"message_id": 1}})
+}
+
+func TestEditsSkipChatLimit(t *testing.T) {
+	api := newBotAPI(t, func(_ int32, w http.ResponseWriter) { ok(w) })
+	c := api.client(NewLimiter(RateLimits{PrivateChat: Rate{Events: 1, Per: time.Minute}}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := c.CopyMessage(ctx, 42, -100, 5); err != nil {
+		t.Fatal(err)
+	}
+	kb := NewInlineKeyboardMarkup(nil)
+	if err := c.EditMessageReplyMarkup(ctx, EditMessageReplyMarkupRequest{ChatID: 42, MessageID: 1, ReplyMarkup: &kb}); err != nil {
+		t.Fatalf("edit after a send was throttled: %v", err)
+	}
+	if err := c.EditMessageText(ctx, EditMessageTextRequest{ChatID: 42, MessageID: 1, Text: "x"}); err != nil {
+		t.Fatalf("edit after a send was throttled: %v", err)
+	}
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if err := c.SendMessage(short, SendMessageRequest{ChatID: 42, Text: "x"}); err == nil {
+		t.Error("second send within the chat limit was not throttled")
+	}
+}
+
+func floodWait(w http.ResponseWriter, retryAfter int) {
+	reply(w, http.StatusTooManyRequests, map[string]any{
+		"ok": false, "error_code": 429, "description": "Too Many Requests: retry later",
+		"parameters": map[string]any{"retry_after": retryAfter},
+	})
+}
+
+func TestFloodWaitRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		floods     int32 // 429s before the call succeeds
+		retryAfter int
+		maxRetries int
+		timeout    time.Duration
+		cancelIn   time.Duration
+		wantCalls  int32
+		wantFlood  bool
+		minElapsed time.Duration
+		maxElapsed time.Duration
+	}{
+		{
+			name: "retries after retry_after", floods: 1, retryAfter: 1, maxRetries: 3, timeout: 5 * time.Second,
+			wantCalls: 2, minElapsed: time.Second, maxElapsed: 3 * time.Second,
+		},
+		{
+			name: "gives up when retry_after passes the deadline", floods: 1, retryAfter: 30, maxRetries: 3, timeout: 2 * time.Second,
+			wantCalls: 1, wantFlood: true, maxElapsed: 500 * time.Millisecond,
+		},
+		{
+			name: "gives up after maxRetries", floods: 5, retryAfter: 0, maxRetries: 0, timeout: 5 * time.Second,
+			wantCalls: 1, wantFlood: true, maxElapsed: 500 * time.Millisecond,
+		},
+		{
+			name: "stops waiting when the context is canceled", floods: 1, retryAfter: 5, maxRetries: 3, cancelIn: 50 * time.Millisecond,
+			wantCalls: 1, wantFlood: true, maxElapsed: time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newBotAPI(t, func(call int32, w http.ResponseWriter) {
+				if call <= tt.floods {
+					floodWait(w, tt.retryAfter)
+					return
+				}
+				ok(w)
+			})
+			c := api.client(nil)
+			c.maxRetries = tt.maxRetries
+			var ctx context.Context
+			var cancel context.CancelFunc
+			if tt.timeout > 0 {
+				ctx, cancel = context.WithTimeout(context.Background(), tt.timeout)
+			} else {
+				ctx, cancel = context.WithCancel(context.Background())
+				time.AfterFunc(tt.cancelIn, cancel)
+			}
+			defer cancel()
+
+			start := time.Now()
+			err := c.SendMessage(ctx, SendMessageRequest{ChatID: 42, Text: "x"})
+			elapsed := time.Since(start)
+			if tt.wantFlood != IsTooManyRequests(err) || (!tt.wantFlood && err != nil) {
+				t.Fatalf("err = %v, want flood error %v", err, tt.wantFlood)
+			}
+			if got := api.calls.Load(); got != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", got, tt.wantCalls)
+			}
+			if elapsed < tt.minElapsed || elapsed > tt.maxElapsed {
+				t.Errorf("took %s, want between %s and %s", elapsed, tt.minElapsed, tt.maxElapsed)
+			}
+		})
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	api := newBotAPI(t, func(_ int32, w http.ResponseWriter) {
+		reply(w, http.StatusForbidden, map[string]any{"ok": false, "error_code": 403, "description": "Forbidden: bot was blocked by the user"})
+	})
+	err := api.client(nil).SendMessage(context.Background(), SendMessageRequest{ChatID: 42, Text: "x"})
+	if !IsForbidden(err) || IsTooManyRequests(err) {
+		t.Fatalf("err = %v, want forbidden", err)
+	}
+	if got := api.calls.Load(); got != 1 {
+		t.Errorf("calls = %d, want 1 (403 is not retried)", got)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Method != "/sendMessage" {
+		t.Errorf("err = %#v, want an APIError for /sendMessage", err)
+	}
+}
@@ -0,0 +1,47 @@
+package tg
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ResponseParameters is the optional "parameters" object Telegram attaches
+// to failed requests.
+type ResponseParameters struct {
+	MigrateToChatID int64 `json:"migrate_to_chat_id,omitempty"`
+	RetryAfter      int   `json:"retry_after,omitempty"`
+}
+
+// APIError is returned for non-2xx responses and for ok:false bodies.
+type APIError struct {
+	Method      string             `json:"-"`
+	ErrorCode   int                `json:"error_code"`
+	Description string             `json:"description"`
+	Parameters  ResponseParameters `json:"parameters"`
+}
+
+func (e *APIError) Error() string {
+	if e.Parameters.RetryAfter > 0 {
+		return fmt.Sprintf("telegram api %s error %d: %s (retry after %ds)", e.Method, e.ErrorCode, e.Description, e.Parameters.RetryAfter)
+	}
+	return fmt.Sprintf("telegram api %s error %d: %s", e.Method, e.ErrorCode, e.Description)
+}
+
+// RetryAfter reports how long Telegram asked to wait before the next request.
+func (e *APIError) RetryAfter() time.Duration {
+	return time.Duration(e.Parameters.RetryAfter) * time.Second
+}
+
+// IsTooManyRequests reports whether err is a 429 flood-wait error.
+func IsTooManyRequests(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == http.StatusTooManyRequests
+}
+
+// IsForbidden reports whether err is a 403, e.g. the user blocked the bot.
+func IsForbidden(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == http.StatusForbidden
+}
@@ -0,0 +1,231 @@
+package tg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is a token bucket budget: Events per Per, with bursts up to Events.
+type Rate struct {
+	Events int
+	Per    time.Duration
+}
+
+// RateLimits configures Limiter. A zero Rate disables that limit.
+type RateLimits struct {
+	Global      Rate
+	PrivateChat Rate
+	GroupChat   Rate
+}
+
+// DefaultRateLimits follows the Bot API FAQ: about 30 messages per second
+// overall, one per second in a private chat and 20 per minute in a group.
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		Global:      Rate{Events: 30, Per: time.Second},
+		PrivateChat: Rate{Events: 1, Per: time.Second},
+		GroupChat:   Rate{Events: 20, Per: time.Minute},
+	}
+}
+
+// ParseRate reads a rate written as "30/1s" or "20/1m". "off" and "0" give
+// the zero Rate, which disables the limit.
+func ParseRate(s string) (Rate, error) {
+	s = strings.TrimSpace(s)
+	if strings.EqualFold(s, "off") || s == "0" {
+		return Rate{}, nil
+	}
+	events, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("rate %q: want <events>/<duration>", s)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(events))
+	if err != nil || n < 0 {
+		return Rate{}, fmt.Errorf("rate %q: bad event count", s)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(per))
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("rate %q: bad duration", s)
+	}
+	return Rate{Events: n, Per: d}, nil
+}
+
+// RateLimitsFromEnv starts from DefaultRateLimits and overrides the limits
+// set in TG_RATE_GLOBAL, TG_RATE_PRIVATE and TG_RATE_GROUP (see ParseRate).
+// Invalid values keep their default and are reported in the error.
+func RateLimitsFromEnv(getenv func(string) string) (RateLimits, error) {
+	limits := DefaultRateLimits()
+	var errs []error
+	for _, v := range []struct {
+		name string
+		dst  *Rate
+	}{
+		{"TG_RATE_GLOBAL", &limits.Global},
+		{"TG_RATE_PRIVATE", &limits.PrivateChat},
+		{"TG_RATE_GROUP", &limits.GroupChat},
+	} {
+		raw := getenv(v.name)
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		r, err := ParseRate(raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", v.name, err))
+			continue
+		}
+		*v.dst = r
+	}
+	return limits, errors.Join(errs...)
+}
+
+// maxIdleChatBuckets is how many per-chat buckets are kept before full
+// (idle) ones are dropped.
+const maxIdleChatBuckets = 1024
+
+// Limiter throttles outgoing requests client-side so bursts of copies and
+// edits don't run into 429s. It is safe for concurrent use and can be
+// shared by several Clients.
+type Limiter struct {
+	mu     sync.Mutex
+	limits RateLimits
+	global *bucket
+	chats  map[int64]*bucket
+	now    func() time.Time
+}
+
+func NewLimiter(limits RateLimits) *Limiter {
+	l := &Limiter{limits: limits, chats: map[int64]*bucket{}, now: time.Now}
+	l.global = newBucket(limits.Global, l.now())
+	return l
+}
+
+// Wait blocks until a request may be sent. chatID selects the per-chat
+// bucket; pass 0 for requests that are not sent into a chat.
+func (l *Limiter) Wait(ctx context.Context, chatID int64) error {
+	return l.WaitN(ctx, chatID, 1)
+}
+
+// WaitN is Wait for a request that sends n messages at once, such as
+// copyMessages. It takes n global tokens and one from the chat.
+func (l *Limiter) WaitN(ctx context.Context, chatID int64, n int) error {
+	if l == nil {
+		return nil
+	}
+	n = max(n, 1)
+	l.mu.Lock()
+	now := l.now()
+	wait := l.global.reserve(now, n)
+	chat := l.chatBucket(chatID, now)
+	if chat != nil {
+		if w := chat.reserve(now, 1); w > wait {
+			wait = w
+		}
+	}
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.global.cancel(n)
+		if chat != nil {
+			chat.cancel(1)
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (l *Limiter) chatBucket(chatID int64, now time.Time) *bucket {
+	if chatID == 0 {
+		return nil
+	}
+	if b, ok := l.chats[chatID]; ok {
+		return b
+	}
+	rate := l.limits.PrivateChat
+	if chatID < 0 {
+		rate = l.limits.GroupChat
+	}
+	b := newBucket(rate, now)
+	if b == nil {
+		return nil
+	}
+	if len(l.chats) >= maxIdleChatBuckets {
+		for id, old := range l.chats {
+			if old.full(now) {
+				delete(l.chats, id)
+			}
+		}
+	}
+	l.chats[chatID] = b
+	return b
+}
+
+type bucket struct {
+	tokens   float64
+	capacity float64
+	perSec   float64
+	last     time.Time
+}
+
+func newBucket(r Rate, now time.Time) *bucket {
+	if r.Events <= 0 || r.Per <= 0 {
+		return nil
+	}
+	return &bucket{
+		tokens:   float64(r.Events),
+		capacity: float64(r.Events),
+		perSec:   float64(r.Events) / r.Per.Seconds(),
+		last:     now,
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.perSec
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = now
+	}
+}
+
+// reserve takes n tokens and returns how long the caller has to wait for
+// them. Tokens may go negative, which queues later callers behind this one.
+func (b *bucket) reserve(now time.Time, n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.perSec * float64(time.Second))
+}
+
+func (b *bucket) cancel(n int) {
+	if b == nil {
+		return
+	}
+	b.tokens += float64(n)
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+}
+
+func (b *bucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.capacity
+}
@@ -0,0 +1,117 @@
+package tg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock drives Limiter.now; the timers in Wait still use real time.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time      { return c.t }
+func (c *fakeClock) add(d time.Duration) { c.t = c.t.Add(d) }
+func newTestLimiter(limits RateLimits) (*Limiter, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	l := NewLimiter(limits)
+	l.now = clock.now
+	l.global = newBucket(limits.Global, clock.now())
+	return l, clock
+}
+
+// immediate reports whether Wait returns without blocking.
+func immediate(l *Limiter, chatID int64, n int) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	return l.WaitN(ctx, chatID, n) == nil
+}
+
+func TestLimiterRefill(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits RateLimits
+		chatID int64
+		burst  int           // requests that pass at once
+		refill time.Duration // time after which one more passes
+	}{
+		{name: "global", limits: RateLimits{Global: Rate{Events: 3, Per: time.Second}}, burst: 3, refill: time.Second / 3},
+		{name: "private chat", limits: RateLimits{PrivateChat: Rate{Events: 1, Per: time.Second}}, chatID: 42, burst: 1, refill: time.Second},
+		{name: "group chat", limits: RateLimits{GroupChat: Rate{Events: 20, Per: time.Minute}}, chatID: -100, burst: 20, refill: 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock := newTestLimiter(tt.limits)
+			for i := 0; i < tt.burst; i++ {
+				if !immediate(l, tt.chatID, 1) {
+					t.Fatalf("request %d of the burst was throttled", i)
+				}
+			}
+			if immediate(l, tt.chatID, 1) {
+				t.Fatal("request over the burst was not throttled")
+			}
+			clock.add(tt.refill)
+			if !immediate(l, tt.chatID, 1) {
+				t.Error("request after refill was throttled")
+			}
+			if immediate(l, tt.chatID, 1) {
+				t.Error("refill gave more than one token")
+			}
+		})
+	}
+}
+
+func TestLimiterWaitsForToken(t *testing.T) {
+	l, _ := newTestLimiter(RateLimits{Global: Rate{Events: 1, Per: 50 * time.Millisecond}})
+	ctx := context.Background()
+	_ = l.Wait(ctx, 0)
+	start := time.Now()
+	if err := l.Wait(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("waited %s, want about 50ms", waited)
+	}
+}
+
+func TestLimiterCancelReturnsTokens(t *testing.T) {
+	l, clock := newTestLimiter(RateLimits{Global: Rate{Events: 2, Per: time.Second}})
+	if !immediate(l, 0, 2) {
+		t.Fatal("burst was throttled")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.Wait(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	// the canceled waiter must not keep its reservation
+	clock.add(time.Second / 2)
+	if !immediate(l, 0, 1) {
+		t.Error("token was lost to the canceled waiter")
+	}
+}
+
+func TestLimiterWaitN(t *testing.T) {
+	l, clock := newTestLimiter(RateLimits{
+		Global:      Rate{Events: 10, Per: time.Second},
+		PrivateChat: Rate{Events: 1, Per: time.Second},
+	})
+	if !immediate(l, 42, 10) {
+		t.Fatal("album of 10 was throttled")
+	}
+	if immediate(l, 0, 1) {
+		t.Error("global bucket was not charged per message")
+	}
+	// a second of refill covers the one chat token and the ten global ones
+	clock.add(time.Second + 100*time.Millisecond)
+	if !immediate(l, 42, 1) {
+		t.Error("chat was charged per message")
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	if err := l.Wait(context.Background(), 42); err != nil {
+		t.Fatal(err)
+	}
+}
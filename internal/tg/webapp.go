@@ -0,0 +1,72 @@
+package tg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebAppUser is the user field of Mini App init data.
+type WebAppUser struct {
+	ID        int64  `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name,omitempty"`
+	Username  string `json:"username,omitempty"`
+}
+
+var ErrInitData = errors.New("invalid web app init data")
+
+// ValidateInitData checks the hash of Telegram.WebApp.initData as described
+// in https://core.telegram.org/bots/webapps#validating-data-received-via-the-mini-app
+// and returns the user it was issued for. Data older than maxAge is rejected
+// unless maxAge is 0.
+func ValidateInitData(initData string, botToken string, maxAge time.Duration) (*WebAppUser, error) {
+	vals, err := url.ParseQuery(initData)
+	if err != nil {
+		return nil, ErrInitData
+	}
+	hash := vals.Get("hash")
+	if hash == "" {
+		return nil, ErrInitData
+	}
+	vals.Del("hash")
+
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		lines = append(lines, k+"="+vals.Get(k))
+	}
+
+	secret := hmac.New(sha256.New, []byte("WebAppData"))
+	secret.Write([]byte(botToken))
+	mac := hmac.New(sha256.New, secret.Sum(nil))
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	want := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(want), []byte(strings.ToLower(hash))) {
+		return nil, ErrInitData
+	}
+
+	if maxAge > 0 {
+		authDate, err := strconv.ParseInt(vals.Get("auth_date"), 10, 64)
+		if err != nil || time.Since(time.Unix(authDate, 0)) > maxAge {
+			return nil, ErrInitData
+		}
+	}
+
+	var u WebAppUser
+	if err := json.Unmarshal([]byte(vals.Get("user")), &u); err != nil || u.ID == 0 {
+		return nil, ErrInitData
+	}
+	return &u, nil
+}